@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+)
+
+// accessLogEntry is a request logged in the JSON access log format
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote_addr"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_seconds"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// accessLogWriter records the status and size of a response. Flushing and
+// hijacking are passed through for event streams and WebSockets.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker; hijacked connections are logged with
+// status 101
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not implement http.Hijacker")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLog returns a middleware logging every request to out once it
+// completes, in the common log format followed by the duration in seconds
+// or as JSON lines
+func accessLog(format string, out io.Writer) func(http.Handler) http.Handler {
+	var mutex sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			lw := &accessLogWriter{ResponseWriter: w}
+			next.ServeHTTP(lw, r)
+
+			entry := accessLogEntry{
+				Time:      start,
+				Remote:    r.RemoteAddr,
+				Method:    r.Method,
+				Path:      loggedPath(r),
+				Protocol:  r.Proto,
+				Status:    lw.status,
+				Bytes:     lw.bytes,
+				Duration:  time.Since(start).Seconds(),
+				UserAgent: r.UserAgent(),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				entry.Remote = host
+			}
+			if user, _, ok := r.BasicAuth(); ok {
+				entry.User = user
+			}
+
+			var line []byte
+			if format == accessLogJSON {
+				line, _ = json.Marshal(entry)
+				line = append(line, '\n')
+			} else {
+				line = []byte(commonLogLine(entry))
+			}
+			mutex.Lock()
+			out.Write(line)
+			mutex.Unlock()
+		})
+	}
+}
+
+// loggedPath returns the path and query of a request with the token query
+// parameter devices authenticate with redacted
+func loggedPath(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("token") {
+		return r.URL.RequestURI()
+	}
+	query.Set("token", "REDACTED")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// commonLogLine formats an entry in the common log format with the duration
+// appended
+func commonLogLine(entry accessLogEntry) string {
+	remote, user := entry.Remote, entry.User
+	if remote == "" {
+		remote = "-"
+	}
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %.3f\n",
+		remote, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strings.Join([]string{entry.Method, entry.Path, entry.Protocol}, " "),
+		entry.Status, entry.Bytes, entry.Duration)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Comparison operators of alert conditions
+var alertOperators = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// AlertConfig configures a threshold alert evaluated by the exporter. It
+// either compares a metric's series with a threshold or fires for devices
+// that went offline.
+type AlertConfig struct {
+	Name string `yaml:"name"`
+	// Metric is the name of an exposed gauge or counter, e.g.
+	// shelly_power_watts; every series is alerted on separately
+	Metric string `yaml:"metric"`
+	// Labels restricts the alert to series with these label values
+	Labels    map[string]string `yaml:"labels"`
+	Operator  string            `yaml:"operator"`
+	Threshold float64           `yaml:"threshold"`
+	// Offline alerts on devices that disappeared from discovery instead
+	Offline bool `yaml:"offline"`
+	// For is how long the condition must hold before the alert fires
+	For time.Duration `yaml:"for"`
+}
+
+// compile validates the alert
+func (c *AlertConfig) compile() error {
+	if c.Name == "" {
+		return fmt.Errorf("invalid alert: missing name")
+	}
+	if c.For < 0 {
+		return fmt.Errorf("invalid for of alert %s: must not be negative", c.Name)
+	}
+	if c.Offline {
+		if c.Metric != "" {
+			return fmt.Errorf("invalid alert %s: metric and offline are mutually exclusive", c.Name)
+		}
+		return nil
+	}
+	if c.Metric == "" {
+		return fmt.Errorf("invalid alert %s: metric or offline is required", c.Name)
+	}
+	if _, ok := alertOperators[c.Operator]; !ok {
+		operators := slices.Sorted(maps.Keys(alertOperators))
+		return fmt.Errorf("invalid operator '%s' of alert %s: must be one of %s", c.Operator, c.Name, strings.Join(operators, ", "))
+	}
+	return nil
+}
+
+// matches reports whether a metric carries the alert's label values
+func (c *AlertConfig) matches(m *dto.Metric) bool {
+	for name, value := range c.Labels {
+		if labelValue(m, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// alertState is the state of an alert for one series or device
+type alertState struct {
+	since  time.Time // When the condition started holding
+	firing bool
+	event  deviceEvent // Identifies the device of the last evaluation
+}
+
+// alertEvaluator evaluates the configured alerts and publishes their state
+// changes as device events
+type alertEvaluator struct {
+	alerts   []AlertConfig
+	gatherer prometheus.Gatherer
+	events   *broadcaster[deviceEvent]
+	log      *slog.Logger
+
+	states map[string]*alertState // Keyed by alert name and series or device
+	// offline holds the devices that went offline, keyed by device ID
+	offline map[string]deviceEvent
+}
+
+// newAlertEvaluator creates an evaluator of alerts on the gathered metrics
+func (e *ShellyExporter) newAlertEvaluator(alerts []AlertConfig, gatherer prometheus.Gatherer, log *slog.Logger) *alertEvaluator {
+	return &alertEvaluator{
+		alerts:   alerts,
+		gatherer: gatherer,
+		events:   e.deviceEvents,
+		log:      log,
+		states:   make(map[string]*alertState),
+		offline:  make(map[string]deviceEvent),
+	}
+}
+
+// run evaluates the alerts every interval until ctx is cancelled. Offline
+// devices are tracked from the lifecycle events, which must be subscribed
+// before discovery starts.
+func (a *alertEvaluator) run(ctx context.Context, interval time.Duration, lifecycle <-chan deviceEvent) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-lifecycle:
+			if !ok {
+				return
+			}
+			switch event.Event {
+			case eventOffline:
+				a.offline[event.DeviceID] = event
+			case eventOnline, eventDiscovered, eventIPChanged:
+				delete(a.offline, event.DeviceID)
+			}
+		case <-ticker.C:
+			a.evaluate(time.Now())
+		}
+	}
+}
+
+// evaluate checks every alert's condition and fires or resolves it
+func (a *alertEvaluator) evaluate(now time.Time) {
+	var families []*dto.MetricFamily
+	if slices.ContainsFunc(a.alerts, func(alert AlertConfig) bool { return !alert.Offline }) {
+		var err error
+		if families, err = a.gatherer.Gather(); err != nil {
+			a.log.Warn("Error gathering metrics for alerts", "error", err)
+		}
+	}
+
+	active := make(map[string]bool)
+	for i := range a.alerts {
+		alert := &a.alerts[i]
+		if alert.Offline {
+			for deviceID, event := range a.offline {
+				key := alert.Name + "\xff" + deviceID
+				active[key] = true
+				a.update(alert, key, event, nil, now.Sub(event.Time), now)
+			}
+			continue
+		}
+
+		holds := alertOperators[alert.Operator]
+		for _, mf := range families {
+			if mf.GetName() != alert.Metric {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				value, ok := metricValue(mf.GetType(), m)
+				if !ok || !alert.matches(m) || !holds(value, alert.Threshold) {
+					continue
+				}
+				key := alert.Name + "\xff" + seriesSignature(m)
+				active[key] = true
+				event := deviceEvent{
+					DeviceID:   labelValue(m, "device_id"),
+					DeviceName: labelValue(m, "device_name"),
+					DeviceType: labelValue(m, "device_type"),
+					IP:         labelValue(m, "ip_address"),
+				}
+				state := a.states[key]
+				held := time.Duration(0)
+				if state != nil {
+					held = now.Sub(state.since)
+				}
+				a.update(alert, key, event, &value, held, now)
+			}
+		}
+	}
+
+	// Conditions no longer holding resolve their alerts
+	for key, state := range a.states {
+		if active[key] {
+			continue
+		}
+		if state.firing {
+			event := state.event
+			event.Event = eventAlertResolved
+			event.Time = now
+			event.Value = nil
+			a.events.publish(event)
+			a.log.Info("Alert resolved", "alert", event.Alert, "device_id", event.DeviceID)
+		}
+		delete(a.states, key)
+	}
+}
+
+// update records that an alert's condition has held for a duration and
+// fires the alert once it held long enough
+func (a *alertEvaluator) update(alert *AlertConfig, key string, event deviceEvent, value *float64, held time.Duration, now time.Time) {
+	state, ok := a.states[key]
+	if !ok {
+		state = &alertState{since: now.Add(-held)}
+		a.states[key] = state
+	}
+	event.Alert = alert.Name
+	state.event = event
+	if state.firing || held < alert.For {
+		return
+	}
+
+	state.firing = true
+	event.Event = eventAlertFiring
+	event.Time = now
+	event.PreviousIP = ""
+	event.Value = value
+	a.events.publish(event)
+	a.log.Info("Alert firing", "alert", alert.Name, "device_id", event.DeviceID)
+}
+
+// metricValue returns the value of a gauge, counter or untyped metric
+func metricValue(t dto.MetricType, m *dto.Metric) (float64, bool) {
+	switch t {
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue(), true
+	case dto.MetricType_COUNTER:
+		return m.GetCounter().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
+
+// seriesSignature identifies a series of a metric family by its labels
+func seriesSignature(m *dto.Metric) string {
+	labels := make([]string, 0, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		labels = append(labels, label.GetName()+"\xff"+label.GetValue())
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, "\xff")
+}
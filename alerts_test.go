@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAlertCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		alert AlertConfig
+		valid bool
+	}{
+		{"threshold", AlertConfig{Name: "high", Metric: "shelly_power_watts", Operator: ">", Threshold: 2000}, true},
+		{"offline", AlertConfig{Name: "gone", Offline: true, For: time.Minute}, true},
+		{"missing name", AlertConfig{Metric: "shelly_power_watts", Operator: ">"}, false},
+		{"missing metric", AlertConfig{Name: "high", Operator: ">"}, false},
+		{"unknown operator", AlertConfig{Name: "high", Metric: "shelly_power_watts", Operator: "=>"}, false},
+		{"metric and offline", AlertConfig{Name: "both", Metric: "shelly_power_watts", Operator: ">", Offline: true}, false},
+		{"negative for", AlertConfig{Name: "high", Metric: "shelly_power_watts", Operator: ">", For: -time.Second}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.alert.compile(); (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAlertEvaluator(t *testing.T) {
+	e := newTestExporter(t)
+	power := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "shelly_power_watts", Help: "Power"}, []string{"device_id", "channel"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(power)
+	alerts := []AlertConfig{
+		{Name: "high", Metric: "shelly_power_watts", Labels: map[string]string{"channel": "0"}, Operator: ">", Threshold: 2000, For: time.Minute},
+		{Name: "gone", Offline: true, For: time.Minute},
+	}
+	a := e.newAlertEvaluator(alerts, registry, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	events := e.deviceEvents.subscribe()
+
+	// Each step sets the power of channel 0 and 1, evaluates the alerts at
+	// the given time and expects the published events
+	start := time.Unix(1700000000, 0)
+	steps := []struct {
+		name   string
+		at     time.Duration
+		power  [2]float64
+		events []string
+	}{
+		{"below threshold", 0, [2]float64{1500, 2500}, nil},
+		{"pending", 10 * time.Second, [2]float64{2500, 2500}, nil},
+		{"still pending", 69 * time.Second, [2]float64{2400, 2500}, nil},
+		{"fires", 70 * time.Second, [2]float64{2400, 2500}, []string{eventAlertFiring + " high"}},
+		{"fires once", 80 * time.Second, [2]float64{2400, 2500}, nil},
+		{"resolves", 90 * time.Second, [2]float64{1000, 2500}, []string{eventAlertResolved + " high"}},
+		{"pending again", 100 * time.Second, [2]float64{2100, 2500}, nil},
+		{"interrupted", 110 * time.Second, [2]float64{100, 2500}, nil},
+		{"restarts pending", 120 * time.Second, [2]float64{2100, 2500}, nil},
+		{"not yet firing", 170 * time.Second, [2]float64{2100, 2500}, nil},
+	}
+	for _, s := range steps {
+		power.WithLabelValues("plug", "0").Set(s.power[0])
+		power.WithLabelValues("plug", "1").Set(s.power[1])
+		a.evaluate(start.Add(s.at))
+		if got := drainEvents(events); !slices.Equal(got, s.events) {
+			t.Fatalf("%s: got events %v, want %v", s.name, got, s.events)
+		}
+	}
+
+	// Offline devices fire once offline for the duration, counted from the
+	// offline event
+	now := start.Add(time.Hour)
+	power.Reset()
+	a.offline["plug"] = deviceEvent{Event: eventOffline, DeviceID: "plug", Time: now.Add(-30 * time.Second)}
+	a.evaluate(now)
+	if got := drainEvents(events); len(got) != 0 {
+		t.Fatalf("got events %v before the device was offline for a minute", got)
+	}
+	a.evaluate(now.Add(30 * time.Second))
+	if got := drainEvents(events); !slices.Equal(got, []string{eventAlertFiring + " gone"}) {
+		t.Fatalf("got events %v, want the offline alert firing", got)
+	}
+	delete(a.offline, "plug")
+	a.evaluate(now.Add(40 * time.Second))
+	if got := drainEvents(events); !slices.Equal(got, []string{eventAlertResolved + " gone"}) {
+		t.Fatalf("got events %v, want the offline alert resolved", got)
+	}
+}
+
+// drainEvents returns the events published so far as event type and alert
+func drainEvents(events <-chan deviceEvent) []string {
+	var got []string
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event.Event+" "+event.Alert)
+		default:
+			return got
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device health states reported by the API
+const (
+	deviceHealthy   = "healthy"
+	deviceUnhealthy = "unhealthy"
+)
+
+// apiDevice is the JSON representation of a known device
+type apiDevice struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Type          string     `json:"type"`
+	IP            string     `json:"ip"`
+	MAC           string     `json:"mac"`
+	Firmware      string     `json:"firmware"`
+	Generation    int        `json:"gen"`
+	Pushed        bool       `json:"pushed"`
+	Source        string     `json:"source"`
+	Extender      string     `json:"extender,omitempty"`
+	DNSName       string     `json:"dns_name,omitempty"`
+	LastSeen      time.Time  `json:"last_seen"`
+	LastCollected *time.Time `json:"last_collected,omitempty"`
+	Health        string     `json:"health"`
+}
+
+// apiDevices returns the known devices with their collection health, sorted by ID
+func (e *ShellyExporter) apiDevices() []apiDevice {
+	readings := e.readings.Readings()
+
+	e.devicesMutex.RLock()
+	all := make(map[string]*ShellyDevice, len(e.knownDevices)+len(e.pushedDevices)+len(e.cloudDevices))
+	for _, device := range e.knownDevices {
+		all[device.DeviceID] = device
+	}
+	for deviceID, device := range e.pushedDevices {
+		all[deviceID] = device
+	}
+	for deviceID, device := range e.cloudDevices {
+		all[deviceID] = device
+	}
+	devices := make([]apiDevice, 0, len(all))
+	for _, device := range all {
+		d := apiDevice{
+			ID:         device.DeviceID,
+			Name:       device.DeviceName,
+			Type:       device.DeviceType,
+			IP:         device.IP,
+			MAC:        device.Mac,
+			Firmware:   device.Firmware,
+			Generation: device.Generation,
+			Pushed:     e.pushedDevices[device.DeviceID] == device,
+			Source:     device.Source,
+			Extender:   device.Extender,
+			DNSName:    device.DNSName,
+			LastSeen:   device.LastSeen,
+			Health:     deviceUnhealthy,
+		}
+		// A reading is only kept while the device's last collection succeeded
+		if reading, ok := readings[device.DeviceID]; ok {
+			d.LastCollected = &reading.collectedAt
+			d.Health = deviceHealthy
+		}
+		devices = append(devices, d)
+	}
+	e.devicesMutex.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// devicesHandler serves the known devices as JSON
+func (e *ShellyExporter) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.apiDevices())
+}
+
+// rawStatusHandler serves the status document the latest reading of a device
+// was built from, as returned by the device or the cloud, to help debug
+// missing metrics
+func (e *ShellyExporter) rawStatusHandler(w http.ResponseWriter, r *http.Request) {
+	reading, ok := e.readings.Readings()[r.PathValue("id")]
+	if !ok || reading.raw == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no status collected for this device"})
+		return
+	}
+	raw := redactCredentials(reading.raw)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", reading.collectedAt.UTC().Format(http.TimeFormat))
+	if _, err := w.Write(raw); err != nil {
+		slog.Error("Error writing HTTP response", "error", err)
+	}
+}
+
+// credentialFields are field names of device documents holding secrets
+var credentialFields = []string{"pass", "password", "auth_key", "token", "access_token"}
+
+// redactCredentials removes credential fields from a JSON document at any
+// depth, keeping the order of fields and numbers as they are. Documents that
+// can't be decoded are returned unchanged.
+func redactCredentials(raw json.RawMessage) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := redactValue(dec, &buf); err != nil {
+		return raw
+	}
+	return buf.Bytes()
+}
+
+// redactValue copies the next value of dec to buf without credential fields
+func redactValue(dec *json.Decoder, buf *bytes.Buffer) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		// Numbers are json.Number, which encodes as it was received
+		data, err := json.Marshal(token)
+		buf.Write(data)
+		return err
+	}
+
+	buf.WriteRune(rune(delim))
+	written := 0
+	for dec.More() {
+		if delim == '{' {
+			token, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+			if slices.Contains(credentialFields, strings.ToLower(key)) {
+				var skipped json.RawMessage
+				if err := dec.Decode(&skipped); err != nil {
+					return err
+				}
+				continue
+			}
+			if written > 0 {
+				buf.WriteByte(',')
+			}
+			data, _ := json.Marshal(key)
+			buf.Write(data)
+			buf.WriteByte(':')
+		} else if written > 0 {
+			buf.WriteByte(',')
+		}
+		if err := redactValue(dec, buf); err != nil {
+			return err
+		}
+		written++
+	}
+	// The closing delimiter
+	token, err = dec.Token()
+	if err != nil {
+		return err
+	}
+	buf.WriteRune(rune(token.(json.Delim)))
+	return nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing HTTP response", "error", err)
+	}
+}
+
+// discoverHandler runs an immediate discovery scan and returns its summary.
+// Calls are rate-limited to one per configured interval.
+func (e *ShellyExporter) discoverHandler(w http.ResponseWriter, r *http.Request) {
+	e.discoverLimiter.Lock()
+	if wait := e.config.DiscoverRateLimit - time.Since(e.lastDiscoverCall); wait > 0 {
+		e.discoverLimiter.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "discovery was triggered recently, retry later"})
+		return
+	}
+	e.lastDiscoverCall = time.Now()
+	e.discoverLimiter.Unlock()
+
+	e.discoveryLog.Info("On-demand device discovery triggered", "remote_addr", r.RemoteAddr)
+
+	// Finish the scan even if the client goes away so the result isn't partial
+	result := e.discoverDevices(context.WithoutCancel(r.Context()))
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRedactCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"nested", `{"wifi":{"ssid":"home","pass":"secret"},"cloud":{"enabled":true}}`, `{"wifi":{"ssid":"home"},"cloud":{"enabled":true}}`},
+		{"order and numbers", `{"z": 1.50, "Password": "x", "a": 12345678901234567890, "token": null}`, `{"z":1.50,"a":12345678901234567890}`},
+		{"arrays", `[{"auth_key":"k","id":1},{"id":2},[]]`, `[{"id":1},{"id":2},[]]`},
+		{"only credentials", `{"access_token":{"value":"x"}}`, `{}`},
+		{"invalid", `{"pass": "secret"`, `{"pass": "secret"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactCredentials(json.RawMessage(tt.raw)); string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig configures optional authentication of the exporter's endpoints
+type AuthConfig struct {
+	// BasicAuthUsers maps user names to bcrypt password hashes
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	BearerTokens   []string          `yaml:"bearer_tokens"`
+}
+
+// enabled reports whether any credentials are configured
+func (c AuthConfig) enabled() bool {
+	return len(c.BasicAuthUsers) > 0 || len(c.BearerTokens) > 0
+}
+
+// authorized reports whether the request carries valid credentials
+func (c AuthConfig) authorized(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, known := c.BasicAuthUsers[user]
+		if !known {
+			return false
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return c.validToken(token)
+	}
+	return false
+}
+
+// validToken reports whether token is one of the configured bearer tokens
+func (c AuthConfig) validToken(token string) bool {
+	for _, valid := range c.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// APIAuthConfig configures the tokens required by the endpoints that change
+// state, e.g. triggering discovery or switching relays, separately from the
+// credentials of /metrics
+type APIAuthConfig struct {
+	Tokens []string `yaml:"tokens"`
+	// TokensFile holds one token per line. It's read on every request, so
+	// tokens can be rotated without a restart.
+	TokensFile string `yaml:"tokens_file"`
+}
+
+// enabled reports whether API tokens are configured
+func (c APIAuthConfig) enabled() bool {
+	return len(c.Tokens) > 0 || c.TokensFile != ""
+}
+
+// tokens returns the configured tokens and those of the tokens file; blank
+// lines and lines starting with # are skipped
+func (c APIAuthConfig) tokens() ([]string, error) {
+	if c.TokensFile == "" {
+		return c.Tokens, nil
+	}
+	data, err := os.ReadFile(c.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+	tokens := slices.Clone(c.Tokens)
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+// requireAPIToken returns a middleware requiring one of the API tokens as
+// bearer token. Without API tokens configured, endpoints are protected by
+// fallback like all others.
+func requireAPIToken(c APIAuthConfig, fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if !c.enabled() {
+		return fallback
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokens, err := c.tokens()
+			if err != nil {
+				slog.Error("Error reading API tokens", "path", c.TokensFile, "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !(AuthConfig{BearerTokens: tokens}).validToken(token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="shelly-exporter"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authContextKey is the context key of the authentication settings of the
+// listener a request was received on
+type authContextKey struct{}
+
+// withListenerAuth returns a context carrying the authentication settings
+// of a listener, overriding the global ones
+func withListenerAuth(ctx context.Context, c AuthConfig) context.Context {
+	return context.WithValue(ctx, authContextKey{}, c)
+}
+
+// requestAuth returns the authentication settings applying to a request:
+// those of the listener it was received on, if any, otherwise c
+func requestAuth(r *http.Request, c AuthConfig) AuthConfig {
+	if auth, ok := r.Context().Value(authContextKey{}).(AuthConfig); ok {
+		return auth
+	}
+	return c
+}
+
+// requireAuth returns a middleware rejecting requests without valid
+// credentials; it passes requests through when no credentials are configured
+func requireAuth(global AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := requestAuth(r, global)
+			if c.enabled() && !c.authorized(r) {
+				if len(c.BasicAuthUsers) > 0 {
+					w.Header().Set("WWW-Authenticate", `Basic realm="shelly-exporter"`)
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// okHandler answers every request with 200
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// serveAuth runs a request with an Authorization header through a handler
+// and returns the status code
+func serveAuth(handler http.Handler, authorization string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/discover", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestRequireAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := AuthConfig{BasicAuthUsers: map[string]string{"admin": string(hash)}, BearerTokens: []string{"token1"}}
+
+	tests := []struct {
+		name          string
+		auth          AuthConfig
+		authorization string
+		want          int
+	}{
+		{"no credentials configured", AuthConfig{}, "", http.StatusOK},
+		{"missing credentials", auth, "", http.StatusUnauthorized},
+		{"basic", auth, "Basic YWRtaW46c2VjcmV0", http.StatusOK},                    // admin:secret
+		{"wrong password", auth, "Basic YWRtaW46d3Jvbmc=", http.StatusUnauthorized}, // admin:wrong
+		{"unknown user", auth, "Basic cm9vdDpzZWNyZXQ=", http.StatusUnauthorized},   // root:secret
+		{"bearer", auth, "Bearer token1", http.StatusOK},
+		{"wrong token", auth, "Bearer token2", http.StatusUnauthorized},
+		{"token as basic password", auth, "Basic YWRtaW46dG9rZW4x", http.StatusUnauthorized}, // admin:token1
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveAuth(requireAuth(tt.auth)(okHandler), tt.authorization); got != tt.want {
+				t.Errorf("got status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Listeners override the global credentials
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req = req.WithContext(withListenerAuth(req.Context(), AuthConfig{}))
+	rec := httptest.NewRecorder()
+	requireAuth(auth)(okHandler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d on a listener without credentials, want 200", rec.Code)
+	}
+}
+
+func TestRequireAPIToken(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokensFile, []byte("# Deploy pipeline\nfile-token\n\n  spaced-token  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fallback := requireAuth(AuthConfig{BearerTokens: []string{"metrics-token"}})
+
+	tests := []struct {
+		name          string
+		api           APIAuthConfig
+		authorization string
+		want          int
+	}{
+		{"fallback", APIAuthConfig{}, "Bearer metrics-token", http.StatusOK},
+		{"fallback rejects", APIAuthConfig{}, "Bearer api-token", http.StatusUnauthorized},
+		{"api token", APIAuthConfig{Tokens: []string{"api-token"}}, "Bearer api-token", http.StatusOK},
+		{"metrics token", APIAuthConfig{Tokens: []string{"api-token"}}, "Bearer metrics-token", http.StatusUnauthorized},
+		{"missing token", APIAuthConfig{Tokens: []string{"api-token"}}, "", http.StatusUnauthorized},
+		{"file token", APIAuthConfig{Tokens: []string{"api-token"}, TokensFile: tokensFile}, "Bearer file-token", http.StatusOK},
+		{"trimmed file token", APIAuthConfig{TokensFile: tokensFile}, "Bearer spaced-token", http.StatusOK},
+		{"comment", APIAuthConfig{TokensFile: tokensFile}, "Bearer # Deploy pipeline", http.StatusUnauthorized},
+		{"missing file", APIAuthConfig{TokensFile: tokensFile + ".missing"}, "Bearer file-token", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveAuth(requireAPIToken(tt.api, fallback)(okHandler), tt.authorization); got != tt.want {
+				t.Errorf("got status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// The file is read on every request, so tokens rotate without a restart
+	handler := requireAPIToken(APIAuthConfig{TokensFile: tokensFile}, fallback)(okHandler)
+	if err := os.WriteFile(tokensFile, []byte("rotated-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := serveAuth(handler, "Bearer file-token"); got != http.StatusUnauthorized {
+		t.Errorf("got status %d for a rotated token, want 401", got)
+	}
+	if got := serveAuth(handler, "Bearer rotated-token"); got != http.StatusOK {
+		t.Errorf("got status %d for the new token, want 200", got)
+	}
+}
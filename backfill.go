@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// BackfillConfig configures pushing the energy history stored by energy
+// meters to a Prometheus remote write endpoint
+type BackfillConfig struct {
+	// RemoteWriteURL is the remote write endpoint, e.g.
+	// http://prometheus:9090/api/v1/write
+	RemoteWriteURL string `yaml:"remote_write_url"`
+	BearerToken    string `yaml:"bearer_token"`
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	// MaxAge limits how far back history is pushed for a device seen for
+	// the first time
+	MaxAge   time.Duration `yaml:"max_age"`
+	Interval time.Duration `yaml:"interval"`
+	// StateFile persists up to when each device's history was pushed, so
+	// the gap since the last push is backfilled after a restart
+	StateFile string `yaml:"state_file"`
+}
+
+// enabled reports whether the energy history backfill is configured
+func (c BackfillConfig) enabled() bool {
+	return c.RemoteWriteURL != ""
+}
+
+// Gen1 energy meters store energy per minute for each of their meters
+var gen1EnergyMeters = map[string]int{
+	"SHEM":   2,
+	"SHEM-3": 3,
+}
+
+// emDataPhases are the phases of a three-phase energy counter, exported as
+// channels like the meters of the Gen1 3EM
+var emDataPhases = []string{"a", "b", "c"}
+
+// emDataMaxPages bounds the number of EMData.GetData requests made for a
+// single component and backfill run
+const emDataMaxPages = 100
+
+// energyHistory holds the energy measured per interval by one channel of an
+// energy meter
+type energyHistory struct {
+	channel string
+	records []energyRecord
+}
+
+// energyRecord is the energy consumed and returned during one interval
+// ending at time
+type energyRecord struct {
+	time     time.Time
+	active   float64
+	returned float64
+}
+
+// backfiller pushes the energy history of energy meters for the time up to
+// which it wasn't pushed yet
+type backfiller struct {
+	exporter   *ShellyExporter
+	cfg        BackfillConfig
+	log        *slog.Logger
+	client     *http.Client
+	mutex      sync.Mutex
+	watermarks map[string]int64 // Unix time up to which each device's history was pushed
+}
+
+// newBackfiller creates a backfiller and loads its persisted state; a
+// missing state file is not an error
+func (e *ShellyExporter) newBackfiller(cfg BackfillConfig, log *slog.Logger) (*backfiller, error) {
+	b := &backfiller{
+		exporter:   e,
+		cfg:        cfg,
+		log:        log,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		watermarks: make(map[string]int64),
+	}
+	if cfg.StateFile == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading backfill state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.watermarks); err != nil {
+		return nil, fmt.Errorf("parsing backfill state file %s: %w", cfg.StateFile, err)
+	}
+	return b, nil
+}
+
+// run pushes the history of all energy meters once the initial discovery
+// has completed and then every interval until ctx is cancelled
+func (b *backfiller) run(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	wait := time.NewTicker(time.Second)
+	for !b.exporter.ready.Load() {
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		case <-wait.C:
+		}
+	}
+	wait.Stop()
+
+	for {
+		b.backfillDevices(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backfillDevices pushes the history of every locally reachable energy meter
+func (b *backfiller) backfillDevices(ctx context.Context) {
+	b.exporter.devicesMutex.RLock()
+	devices := make([]ShellyDevice, 0, len(b.exporter.knownDevices))
+	for _, device := range b.exporter.knownDevices {
+		devices = append(devices, *device)
+	}
+	b.exporter.devicesMutex.RUnlock()
+
+	for _, dev := range devices {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := b.backfillDevice(ctx, &dev); err != nil {
+			b.log.Warn("Error backfilling energy history", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		}
+	}
+	if err := b.save(); err != nil {
+		b.log.Warn("Error saving backfill state", "path", b.cfg.StateFile, "error", err)
+	}
+}
+
+// backfillDevice fetches the history of a device recorded since its
+// watermark and pushes it. Devices without stored history are skipped.
+func (b *backfiller) backfillDevice(ctx context.Context, dev *ShellyDevice) error {
+	ctx = withDeviceAuth(ctx, dev)
+	now := time.Now()
+	from := now.Add(-b.cfg.MaxAge)
+	b.mutex.Lock()
+	if watermark, ok := b.watermarks[dev.DeviceID]; ok && time.Unix(watermark, 0).After(from) {
+		from = time.Unix(watermark, 0)
+	}
+	b.mutex.Unlock()
+
+	var histories []energyHistory
+	var err error
+	if dev.Generation >= 2 {
+		histories, err = b.fetchGen2History(ctx, dev, from, now)
+	} else if meters, ok := gen1EnergyMeters[strings.ToUpper(dev.DeviceType)]; ok {
+		histories, err = b.fetchGen1History(ctx, dev, meters, from)
+	}
+	if err != nil || len(histories) == 0 {
+		return err
+	}
+
+	families, last := b.historyFamilies(dev, histories)
+	if len(families) == 0 {
+		return nil
+	}
+	if err := b.write(ctx, families); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.watermarks[dev.DeviceID] = last.Unix()
+	b.mutex.Unlock()
+	b.log.Info("Backfilled energy history", "device_id", dev.DeviceID, "from", from, "to", last)
+	return nil
+}
+
+// fetchGen1History downloads the per-minute history of each meter of a Gen1
+// energy meter and keeps the records after from
+func (b *backfiller) fetchGen1History(ctx context.Context, dev *ShellyDevice, meters int, from time.Time) ([]energyHistory, error) {
+	var histories []energyHistory
+	for i := range meters {
+		resp, err := b.exporter.deviceGet(ctx, fmt.Sprintf("http://%s/emeter/%d/em_data.csv", dev.IP, i))
+		if err != nil {
+			return nil, err
+		}
+		records, err := parseEMDataCSV(resp, from)
+		closeBody(resp)
+		if err != nil {
+			return nil, fmt.Errorf("meter %d: %w", i, err)
+		}
+		histories = append(histories, energyHistory{channel: strconv.Itoa(i), records: records})
+	}
+	return histories, nil
+}
+
+// parseEMDataCSV parses the em_data.csv download of a Gen1 energy meter:
+// a header followed by the UTC start of each minute, the active and
+// returned energy in watt-hours and the minimum and maximum voltage
+func parseEMDataCSV(resp *http.Response, from time.Time) ([]energyRecord, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	reader := csv.NewReader(resp.Body)
+	reader.FieldsPerRecord = -1
+	if _, err := reader.Read(); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	var records []energyRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 {
+			continue
+		}
+		start, err := time.Parse("2006-01-02 15:04", strings.TrimSpace(row[0]))
+		if err != nil {
+			continue
+		}
+		active, errActive := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		returned, errReturned := strconv.ParseFloat(strings.TrimSpace(row[2]), 64)
+		end := start.Add(time.Minute)
+		if errActive != nil || errReturned != nil || !end.After(from) {
+			continue
+		}
+		records = append(records, energyRecord{time: end, active: active, returned: returned})
+	}
+	return records, nil
+}
+
+// emDataResponse is the result of an EMData.GetData or EM1Data.GetData call
+type emDataResponse struct {
+	Keys []string `json:"keys"`
+	Data []struct {
+		TS     int64       `json:"ts"`
+		Period int64       `json:"period"`
+		Values [][]float64 `json:"values"`
+	} `json:"data"`
+	NextRecordTS *int64 `json:"next_record_ts"`
+}
+
+// fetchGen2History pages through the stored history of the energy counter
+// components of a Gen2+ device
+func (b *backfiller) fetchGen2History(ctx context.Context, dev *ShellyDevice, from, to time.Time) ([]energyHistory, error) {
+	var status gen2Status
+	if _, ok := b.exporter.fetchStatus(ctx, dev, &status); !ok {
+		return nil, errors.New("getting status failed")
+	}
+
+	var histories []energyHistory
+	for _, key := range status.components("emdata") {
+		_, id, _ := splitComponentKey(key)
+		columns := make(map[string][2]string, len(emDataPhases))
+		for i, phase := range emDataPhases {
+			columns[strconv.Itoa(i)] = [2]string{phase + "_total_act_energy", phase + "_total_act_ret_energy"}
+		}
+		fetched, err := b.fetchEMData(ctx, dev, "EMData.GetData", id, columns, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		histories = append(histories, fetched...)
+	}
+	for _, key := range status.components("em1data") {
+		_, id, _ := splitComponentKey(key)
+		columns := map[string][2]string{strconv.Itoa(id): {"total_act_energy", "total_act_ret_energy"}}
+		fetched, err := b.fetchEMData(ctx, dev, "EM1Data.GetData", id, columns, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		histories = append(histories, fetched...)
+	}
+	return histories, nil
+}
+
+// fetchEMData fetches the records of an energy counter component between
+// from and to. columns maps each channel to the keys of its active and
+// returned energy.
+func (b *backfiller) fetchEMData(ctx context.Context, dev *ShellyDevice, method string, id int, columns map[string][2]string, from, to time.Time) ([]energyHistory, error) {
+	histories := make(map[string]*energyHistory, len(columns))
+	for channel := range columns {
+		histories[channel] = &energyHistory{channel: channel}
+	}
+
+	ts := from.Unix()
+	for range emDataMaxPages {
+		url := fmt.Sprintf("http://%s/rpc/%s?id=%d&ts=%d&end_ts=%d", dev.IP, method, id, ts, to.Unix())
+		resp, err := b.exporter.deviceGet(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		var page emDataResponse
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected response: %s", resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		closeBody(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		index := make(map[string]int, len(page.Keys))
+		for i, key := range page.Keys {
+			index[key] = i
+		}
+		for _, block := range page.Data {
+			for i, values := range block.Values {
+				end := time.Unix(block.TS+int64(i+1)*block.Period, 0)
+				for channel, keys := range columns {
+					active, okActive := index[keys[0]]
+					returned, okReturned := index[keys[1]]
+					if !okActive || active >= len(values) {
+						continue
+					}
+					record := energyRecord{time: end, active: values[active]}
+					if okReturned && returned < len(values) {
+						record.returned = values[returned]
+					}
+					histories[channel].records = append(histories[channel].records, record)
+				}
+			}
+		}
+
+		if page.NextRecordTS == nil || *page.NextRecordTS <= ts || *page.NextRecordTS >= to.Unix() {
+			break
+		}
+		ts = *page.NextRecordTS
+	}
+
+	result := make([]energyHistory, 0, len(histories))
+	for _, channel := range slices.Sorted(maps.Keys(histories)) {
+		result = append(result, *histories[channel])
+	}
+	return result, nil
+}
+
+// historyFamilies converts the histories of a device to timestamped metric
+// families and returns the time of the newest record
+func (b *backfiller) historyFamilies(dev *ShellyDevice, histories []energyHistory) ([]*dto.MetricFamily, time.Time) {
+	active := &dto.MetricFamily{
+		Name: proto.String("shelly_energy_history_active_watthours"),
+		Help: proto.String("Active energy consumed during the interval ending at the sample's timestamp, backfilled from the device's history"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	returned := &dto.MetricFamily{
+		Name: proto.String("shelly_energy_history_returned_watthours"),
+		Help: proto.String("Active energy returned to the grid during the interval ending at the sample's timestamp, backfilled from the device's history"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	var last time.Time
+	for _, history := range histories {
+		// Labels are modified per metric by the exposition, so each metric
+		// gets its own
+		labels := func() []*dto.LabelPair {
+			return []*dto.LabelPair{
+				{Name: proto.String("channel"), Value: proto.String(history.channel)},
+				{Name: proto.String("device_id"), Value: proto.String(dev.DeviceID)},
+				{Name: proto.String("device_name"), Value: proto.String(dev.DeviceName)},
+				{Name: proto.String("device_type"), Value: proto.String(dev.DeviceType)},
+			}
+		}
+		for _, record := range history.records {
+			timestamp := proto.Int64(record.time.UnixMilli())
+			active.Metric = append(active.Metric, &dto.Metric{
+				Label: labels(), Gauge: &dto.Gauge{Value: proto.Float64(record.active)}, TimestampMs: timestamp,
+			})
+			returned.Metric = append(returned.Metric, &dto.Metric{
+				Label: labels(), Gauge: &dto.Gauge{Value: proto.Float64(record.returned)}, TimestampMs: timestamp,
+			})
+			if record.time.After(last) {
+				last = record.time
+			}
+		}
+	}
+	if len(active.Metric) == 0 {
+		return nil, last
+	}
+	return []*dto.MetricFamily{active, returned}, last
+}
+
+// write pushes metric families through remote write after applying the
+// configured labels, like any other sink
+func (b *backfiller) write(ctx context.Context, families []*dto.MetricFamily) error {
+	gatherer := b.exporter.exposition(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	}))
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering history: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.cfg.RemoteWriteURL, encodeWriteRequest(families))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case b.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+b.cfg.BearerToken)
+	case b.cfg.Username != "":
+		req.SetBasicAuth(b.cfg.Username, b.cfg.Password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// save persists the watermarks when a state file is configured
+func (b *backfiller) save() error {
+	if b.cfg.StateFile == "" {
+		return nil
+	}
+	b.mutex.Lock()
+	data, err := json.Marshal(b.watermarks)
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.cfg.StateFile, data)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bluLabelNames are the labels identifying a BLU device relayed by a gateway
+var bluLabelNames = []string{"device_id", "device_name", "gateway_id"}
+
+// bluSensorLabelNames additionally identify one of several sensors of a kind
+var bluSensorLabelNames = append(append([]string{}, bluLabelNames...), "index")
+
+// bluDescs holds the descriptors of BLU device metrics
+type bluDescs struct {
+	rssi        *prometheus.Desc
+	battery     *prometheus.Desc
+	lastUpdate  *prometheus.Desc
+	temperature *prometheus.Desc
+	humidity    *prometheus.Desc
+	illuminance *prometheus.Desc
+	contact     *prometheus.Desc
+	motion      *prometheus.Desc
+	rotation    *prometheus.Desc
+	voltage     *prometheus.Desc
+}
+
+// newBLUDescs creates the descriptors of BLU device metrics
+func newBLUDescs() bluDescs {
+	return bluDescs{
+		rssi: prometheus.NewDesc(
+			"shelly_blu_rssi_dbm",
+			"Signal strength of the last BLE advertisement of a BLU device received by the gateway",
+			bluLabelNames, nil,
+		),
+		battery: prometheus.NewDesc(
+			"shelly_blu_battery_percent",
+			"Battery level of a BLU device in percent",
+			bluLabelNames, nil,
+		),
+		lastUpdate: prometheus.NewDesc(
+			"shelly_blu_last_update_timestamp_seconds",
+			"Unix timestamp of the last BLE advertisement of a BLU device received by the gateway",
+			bluLabelNames, nil,
+		),
+		temperature: prometheus.NewDesc(
+			"shelly_blu_temperature_celsius",
+			"Temperature measured by a BLU device in degrees Celsius",
+			bluSensorLabelNames, nil,
+		),
+		humidity: prometheus.NewDesc(
+			"shelly_blu_humidity_percent",
+			"Relative humidity measured by a BLU device in percent",
+			bluSensorLabelNames, nil,
+		),
+		illuminance: prometheus.NewDesc(
+			"shelly_blu_illuminance_lux",
+			"Illuminance measured by a BLU device in lux",
+			bluSensorLabelNames, nil,
+		),
+		contact: prometheus.NewDesc(
+			"shelly_blu_contact_open",
+			"Whether the window or door monitored by a BLU device is open (1) or closed (0)",
+			bluSensorLabelNames, nil,
+		),
+		motion: prometheus.NewDesc(
+			"shelly_blu_motion",
+			"Whether a BLU device currently detects motion (1) or not (0)",
+			bluSensorLabelNames, nil,
+		),
+		rotation: prometheus.NewDesc(
+			"shelly_blu_rotation_degrees",
+			"Tilt angle measured by a BLU device in degrees",
+			bluSensorLabelNames, nil,
+		),
+		voltage: prometheus.NewDesc(
+			"shelly_blu_voltage_volts",
+			"Voltage measured by a BLU device in volts",
+			bluSensorLabelNames, nil,
+		),
+	}
+}
+
+// all returns all BLU device metric descriptors
+func (d bluDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.rssi,
+		d.battery,
+		d.lastUpdate,
+		d.temperature,
+		d.humidity,
+		d.illuminance,
+		d.contact,
+		d.motion,
+		d.rotation,
+		d.voltage,
+	}
+}
+
+// sensor returns the descriptor of a BTHome object ID, or nil for objects
+// that aren't exported. Battery levels are taken from the device status.
+func (d bluDescs) sensor(objID int) *prometheus.Desc {
+	switch objID {
+	case 0x02, 0x45:
+		return d.temperature
+	case 0x03, 0x2e:
+		return d.humidity
+	case 0x05:
+		return d.illuminance
+	case 0x1a, 0x2d:
+		return d.contact
+	case 0x21:
+		return d.motion
+	case 0x3f:
+		return d.rotation
+	case 0x0c:
+		return d.voltage
+	}
+	return nil
+}
+
+// bthomeDeviceStatus is the status of a bthomedevice:N component, a BLU
+// device observed by the gateway
+type bthomeDeviceStatus struct {
+	RSSI          *float64 `json:"rssi"`
+	Battery       *float64 `json:"battery"`
+	LastUpdatedTS *float64 `json:"last_updated_ts"`
+}
+
+// bthomeDeviceConfig is the configuration of a bthomedevice:N component
+type bthomeDeviceConfig struct {
+	Addr string `json:"addr"`
+	Name string `json:"name"`
+}
+
+// bthomeSensorStatus is the status of a bthomesensor:N component, a single
+// BTHome object of a BLU device
+type bthomeSensorStatus struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// bthomeSensorConfig is the configuration of a bthomesensor:N component
+type bthomeSensorConfig struct {
+	Addr  string `json:"addr"`
+	ObjID int    `json:"obj_id"`
+	Idx   int    `json:"idx"`
+}
+
+// gen2Config is the Shelly.GetConfig result of a Gen2+ device together with
+// the configuration revision it was fetched at
+type gen2Config struct {
+	revision   int
+	components gen2Status
+}
+
+// configRevision returns the configuration revision reported in the sys status
+func (s gen2Status) configRevision() int {
+	var sys struct {
+		CfgRev int `json:"cfg_rev"`
+	}
+	s.component("sys", &sys)
+	return sys.CfgRev
+}
+
+// gen2ConfigKinds are the component kinds whose metrics need the device
+// configuration; every device has a sys component watched for drift
+var gen2ConfigKinds = []string{"sys", "switch", "input", "temperature", "humidity", "illuminance", "thermostat", "voltmeter", "em", "em1", "number", "boolean", "bthomedevice", "matter", "lora"}
+
+// needsConfig reports whether the status has components that can only be
+// exported with the device configuration, which isn't cached for its revision
+func (e *ShellyExporter) needsConfig(deviceID string, status gen2Status) bool {
+	if !slices.ContainsFunc(gen2ConfigKinds, func(kind string) bool { return len(status.components(kind)) > 0 }) {
+		return false
+	}
+	e.gen2ConfigsMutex.RLock()
+	defer e.gen2ConfigsMutex.RUnlock()
+
+	config, ok := e.gen2Configs[deviceID]
+	return !ok || config.revision != status.configRevision()
+}
+
+// cachedConfig returns the cached configuration of a Gen2+ device, or nil
+func (e *ShellyExporter) cachedConfig(deviceID string) *gen2Config {
+	e.gen2ConfigsMutex.RLock()
+	defer e.gen2ConfigsMutex.RUnlock()
+
+	return e.gen2Configs[deviceID]
+}
+
+// storeConfig caches the configuration of a Gen2+ device
+func (e *ShellyExporter) storeConfig(deviceID string, revision int, components gen2Status) {
+	e.gen2ConfigsMutex.Lock()
+	defer e.gen2ConfigsMutex.Unlock()
+
+	e.gen2Configs[deviceID] = &gen2Config{revision: revision, components: components}
+}
+
+// refreshConfig fetches the configuration of a Gen2+ device over HTTP when
+// its status requires it. Failures only leave out the dependent metrics.
+func (e *ShellyExporter) refreshConfig(ctx context.Context, dev *ShellyDevice, status gen2Status) {
+	if !e.needsConfig(dev.DeviceID, status) {
+		return
+	}
+
+	resp, err := e.deviceGet(ctx, fmt.Sprintf("http://%s/rpc/Shelly.GetConfig", dev.IP))
+	if err != nil {
+		e.collectionLog.Debug("Error getting config", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		return
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		e.collectionLog.Debug("Unexpected response getting config", "device_id", dev.DeviceID, "ip", dev.IP, "status", resp.Status)
+		return
+	}
+	var config gen2Status
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		e.collectionLog.Debug("Error decoding config", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		return
+	}
+	e.storeConfig(dev.DeviceID, status.configRevision(), config)
+}
+
+// bluSamples returns the samples of the BLU devices relayed by a gateway,
+// labeled with the BLU device's MAC address as device ID
+func (e *ShellyExporter) bluSamples(gateway *ShellyDevice, status gen2Status) []deviceSample {
+	config := e.cachedConfig(gateway.DeviceID)
+	if config == nil {
+		return nil
+	}
+
+	var samples []deviceSample
+	names := make(map[string]string)
+	for _, key := range status.components("bthomedevice") {
+		var devConfig bthomeDeviceConfig
+		var devStatus bthomeDeviceStatus
+		if !config.components.component(key, &devConfig) || !status.component(key, &devStatus) || devConfig.Addr == "" {
+			continue
+		}
+		deviceID := bluDeviceID(devConfig.Addr)
+		name := devConfig.Name
+		if name == "" {
+			name = deviceID
+		}
+		names[deviceID] = name
+
+		samples = appendValues(samples, []string{deviceID, name, gateway.DeviceID},
+			optionalValue{e.descs.blu.rssi, prometheus.GaugeValue, devStatus.RSSI},
+			optionalValue{e.descs.blu.battery, prometheus.GaugeValue, devStatus.Battery},
+			optionalValue{e.descs.blu.lastUpdate, prometheus.GaugeValue, devStatus.LastUpdatedTS},
+		)
+	}
+
+	for _, key := range status.components("bthomesensor") {
+		var sensorConfig bthomeSensorConfig
+		var sensorStatus bthomeSensorStatus
+		if !config.components.component(key, &sensorConfig) || !status.component(key, &sensorStatus) {
+			continue
+		}
+		desc := e.descs.blu.sensor(sensorConfig.ObjID)
+		value, ok := bthomeValue(sensorStatus.Value)
+		deviceID := bluDeviceID(sensorConfig.Addr)
+		name, known := names[deviceID]
+		if desc == nil || !ok || !known {
+			continue
+		}
+		samples = append(samples, deviceSample{
+			Desc: desc, ValueType: prometheus.GaugeValue, Value: value,
+			LabelValues: []string{deviceID, name, gateway.DeviceID, strconv.Itoa(sensorConfig.Idx)},
+		})
+	}
+	return samples
+}
+
+// bluDeviceID returns the device ID of a BLU device, its lower-case MAC address
+func bluDeviceID(addr string) string {
+	return strings.ToLower(addr)
+}
+
+// bthomeValue converts a BTHome sensor value to a float; binary sensors
+// report booleans
+func bthomeValue(raw json.RawMessage) (float64, bool) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
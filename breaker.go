@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Circuit breaker states, exported as the value of shelly_circuit_breaker_state
+const (
+	breakerClosed   = 0 // Polled normally
+	breakerOpen     = 1 // Not polled until the cool-down elapsed
+	breakerHalfOpen = 2 // Polled once to test whether the device recovered
+)
+
+// BreakerConfig configures the per-device circuit breaker, which stops
+// polling a device after consecutive failed collections for a cool-down, so
+// a few dead devices don't keep collection cycles waiting on their timeouts
+type BreakerConfig struct {
+	Failures int           `yaml:"failures"` // 0 disables the breaker
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// enabled reports whether the circuit breaker is enabled
+func (c BreakerConfig) enabled() bool {
+	return c.Failures > 0
+}
+
+// compile validates the circuit breaker configuration
+func (c BreakerConfig) compile() error {
+	if c.Failures < 0 {
+		return fmt.Errorf("invalid circuit breaker failures %d: must not be negative", c.Failures)
+	}
+	if c.enabled() && c.Cooldown <= 0 {
+		return fmt.Errorf("invalid circuit breaker cool-down %s: must be positive", c.Cooldown)
+	}
+	return nil
+}
+
+// breaker is the circuit breaker of a device
+type breaker struct {
+	state    int
+	failures int       // Consecutive failed collections
+	openedAt time.Time // When the breaker last opened
+}
+
+// allowedDevices returns the devices whose circuit breaker lets them be
+// polled. Open breakers whose cool-down elapsed turn half-open, letting a
+// single collection through.
+func (e *ShellyExporter) allowedDevices(devices []*ShellyDevice) []*ShellyDevice {
+	if !e.config.Breaker.enabled() {
+		return devices
+	}
+
+	e.breakersMutex.Lock()
+	defer e.breakersMutex.Unlock()
+
+	allowed := devices[:0]
+	for _, device := range devices {
+		b, ok := e.breakers[device.DeviceID]
+		switch {
+		case !ok || b.state == breakerClosed:
+		case time.Since(b.openedAt) >= e.config.Breaker.Cooldown:
+			// Also retests half-open breakers whose collection never ran
+			e.setBreakerState(device.DeviceID, b, breakerHalfOpen)
+		default:
+			continue
+		}
+		allowed = append(allowed, device)
+	}
+	return allowed
+}
+
+// recordCollection updates the circuit breaker of a device with the outcome
+// of a collection
+func (e *ShellyExporter) recordCollection(dev *ShellyDevice, ok bool) {
+	if !e.config.Breaker.enabled() {
+		return
+	}
+
+	e.breakersMutex.Lock()
+	defer e.breakersMutex.Unlock()
+
+	b, known := e.breakers[dev.DeviceID]
+	if !known {
+		b = &breaker{}
+		e.breakers[dev.DeviceID] = b
+		e.breakerStates.WithLabelValues(dev.DeviceID).Set(breakerClosed)
+	}
+	if ok {
+		if b.state != breakerClosed {
+			e.collectionLog.Info("Device recovered, resuming polling", "device_id", dev.DeviceID, "ip", dev.IP)
+		}
+		b.failures = 0
+		e.setBreakerState(dev.DeviceID, b, breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= e.config.Breaker.Failures {
+		if b.state == breakerClosed {
+			e.collectionLog.Warn("Device failed repeatedly, pausing polling", "device_id", dev.DeviceID, "ip", dev.IP, "failures", b.failures, "cooldown", e.config.Breaker.Cooldown)
+		}
+		b.openedAt = time.Now()
+		e.setBreakerState(dev.DeviceID, b, breakerOpen)
+	}
+}
+
+// setBreakerState changes the state of a device's circuit breaker. The
+// caller must hold breakersMutex.
+func (e *ShellyExporter) setBreakerState(deviceID string, b *breaker, state int) {
+	b.state = state
+	e.breakerStates.WithLabelValues(deviceID).Set(float64(state))
+}
+
+// forgetBreakers drops the circuit breakers of devices that are no longer known
+func (e *ShellyExporter) forgetBreakers(known map[string]bool) {
+	e.breakersMutex.Lock()
+	defer e.breakersMutex.Unlock()
+	for deviceID := range e.breakers {
+		if !known[deviceID] {
+			delete(e.breakers, deviceID)
+			e.breakerStates.DeleteLabelValues(deviceID)
+		}
+	}
+}
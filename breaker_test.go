@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	e := newTestExporter(t)
+	e.config.Breaker = BreakerConfig{Failures: 2, Cooldown: time.Minute}
+	dev := &ShellyDevice{DeviceID: "shellyplug-s-ddeeff"}
+
+	// Each step records the outcome of a collection or checks whether the
+	// device may be polled
+	type step struct {
+		name    string
+		check   bool
+		ok      bool // Outcome of the collection
+		elapsed bool // Whether the cool-down elapsed before the check
+		allowed bool
+		state   int
+	}
+	steps := []step{
+		{"first failure", false, false, false, false, breakerClosed},
+		{"polled after one failure", true, false, false, true, breakerClosed},
+		{"second failure opens", false, false, false, false, breakerOpen},
+		{"paused during the cool-down", true, false, false, false, breakerOpen},
+		{"half-open after the cool-down", true, false, true, true, breakerHalfOpen},
+		{"retest fails", false, false, false, false, breakerOpen},
+		{"paused again", true, false, false, false, breakerOpen},
+		{"half-open again", true, false, true, true, breakerHalfOpen},
+		{"retest succeeds", false, true, false, false, breakerClosed},
+		{"polled after recovery", true, false, false, true, breakerClosed},
+		{"one failure after recovery", false, false, false, false, breakerClosed},
+	}
+	for _, s := range steps {
+		if s.check {
+			if s.elapsed {
+				e.breakers[dev.DeviceID].openedAt = time.Now().Add(-time.Minute)
+			}
+			if allowed := len(e.allowedDevices([]*ShellyDevice{dev})) == 1; allowed != s.allowed {
+				t.Fatalf("%s: got allowed %v, want %v", s.name, allowed, s.allowed)
+			}
+		} else {
+			e.recordCollection(dev, s.ok)
+		}
+		if state := e.breakers[dev.DeviceID].state; state != s.state {
+			t.Fatalf("%s: got state %d, want %d", s.name, state, s.state)
+		}
+	}
+
+	e.forgetBreakers(map[string]bool{})
+	if _, ok := e.breakers[dev.DeviceID]; ok {
+		t.Error("breaker of a forgotten device kept")
+	}
+}
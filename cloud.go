@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of device readings, exported as the source label
+const (
+	sourceLocal = "local"
+	sourceCloud = "cloud"
+)
+
+// CloudConfig configures collecting devices through the Shelly Cloud API
+type CloudConfig struct {
+	// Server is the account's cloud server, e.g. https://shelly-49-eu.shelly.cloud
+	Server   string        `yaml:"server"`
+	AuthKey  string        `yaml:"auth_key"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// enabled reports whether the Shelly Cloud collector is configured
+func (c CloudConfig) enabled() bool {
+	return c.Server != "" && c.AuthKey != ""
+}
+
+// cloudStatusResponse is the response of the cloud's /device/all_status call
+type cloudStatusResponse struct {
+	IsOK   bool `json:"isok"`
+	Errors any  `json:"errors"`
+	Data   struct {
+		DevicesStatus map[string]json.RawMessage `json:"devices_status"`
+	} `json:"data"`
+}
+
+// cloudDeviceStatus holds the fields of a cloud device status identifying the device
+type cloudDeviceStatus struct {
+	DevInfo struct {
+		ID     string `json:"id"`
+		Gen    string `json:"gen"`
+		Code   string `json:"code"`
+		Online bool   `json:"online"`
+	} `json:"_dev_info"`
+	WiFiSta struct {
+		IP string `json:"ip"`
+	} `json:"wifi_sta"` // Gen1
+	WiFi struct {
+		StaIP string `json:"sta_ip"`
+	} `json:"wifi"` // Gen2+
+	Mac string `json:"mac"`
+	Sys struct {
+		Mac string `json:"mac"`
+	} `json:"sys"`
+}
+
+// runCloudCollector collects the devices of a Shelly Cloud account until ctx
+// is cancelled. The cloud rate-limits requests, so a single status request
+// covering all devices is made per interval.
+func (e *ShellyExporter) runCloudCollector(ctx context.Context) {
+	ticker := time.NewTicker(e.config.Cloud.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.collectCloudDevices(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectCloudDevices fetches the status of all devices of the cloud account
+// and stores their readings
+func (e *ShellyExporter) collectCloudDevices(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.config.CollectTimeout)
+	defer cancel()
+
+	statuses, err := e.fetchCloudStatus(ctx)
+	if err != nil {
+		e.collectionLog.Warn("Error getting status from Shelly Cloud", "server", e.config.Cloud.Server, "error", err)
+		return
+	}
+
+	devices := make(map[string]*ShellyDevice, len(statuses))
+	readings := make([]*deviceReading, 0, len(statuses))
+	for id, raw := range statuses {
+		var info cloudDeviceStatus
+		if err := json.Unmarshal(raw, &info); err != nil {
+			e.collectionLog.Warn("Error decoding cloud device status", "device_id", id, "error", err)
+			continue
+		}
+		if !info.DevInfo.Online {
+			continue
+		}
+
+		dev := &ShellyDevice{
+			IP:         info.WiFiSta.IP,
+			DeviceID:   id,
+			DeviceName: id,
+			DeviceType: info.DevInfo.Code,
+			Mac:        info.Mac,
+			Generation: 1,
+			Source:     sourceCloud,
+			LastSeen:   time.Now(),
+		}
+
+		if gen := strings.TrimPrefix(info.DevInfo.Gen, "G"); gen != "" && gen != "1" {
+			dev.IP = info.WiFi.StaIP
+			dev.Mac = info.Sys.Mac
+			// Gen3 and Gen4 devices share the Gen2 API
+			dev.Generation = 2
+			if n, err := strconv.Atoi(gen); err == nil && n > 2 {
+				dev.Generation = n
+			}
+		}
+
+		if e.config.excludedType(dev.DeviceType) || !e.config.inShard(dev) {
+			continue
+		}
+
+		var reading *deviceReading
+		if dev.Generation > 1 {
+			var status gen2Status
+			if err := json.Unmarshal(raw, &status); err != nil {
+				e.collectionLog.Warn("Error decoding cloud device status", "device_id", id, "error", err)
+				continue
+			}
+			reading = e.newGen2Reading(dev, status)
+		} else {
+			var status ShellyStatus
+			if err := json.Unmarshal(raw, &status); err != nil {
+				e.collectionLog.Warn("Error decoding cloud device status", "device_id", id, "error", err)
+				continue
+			}
+			reading = e.newGen1Reading(dev, status)
+		}
+		reading.raw = raw
+		devices[id] = dev
+		readings = append(readings, reading)
+	}
+
+	e.devicesMutex.Lock()
+	previous := e.cloudDevices
+	devices = e.capCloudDevices(devices)
+	e.cloudDevices = devices
+	e.devicesMutex.Unlock()
+	readings = slices.DeleteFunc(readings, func(reading *deviceReading) bool {
+		_, ok := devices[reading.device.DeviceID]
+		return !ok
+	})
+
+	e.readings.Update(func(current map[string]*deviceReading) {
+		for id := range previous {
+			if _, ok := devices[id]; !ok {
+				delete(current, id)
+			}
+		}
+	})
+	for _, reading := range readings {
+		e.storeReading(reading)
+	}
+
+	e.collectionLog.Debug("Collected metrics from Shelly Cloud", "devices", len(devices))
+}
+
+// fetchCloudStatus returns the raw status of every device of the cloud account
+func (e *ShellyExporter) fetchCloudStatus(ctx context.Context) (map[string]json.RawMessage, error) {
+	form := url.Values{"auth_key": {e.config.Cloud.AuthKey}}
+	endpoint := strings.TrimSuffix(e.config.Cloud.Server, "/") + "/device/all_status"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	var status cloudStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if !status.IsOK {
+		return nil, fmt.Errorf("request failed: %v", status.Errors)
+	}
+	return status.Data.DevicesStatus, nil
+}
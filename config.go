@@ -0,0 +1,688 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Collection modes
+const (
+	collectionModeInterval = "interval"
+	collectionModeScrape   = "scrape"
+)
+
+// Config holds the exporter configuration
+type Config struct {
+	NetworkRange       string                  `yaml:"network_range"`
+	Targets            []string                `yaml:"targets"`
+	ReverseDNS         bool                    `yaml:"reverse_dns"`
+	DiscoveryInterval  time.Duration           `yaml:"discovery_interval"`
+	DiscoveryTimeout   time.Duration           `yaml:"discovery_timeout"`
+	DiscoveryRate      float64                 `yaml:"discovery_rate"`
+	FullSweepInterval  time.Duration           `yaml:"full_discovery_interval"`
+	DiscoverRateLimit  time.Duration           `yaml:"discover_rate_limit"`
+	MetricsInterval    time.Duration           `yaml:"metrics_interval"`
+	CollectTimeout     time.Duration           `yaml:"collect_timeout"`
+	StatusRetries      int                     `yaml:"status_retries"`
+	RetryBackoff       time.Duration           `yaml:"retry_backoff"`
+	Breaker            BreakerConfig           `yaml:"circuit_breaker"`
+	CollectionMode     string                  `yaml:"collection_mode"`
+	CollectionSpread   bool                    `yaml:"collection_spread"`
+	CollectionJitter   time.Duration           `yaml:"collection_jitter"`
+	ScrapeTimeout      time.Duration           `yaml:"scrape_timeout"`
+	ScrapeCacheTTL     time.Duration           `yaml:"scrape_cache_ttl"`
+	Port               string                  `yaml:"http_port"`
+	Listen             string                  `yaml:"http_listen"`
+	Listeners          []ListenConfig          `yaml:"listeners"`
+	TLS                TLSConfig               `yaml:"tls_server_config"`
+	Auth               AuthConfig              `yaml:"auth"`
+	APIAuth            APIAuthConfig           `yaml:"api_auth"`
+	DeviceAuth         DeviceAuthConfig        `yaml:"device_auth"`
+	PprofEnabled       bool                    `yaml:"pprof_enabled"`
+	ReadOnly           bool                    `yaml:"read_only"`
+	WSServerEnabled    bool                    `yaml:"ws_server_enabled"`
+	Gen2WebSocket      bool                    `yaml:"gen2_websocket"`
+	OTLP               OTLPConfig              `yaml:"otlp"`
+	Tracing            TracingConfig           `yaml:"tracing"`
+	InfluxDB           InfluxDBConfig          `yaml:"influxdb"`
+	MQTT               MQTTConfig              `yaml:"mqtt"`
+	Cloud              CloudConfig             `yaml:"cloud"`
+	HealthMaxIntervals int                     `yaml:"health_max_intervals"`
+	ShardIndex         int                     `yaml:"shard_index"`
+	ShardTotal         int                     `yaml:"shard_total"`
+	MaxDevices         int                     `yaml:"max_devices"`
+	MaxDeviceSeries    int                     `yaml:"max_device_series"`
+	HA                 HAConfig                `yaml:"ha"`
+	ShutdownTimeout    time.Duration           `yaml:"shutdown_timeout"`
+	LogFormat          string                  `yaml:"log_format"`
+	LogLevel           string                  `yaml:"log_level"`
+	LogDebug           []string                `yaml:"log_debug"`
+	AccessLog          string                  `yaml:"access_log"`
+	Devices            map[string]DeviceConfig `yaml:"devices"`
+	DeviceTypes        map[string]DeviceConfig `yaml:"device_types"`
+	ExcludeTypes       []string                `yaml:"exclude_device_types"`
+	DisabledGroups     []string                `yaml:"disabled_metric_groups"`
+	RelabelConfigs     []RelabelConfig         `yaml:"relabel_configs"`
+	Webhooks           []WebhookConfig         `yaml:"webhooks"`
+	Notifiers          []NotifierConfig        `yaml:"notifiers"`
+	Alerts             []AlertConfig           `yaml:"alerts"`
+	AlertInterval      time.Duration           `yaml:"alert_interval"`
+	MetricPrefix       string                  `yaml:"metric_prefix"`
+	ConstLabels        map[string]string       `yaml:"const_labels"`
+	VolatileLabels     string                  `yaml:"volatile_labels"`
+	SampleTimestamps   bool                    `yaml:"sample_timestamps"`
+	StateFile          string                  `yaml:"state_file"`
+	StateFlushInterval time.Duration           `yaml:"state_flush_interval"`
+	Pricing            PricingConfig           `yaml:"pricing"`
+	VoltageBand        VoltageBandConfig       `yaml:"voltage_band"`
+	FileSD             FileSDConfig            `yaml:"file_sd"`
+	Textfile           TextfileConfig          `yaml:"textfile"`
+	Backfill           BackfillConfig          `yaml:"backfill"`
+}
+
+// DeviceConfig holds per-device overrides, keyed by device ID or MAC address
+type DeviceConfig struct {
+	CollectTimeout time.Duration `yaml:"collect_timeout"`
+	// MetricsInterval overrides the interval the device is polled at
+	MetricsInterval time.Duration `yaml:"metrics_interval"`
+	// NoPolling excludes the device from polling, e.g. battery-powered
+	// devices that only report through webhooks
+	NoPolling bool `yaml:"no_polling"`
+	// Modbus collects a Pro 3EM over Modbus TCP instead of HTTP, which
+	// must be enabled on the device
+	Modbus bool `yaml:"modbus"`
+	// Labels are added to all series of the device, e.g. room or circuit
+	Labels map[string]string `yaml:"labels"`
+}
+
+// defaultConfig returns the configuration used when nothing is overridden
+func defaultConfig() Config {
+	return Config{
+		NetworkRange:       "10.10.10.0/24",
+		DiscoveryInterval:  60 * time.Second,
+		DiscoveryTimeout:   2 * time.Second,
+		DiscoverRateLimit:  10 * time.Second,
+		MetricsInterval:    10 * time.Second,
+		CollectTimeout:     5 * time.Second,
+		StatusRetries:      2,
+		RetryBackoff:       500 * time.Millisecond,
+		CollectionMode:     collectionModeInterval,
+		ScrapeTimeout:      8 * time.Second,
+		ScrapeCacheTTL:     5 * time.Second,
+		Port:               ":8080",
+		HealthMaxIntervals: 3,
+		ShardTotal:         1,
+		MaxDevices:         1000,
+		MaxDeviceSeries:    1000,
+		ShutdownTimeout:    15 * time.Second,
+		ReadOnly:           true,
+		AlertInterval:      15 * time.Second,
+		StateFlushInterval: time.Minute,
+		DeviceAuth: DeviceAuthConfig{
+			Username: "admin",
+		},
+		Breaker: BreakerConfig{
+			Failures: 5,
+			Cooldown: 5 * time.Minute,
+		},
+		OTLP: OTLPConfig{
+			Protocol: otlpProtocolHTTP,
+			Interval: 30 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Protocol:    otlpProtocolHTTP,
+			SampleRatio: 1,
+		},
+		InfluxDB: InfluxDBConfig{
+			Interval: 10 * time.Second,
+		},
+		MQTT: MQTTConfig{
+			ClientID:        "shelly-exporter",
+			DiscoveryPrefix: "homeassistant",
+			TopicPrefix:     "shelly-exporter",
+		},
+		HA: HAConfig{
+			LeaseDuration: 15 * time.Second,
+		},
+		Cloud: CloudConfig{
+			Interval: 30 * time.Second,
+		},
+		FileSD: FileSDConfig{
+			Interval: 60 * time.Second,
+		},
+		Textfile: TextfileConfig{
+			Interval: 15 * time.Second,
+		},
+		Backfill: BackfillConfig{
+			MaxAge:   24 * time.Hour,
+			Interval: time.Hour,
+		},
+		MetricPrefix:   defaultMetricPrefix,
+		VolatileLabels: volatileLabelsKeep,
+		LogFormat:      logFormatText,
+		LogLevel:       "info",
+	}
+}
+
+// envVar binds an environment variable to the configuration field it overrides
+type envVar struct {
+	name   string
+	target any
+}
+
+// envVars returns the environment variables that override configuration fields
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"NETWORK_RANGE", &c.NetworkRange},
+		{"TARGETS", &c.Targets},
+		{"REVERSE_DNS", &c.ReverseDNS},
+		{"DISCOVERY_INTERVAL", &c.DiscoveryInterval},
+		{"DISCOVERY_TIMEOUT", &c.DiscoveryTimeout},
+		{"DISCOVERY_RATE", &c.DiscoveryRate},
+		{"FULL_DISCOVERY_INTERVAL", &c.FullSweepInterval},
+		{"DISCOVER_RATE_LIMIT", &c.DiscoverRateLimit},
+		{"METRICS_INTERVAL", &c.MetricsInterval},
+		{"COLLECT_TIMEOUT", &c.CollectTimeout},
+		{"STATUS_RETRIES", &c.StatusRetries},
+		{"RETRY_BACKOFF", &c.RetryBackoff},
+		{"BREAKER_FAILURES", &c.Breaker.Failures},
+		{"BREAKER_COOLDOWN", &c.Breaker.Cooldown},
+		{"COLLECTION_MODE", &c.CollectionMode},
+		{"COLLECTION_SPREAD", &c.CollectionSpread},
+		{"COLLECTION_JITTER", &c.CollectionJitter},
+		{"SCRAPE_TIMEOUT", &c.ScrapeTimeout},
+		{"SCRAPE_CACHE_TTL", &c.ScrapeCacheTTL},
+		{"HTTP_PORT", &c.Port},
+		{"HTTP_LISTEN", &c.Listen},
+		{"TLS_CERT_FILE", &c.TLS.CertFile},
+		{"TLS_KEY_FILE", &c.TLS.KeyFile},
+		{"TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile},
+		{"AUTH_BEARER_TOKENS", &c.Auth.BearerTokens},
+		{"API_TOKENS", &c.APIAuth.Tokens},
+		{"API_TOKENS_FILE", &c.APIAuth.TokensFile},
+		{"DEVICE_USERNAME", &c.DeviceAuth.Username},
+		{"DEVICE_PASSWORD", &c.DeviceAuth.Password},
+		{"PPROF_ENABLED", &c.PprofEnabled},
+		{"READ_ONLY", &c.ReadOnly},
+		{"WS_SERVER_ENABLED", &c.WSServerEnabled},
+		{"GEN2_WEBSOCKET", &c.Gen2WebSocket},
+		{"OTLP_ENDPOINT", &c.OTLP.Endpoint},
+		{"OTLP_PROTOCOL", &c.OTLP.Protocol},
+		{"OTLP_INTERVAL", &c.OTLP.Interval},
+		{"OTLP_TRACES_ENDPOINT", &c.Tracing.Endpoint},
+		{"OTLP_TRACES_PROTOCOL", &c.Tracing.Protocol},
+		{"TRACES_SAMPLE_RATIO", &c.Tracing.SampleRatio},
+		{"INFLUXDB_URL", &c.InfluxDB.URL},
+		{"INFLUXDB_ORG", &c.InfluxDB.Org},
+		{"INFLUXDB_BUCKET", &c.InfluxDB.Bucket},
+		{"INFLUXDB_TOKEN", &c.InfluxDB.Token},
+		{"INFLUXDB_INTERVAL", &c.InfluxDB.Interval},
+		{"MQTT_BROKER", &c.MQTT.Broker},
+		{"MQTT_USERNAME", &c.MQTT.Username},
+		{"MQTT_PASSWORD", &c.MQTT.Password},
+		{"MQTT_CLIENT_ID", &c.MQTT.ClientID},
+		{"MQTT_DISCOVERY_PREFIX", &c.MQTT.DiscoveryPrefix},
+		{"MQTT_TOPIC_PREFIX", &c.MQTT.TopicPrefix},
+		{"SHELLY_CLOUD_SERVER", &c.Cloud.Server},
+		{"SHELLY_CLOUD_AUTH_KEY", &c.Cloud.AuthKey},
+		{"SHELLY_CLOUD_INTERVAL", &c.Cloud.Interval},
+		{"HEALTH_MAX_INTERVALS", &c.HealthMaxIntervals},
+		{"SHARD_INDEX", &c.ShardIndex},
+		{"SHARD_TOTAL", &c.ShardTotal},
+		{"MAX_DEVICES", &c.MaxDevices},
+		{"MAX_DEVICE_SERIES", &c.MaxDeviceSeries},
+		{"HA_LEASE_FILE", &c.HA.LeaseFile},
+		{"HA_LEASE_DURATION", &c.HA.LeaseDuration},
+		{"HA_IDENTITY", &c.HA.Identity},
+		{"SHUTDOWN_TIMEOUT", &c.ShutdownTimeout},
+		{"ALERT_INTERVAL", &c.AlertInterval},
+		{"LOG_FORMAT", &c.LogFormat},
+		{"LOG_LEVEL", &c.LogLevel},
+		{"LOG_DEBUG", &c.LogDebug},
+		{"ACCESS_LOG", &c.AccessLog},
+		{"METRIC_PREFIX", &c.MetricPrefix},
+		{"CONST_LABELS", &c.ConstLabels},
+		{"VOLATILE_LABELS", &c.VolatileLabels},
+		{"SAMPLE_TIMESTAMPS", &c.SampleTimestamps},
+		{"STATE_FILE", &c.StateFile},
+		{"STATE_FLUSH_INTERVAL", &c.StateFlushInterval},
+		{"ENERGY_PRICE", &c.Pricing.Rate},
+		{"ENERGY_CURRENCY", &c.Pricing.Currency},
+		{"VOLTAGE_MIN", &c.VoltageBand.Min},
+		{"VOLTAGE_MAX", &c.VoltageBand.Max},
+		{"EXCLUDE_DEVICE_TYPES", &c.ExcludeTypes},
+		{"DISABLED_METRIC_GROUPS", &c.DisabledGroups},
+		{"FILE_SD_PATH", &c.FileSD.Path},
+		{"FILE_SD_INTERVAL", &c.FileSD.Interval},
+		{"TEXTFILE_PATH", &c.Textfile.Path},
+		{"TEXTFILE_INTERVAL", &c.Textfile.Interval},
+		{"BACKFILL_REMOTE_WRITE_URL", &c.Backfill.RemoteWriteURL},
+		{"BACKFILL_BEARER_TOKEN", &c.Backfill.BearerToken},
+		{"BACKFILL_USERNAME", &c.Backfill.Username},
+		{"BACKFILL_PASSWORD", &c.Backfill.Password},
+		{"BACKFILL_MAX_AGE", &c.Backfill.MaxAge},
+		{"BACKFILL_INTERVAL", &c.Backfill.Interval},
+		{"BACKFILL_STATE_FILE", &c.Backfill.StateFile},
+	}
+}
+
+// applyEnv overrides configuration fields from environment variables
+func (c *Config) applyEnv() error {
+	for _, env := range c.envVars() {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+
+		switch target := env.target.(type) {
+		case *string:
+			*target = value
+		case *time.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s': %w", env.name, value, err)
+			}
+			*target = d
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s': %w", env.name, value, err)
+			}
+			*target = b
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s': %w", env.name, value, err)
+			}
+			*target = n
+		case *[]string:
+			var values []string
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			*target = values
+		case *float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s': %w", env.name, value, err)
+			}
+			*target = f
+		case *map[string]string:
+			values := make(map[string]string)
+			for _, pair := range strings.Split(value, ",") {
+				if pair = strings.TrimSpace(pair); pair == "" {
+					continue
+				}
+				k, v, ok := strings.Cut(pair, "=")
+				if !ok {
+					return fmt.Errorf("invalid %s '%s': expected name=value pairs", env.name, value)
+				}
+				values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+			*target = values
+		default:
+			return fmt.Errorf("unsupported type %T for %s", env.target, env.name)
+		}
+	}
+	return nil
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricPrefixPattern matches metric name prefixes, which may be empty
+var metricPrefixPattern = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)?$`)
+
+// validate checks the configuration and normalizes its values
+func (c *Config) validate() error {
+	switch c.CollectionMode {
+	case collectionModeInterval, collectionModeScrape:
+	default:
+		return fmt.Errorf("invalid collection mode '%s': must be %q or %q", c.CollectionMode, collectionModeInterval, collectionModeScrape)
+	}
+
+	switch c.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid log format '%s': must be %q or %q", c.LogFormat, logFormatText, logFormatJSON)
+	}
+
+	switch c.AccessLog {
+	case "", accessLogCommon, accessLogJSON:
+	default:
+		return fmt.Errorf("invalid access log format '%s': must be %q or %q", c.AccessLog, accessLogCommon, accessLogJSON)
+	}
+
+	// Zero or negative intervals would panic in tickers and time out every
+	// request; those of disabled features don't matter
+	type duration struct {
+		name  string
+		value time.Duration
+	}
+	durations := []duration{
+		{"metrics interval", c.MetricsInterval},
+		{"discovery interval", c.DiscoveryInterval},
+		{"discovery timeout", c.DiscoveryTimeout},
+		{"collect timeout", c.CollectTimeout},
+	}
+	if c.CollectionMode == collectionModeScrape {
+		durations = append(durations, duration{"scrape timeout", c.ScrapeTimeout}, duration{"scrape cache TTL", c.ScrapeCacheTTL})
+	}
+	if c.Cloud.enabled() {
+		durations = append(durations, duration{"Shelly Cloud interval", c.Cloud.Interval})
+	}
+	if c.InfluxDB.enabled() {
+		durations = append(durations, duration{"InfluxDB interval", c.InfluxDB.Interval})
+	}
+	if c.OTLP.enabled() {
+		durations = append(durations, duration{"OTLP interval", c.OTLP.Interval})
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("invalid %s %s: must be positive", d.name, d.value)
+		}
+	}
+
+	if _, err := c.APIAuth.tokens(); err != nil {
+		return fmt.Errorf("invalid API tokens file: %w", err)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("invalid trace sample ratio %g: must be between 0 and 1", c.Tracing.SampleRatio)
+	}
+
+	if c.StatusRetries < 0 {
+		return fmt.Errorf("invalid status retries %d: must not be negative", c.StatusRetries)
+	}
+	if c.RetryBackoff < 0 {
+		return fmt.Errorf("invalid retry backoff %s: must not be negative", c.RetryBackoff)
+	}
+
+	if err := c.Breaker.compile(); err != nil {
+		return err
+	}
+
+	if c.DiscoveryRate < 0 {
+		return fmt.Errorf("invalid discovery rate %g: must not be negative", c.DiscoveryRate)
+	}
+
+	if c.ShardTotal < 1 {
+		return fmt.Errorf("invalid shard total %d: must be at least 1", c.ShardTotal)
+	}
+	if c.ShardIndex < 0 || c.ShardIndex >= c.ShardTotal {
+		return fmt.Errorf("invalid shard index %d: must be between 0 and %d", c.ShardIndex, c.ShardTotal-1)
+	}
+
+	// The lease is renewed every third of its duration
+	if c.HA.LeaseDuration < time.Second {
+		return fmt.Errorf("invalid HA lease duration %s: must be at least 1s", c.HA.LeaseDuration)
+	}
+
+	if c.HealthMaxIntervals < 1 {
+		return fmt.Errorf("invalid health max intervals %d: must be at least 1", c.HealthMaxIntervals)
+	}
+
+	for _, subsystem := range c.LogDebug {
+		if !slices.Contains(logSubsystems, subsystem) {
+			return fmt.Errorf("invalid debug log subsystem '%s': must be one of %s", subsystem, strings.Join(logSubsystems, ", "))
+		}
+	}
+
+	// Ensure port starts with ':'
+	if !strings.HasPrefix(c.Port, ":") {
+		c.Port = ":" + c.Port
+	}
+	if c.Listen == unixListenPrefix {
+		return fmt.Errorf("invalid listen address '%s': missing socket path", c.Listen)
+	}
+	for i, listener := range c.Listeners {
+		if listener.Address == "" || listener.Address == unixListenPrefix {
+			return fmt.Errorf("invalid address '%s' of listener %d", listener.Address, i)
+		}
+	}
+	// Anyone reaching the endpoint could otherwise push readings as any device
+	if c.WSServerEnabled && len(c.Auth.BearerTokens) == 0 {
+		return fmt.Errorf("invalid WebSocket server: bearer tokens must be configured for devices to authenticate with")
+	}
+
+	switch c.VolatileLabels {
+	case volatileLabelsKeep, volatileLabelsDrop, volatileLabelsFreeze:
+	default:
+		return fmt.Errorf("invalid volatile labels mode '%s': must be %q, %q or %q", c.VolatileLabels, volatileLabelsKeep, volatileLabelsDrop, volatileLabelsFreeze)
+	}
+
+	if !metricPrefixPattern.MatchString(c.MetricPrefix) {
+		return fmt.Errorf("invalid metric prefix '%s'", c.MetricPrefix)
+	}
+	for name := range c.ConstLabels {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid const label name '%s'", name)
+		}
+	}
+
+	if c.FileSD.enabled() && c.FileSD.Interval <= 0 {
+		return fmt.Errorf("invalid file_sd interval %s: must be positive", c.FileSD.Interval)
+	}
+
+	if c.Textfile.enabled() {
+		// node_exporter only reads files with the .prom extension
+		if filepath.Ext(c.Textfile.Path) != ".prom" {
+			return fmt.Errorf("invalid textfile path '%s': must end in .prom", c.Textfile.Path)
+		}
+		if c.Textfile.Interval <= 0 {
+			return fmt.Errorf("invalid textfile interval %s: must be positive", c.Textfile.Interval)
+		}
+	}
+
+	if c.Backfill.enabled() {
+		if c.Backfill.MaxAge <= 0 {
+			return fmt.Errorf("invalid backfill max age %s: must be positive", c.Backfill.MaxAge)
+		}
+		if c.Backfill.Interval <= 0 {
+			return fmt.Errorf("invalid backfill interval %s: must be positive", c.Backfill.Interval)
+		}
+	}
+
+	for i := range c.RelabelConfigs {
+		if err := c.RelabelConfigs[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Notifiers {
+		if err := c.Notifiers[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Pricing.compile(); err != nil {
+		return err
+	}
+
+	if err := c.VoltageBand.compile(); err != nil {
+		return err
+	}
+
+	if c.StateFlushInterval <= 0 {
+		return fmt.Errorf("invalid state flush interval '%s': must be positive", c.StateFlushInterval)
+	}
+
+	if c.AlertInterval <= 0 {
+		return fmt.Errorf("invalid alert interval '%s': must be positive", c.AlertInterval)
+	}
+	for i := range c.Alerts {
+		if err := c.Alerts[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	// Normalize device keys so MAC addresses match regardless of notation
+	devices := make(map[string]DeviceConfig, len(c.Devices))
+	for key, device := range c.Devices {
+		for name := range device.Labels {
+			if !labelNamePattern.MatchString(name) {
+				return fmt.Errorf("invalid label name '%s' for device '%s'", name, key)
+			}
+		}
+		devices[normalizeDeviceKey(key)] = device
+	}
+	c.Devices = devices
+
+	// Device types are matched regardless of case
+	deviceTypes := make(map[string]DeviceConfig, len(c.DeviceTypes))
+	for deviceType, device := range c.DeviceTypes {
+		deviceTypes[strings.ToUpper(deviceType)] = device
+	}
+	c.DeviceTypes = deviceTypes
+
+	for _, group := range c.DisabledGroups {
+		if !slices.Contains(metricGroups, group) {
+			return fmt.Errorf("invalid metric group '%s': must be one of %s", group, strings.Join(metricGroups, ", "))
+		}
+	}
+
+	for i, pattern := range c.ExcludeTypes {
+		c.ExcludeTypes[i] = strings.ToUpper(pattern)
+		if _, err := path.Match(c.ExcludeTypes[i], ""); err != nil {
+			return fmt.Errorf("invalid excluded device type '%s': %w", pattern, err)
+		}
+	}
+
+	for key, device := range c.overrides() {
+		if device.MetricsInterval < 0 {
+			return fmt.Errorf("invalid metrics interval %s for '%s': must not be negative", device.MetricsInterval, key)
+		}
+		if device.CollectTimeout < 0 {
+			return fmt.Errorf("invalid collect timeout %s for '%s': must not be negative", device.CollectTimeout, key)
+		}
+	}
+
+	return nil
+}
+
+// overrides returns the per-device and per-device-type overrides by key
+func (c *Config) overrides() map[string]DeviceConfig {
+	overrides := make(map[string]DeviceConfig, len(c.Devices)+len(c.DeviceTypes))
+	maps.Copy(overrides, c.DeviceTypes)
+	maps.Copy(overrides, c.Devices)
+	return overrides
+}
+
+// pollInterval returns the interval a device is polled at and whether it is
+// polled at all. Device overrides take precedence over device type overrides.
+func (c *Config) pollInterval(dev *ShellyDevice) (time.Duration, bool) {
+	interval := c.MetricsInterval
+	for _, override := range []DeviceConfig{c.DeviceTypes[strings.ToUpper(dev.DeviceType)], c.deviceConfig(dev.DeviceID, dev.Mac)} {
+		if override.NoPolling {
+			return 0, false
+		}
+		if override.MetricsInterval > 0 {
+			interval = override.MetricsInterval
+		}
+	}
+	return interval, true
+}
+
+// excludedType reports whether devices of a type are excluded from
+// collection. Patterns match case-insensitively and may contain wildcards,
+// e.g. SHBLB-*.
+func (c *Config) excludedType(deviceType string) bool {
+	deviceType = strings.ToUpper(deviceType)
+	for _, pattern := range c.ExcludeTypes {
+		if ok, _ := path.Match(pattern, deviceType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inShard reports whether a device belongs to the shard of this instance.
+// Devices are assigned by a hash of their MAC address, or of their ID if the
+// MAC is unknown, so replicas with the same SHARD_TOTAL split them without
+// coordination.
+func (c *Config) inShard(dev *ShellyDevice) bool {
+	if c.ShardTotal <= 1 {
+		return true
+	}
+	key := strings.ToUpper(strings.ReplaceAll(dev.Mac, ":", ""))
+	if key == "" {
+		key = dev.DeviceID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(c.ShardTotal)) == c.ShardIndex
+}
+
+// collectionTick returns the interval of the collection loop, the shortest
+// of all polling intervals
+func (c *Config) collectionTick() time.Duration {
+	tick := c.MetricsInterval
+	for _, device := range c.overrides() {
+		if device.MetricsInterval > 0 {
+			tick = min(tick, device.MetricsInterval)
+		}
+	}
+	return tick
+}
+
+// normalizeDeviceKey lowercases a device ID or MAC address and strips MAC separators
+func normalizeDeviceKey(key string) string {
+	return strings.NewReplacer(":", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// deviceConfig returns the overrides for a device, looked up by device ID and then MAC address
+func (c *Config) deviceConfig(deviceID, mac string) DeviceConfig {
+	if device, ok := c.Devices[normalizeDeviceKey(deviceID)]; ok {
+		return device
+	}
+	if mac != "" {
+		if device, ok := c.Devices[normalizeDeviceKey(mac)]; ok {
+			return device
+		}
+	}
+	return DeviceConfig{}
+}
+
+// loadConfig reads the exporter configuration from the defaults, the optional
+// YAML file named by CONFIG_FILE and environment variables, in that order
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
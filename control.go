@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// requireWritable rejects requests to endpoints that actuate devices when the
+// exporter is read-only
+func requireWritable(readOnly bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !readOnly {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "the exporter is read-only, set READ_ONLY=false to control devices"})
+		})
+	}
+}
+
+// controlledDevice returns the device named by the id path value of a
+// request sending a command to a device. It writes the error response and
+// returns nil when the device is unknown or not reachable locally.
+func (e *ShellyExporter) controlledDevice(w http.ResponseWriter, r *http.Request) *ShellyDevice {
+	device := e.deviceByID(r.PathValue("id"))
+	if device == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown device"})
+		return nil
+	}
+	if device.Source == sourceCloud {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "device is only reachable through Shelly Cloud"})
+		return nil
+	}
+	return device
+}
+
+// relayResult is the JSON response of a relay command
+type relayResult struct {
+	DeviceID string `json:"device_id"`
+	Relay    int    `json:"relay"`
+	On       bool   `json:"on"`
+}
+
+// relayHandler switches a relay of a device, e.g.
+// POST /api/devices/shellyplug-s-ddeeff/relay/0?turn=on. The command is sent
+// to the device the same way its status is collected, with the configured
+// device credentials, so automations can reuse the exporter's inventory
+// instead of tracking device addresses.
+func (e *ShellyExporter) relayHandler(w http.ResponseWriter, r *http.Request) {
+	device := e.controlledDevice(w, r)
+	if device == nil {
+		return
+	}
+
+	relay, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || relay < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid relay"})
+		return
+	}
+	var on bool
+	switch turn := r.FormValue("turn"); turn {
+	case "on":
+		on = true
+	case "off":
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "turn must be on or off"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.collectTimeout(device))
+	defer cancel()
+	if err := e.switchRelay(ctx, device, relay, on); err != nil {
+		e.collectionLog.Warn("Error switching relay", "device_id", device.DeviceID, "relay", relay, "on", on, "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	e.collectionLog.Info("Relay switched", "device_id", device.DeviceID, "relay", relay, "on", on, "remote_addr", r.RemoteAddr)
+
+	// Show the new state right away; devices connected over a WebSocket
+	// push it themselves
+	if !e.isPushed(device.DeviceID) {
+		e.requestRefresh(device)
+	}
+	writeJSON(w, http.StatusOK, relayResult{DeviceID: device.DeviceID, Relay: relay, On: on})
+}
+
+// switchRelay turns a relay of a device on or off, through the relay
+// endpoint of Gen1 devices or the Switch.Set RPC of Gen2+ devices
+func (e *ShellyExporter) switchRelay(ctx context.Context, dev *ShellyDevice, relay int, on bool) error {
+	url := fmt.Sprintf("http://%s/rpc/Switch.Set?id=%d&on=%t", dev.IP, relay, on)
+	if dev.Generation == 1 {
+		turn := "off"
+		if on {
+			turn = "on"
+		}
+		url = fmt.Sprintf("http://%s/relay/%d?turn=%s", dev.IP, relay, turn)
+	}
+
+	resp, err := e.deviceGet(withDeviceAuth(ctx, dev), url)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusBadRequest:
+		return fmt.Errorf("device has no relay %d", relay)
+	}
+	return fmt.Errorf("unexpected response: %s", resp.Status)
+}
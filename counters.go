@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterStateVersion is the version of the state file format
+const counterStateVersion = 2
+
+// counterState tracks a device counter across resets
+type counterState struct {
+	// Last is the last raw value reported by the device
+	Last float64 `json:"last"`
+	// Offset is the sum of the values the counter had before each reset
+	Offset float64 `json:"offset"`
+}
+
+// savedSeries is a persisted series of an exporter-side counter
+type savedSeries struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// counterFile is the content of the state file
+type counterFile struct {
+	Version  int                      `json:"version"`
+	Counters map[string]*counterState `json:"counters"`
+	Totals   map[string]float64       `json:"totals"`
+	Events   map[string][]savedSeries `json:"events"`
+}
+
+// counterStore turns device counters that reset on reboot into monotonic
+// counters and accumulates the totals the exporter computes itself, e.g.
+// relay on time. Its state is optionally persisted, together with the event
+// counters, so resets while the exporter is down are detected and totals
+// don't restart from zero on every deploy.
+type counterStore struct {
+	mutex    sync.Mutex
+	path     string
+	counters map[string]*counterState
+	totals   map[string]float64
+	// events are the persisted exporter counters by name
+	events map[string]*prometheus.CounterVec
+	saved  []byte // Content of the state file as last read or written
+}
+
+// newCounterStore creates a counter store persisted to path; an empty path
+// keeps the state in memory only
+func newCounterStore(path string) *counterStore {
+	return &counterStore{
+		path:     path,
+		counters: make(map[string]*counterState),
+		totals:   make(map[string]float64),
+		events:   make(map[string]*prometheus.CounterVec),
+	}
+}
+
+// persist adds exporter counters to the persisted state. Their values are
+// restored by load, so they must be added before.
+func (s *counterStore) persist(name string, vec *prometheus.CounterVec) {
+	s.events[name] = vec
+}
+
+// load reads the persisted state; a missing state file is not an error
+func (s *counterStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading state file: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var file counterFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing state file %s: %w", s.path, err)
+	}
+	if file.Counters != nil {
+		s.counters = file.Counters
+	}
+	if file.Totals != nil {
+		s.totals = file.Totals
+	}
+	for name, series := range file.Events {
+		vec, ok := s.events[name]
+		if !ok {
+			continue
+		}
+		for _, saved := range series {
+			// Series whose labels no longer match the counter are dropped
+			if counter, err := vec.GetMetricWith(saved.Labels); err == nil {
+				counter.Add(saved.Value)
+			}
+		}
+	}
+	s.saved = data
+	return nil
+}
+
+// counterResetTolerance is the largest drop of a raw counter value taken as
+// rounding rather than a reset, in watt-hours like the energy counters
+const counterResetTolerance = 0.5
+
+// monotonic returns the monotonic value of a counter given its raw value. Any
+// drop beyond counterResetTolerance is taken as a reset, e.g. a reboot of a
+// device that keeps its counter in RAM; smaller drops from rounding keep the
+// last value.
+func (s *counterStore) monotonic(key string, raw float64) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, ok := s.counters[key]
+	if !ok {
+		state = &counterState{}
+		s.counters[key] = state
+	}
+	switch {
+	case raw < state.Last-counterResetTolerance:
+		state.Offset += state.Last
+	case raw < state.Last:
+		return state.Offset + state.Last
+	}
+	state.Last = raw
+	return state.Offset + raw
+}
+
+// add adds delta to a total and returns the new total
+func (s *counterStore) add(key string, delta float64) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.totals[key] += delta
+	return s.totals[key]
+}
+
+// advance records the current value of a monotonic counter and returns its
+// increase since the previous value; the first value counts as no increase
+func (s *counterStore) advance(key string, value float64) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	last, ok := s.totals[key]
+	s.totals[key] = value
+	if !ok || value < last {
+		return 0
+	}
+	return value - last
+}
+
+// save persists the state if it changed since the last save. The file is
+// replaced atomically so a crash never leaves a truncated state behind.
+func (s *counterStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := counterFile{Version: counterStateVersion, Events: make(map[string][]savedSeries, len(s.events))}
+	for name, vec := range s.events {
+		file.Events[name] = collectSeries(vec)
+	}
+
+	s.mutex.Lock()
+	file.Counters = s.counters
+	file.Totals = s.totals
+	data, err := json.Marshal(file)
+	unchanged := bytes.Equal(data, s.saved)
+	s.mutex.Unlock()
+	if err != nil || unchanged {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	s.mutex.Lock()
+	s.saved = data
+	s.mutex.Unlock()
+	return nil
+}
+
+// collectSeries returns the current series of a counter
+func collectSeries(vec *prometheus.CounterVec) []savedSeries {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var series []savedSeries
+	for metric := range ch {
+		var m dto.Metric
+		if metric.Write(&m) != nil {
+			continue
+		}
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		series = append(series, savedSeries{Labels: labels, Value: m.GetCounter().GetValue()})
+	}
+	// Collection order varies, sorting keeps unchanged state byte-identical
+	sort.Slice(series, func(i, j int) bool {
+		return fmt.Sprint(series[i].Labels) < fmt.Sprint(series[j].Labels)
+	})
+	return series
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary
+// file in the same directory, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// run periodically persists the state until ctx is cancelled, then saves it
+// a final time
+func (s *counterStore) run(ctx context.Context, interval time.Duration, log *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.save(); err != nil {
+				log.Error("Error saving counter state", "path", s.path, "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Warn("Error saving counter state", "path", s.path, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMonotonic(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []float64
+		want []float64
+	}{
+		{"increasing", []float64{10, 12.5, 20}, []float64{10, 12.5, 20}},
+		{"reboot", []float64{100, 120, 3, 10}, []float64{100, 120, 123, 130}},
+		{"reset to zero", []float64{50, 0, 0, 1}, []float64{50, 50, 50, 51}},
+		{"wrap", []float64{4294967290, 4294967295, 4}, []float64{4294967290, 4294967295, 4294967299}},
+		{"rounding", []float64{100, 99.6, 100.2}, []float64{100, 100, 100.2}},
+		{"beyond tolerance", []float64{100, 99.4}, []float64{100, 199.4}},
+		{"repeated resets", []float64{10, 2, 1, 5}, []float64{10, 12, 13, 17}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCounterStore("")
+			var got []float64
+			for _, raw := range tt.raw {
+				got = append(got, s.monotonic("switch:0", raw))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Counters are tracked separately
+	s := newCounterStore("")
+	s.monotonic("a", 100)
+	if got := s.monotonic("b", 5); got != 5 {
+		t.Errorf("got %g for a new counter, want 5", got)
+	}
+}
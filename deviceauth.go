@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// DeviceAuthConfig holds the credentials of password-protected devices. Gen1
+// devices check them with basic authentication, Gen2+ devices with digest
+// authentication, where the user name is always admin.
+type DeviceAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// enabled reports whether device credentials are configured
+func (c DeviceAuthConfig) enabled() bool {
+	return c.Password != ""
+}
+
+// deviceAuthKey is the context key of the device whose challenges requests
+// may answer
+type deviceAuthKey struct{}
+
+// deviceAuthTarget is a device requests may authenticate against
+type deviceAuthTarget struct {
+	host       string
+	generation int
+}
+
+// withDeviceAuth allows the requests of ctx to answer the authentication
+// challenges of dev with the configured credentials. Only identified devices
+// reporting that they require authentication get them, so a host answering
+// a discovery probe with a challenge never sees the password.
+func withDeviceAuth(ctx context.Context, dev *ShellyDevice) context.Context {
+	if dev.AuthEnabled == nil || !*dev.AuthEnabled {
+		return ctx
+	}
+	return context.WithValue(ctx, deviceAuthKey{}, deviceAuthTarget{host: dev.IP, generation: dev.Generation})
+}
+
+// authDoer answers the authentication challenges of devices with the
+// configured credentials, for requests whose context allows it through
+// withDeviceAuth. Devices without a password never see them.
+type authDoer struct {
+	next shelly.Doer
+	auth DeviceAuthConfig
+}
+
+// Do implements shelly.Doer
+func (d authDoer) Do(req *http.Request) (*http.Response, error) {
+	resp, err := d.next.Do(req)
+	// Requests with a body can't be sent again
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !d.auth.enabled() || req.Body != nil {
+		return resp, err
+	}
+	target, ok := req.Context().Value(deviceAuthKey{}).(deviceAuthTarget)
+	if !ok || target.host != req.URL.Host {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	scheme, params, _ := strings.Cut(resp.Header.Get("WWW-Authenticate"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		// Gen2+ devices only use digest authentication, a basic challenge
+		// would get the password in cleartext
+		if target.generation >= 2 {
+			return resp, nil
+		}
+		retry.SetBasicAuth(d.auth.Username, d.auth.Password)
+	case "digest":
+		authorization, err := d.auth.digest(req, parseChallenge(params))
+		if err != nil {
+			return resp, nil
+		}
+		retry.Header.Set("Authorization", authorization)
+	default:
+		return resp, nil
+	}
+	closeBody(resp)
+	return d.next.Do(retry)
+}
+
+// digest returns the Authorization header answering a digest challenge
+// (RFC 7616) for a request
+func (c DeviceAuthConfig) digest(req *http.Request, challenge map[string]string) (string, error) {
+	var newHash func() hash.Hash
+	switch algorithm := strings.ToUpper(challenge["algorithm"]); algorithm {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	// Gen2+ devices only have the admin user
+	const username = "admin"
+	uri := req.URL.RequestURI()
+	ha1 := h(username, challenge["realm"], c.Password)
+	ha2 := h(req.Method, uri)
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", challenge["realm"]),
+		fmt.Sprintf("nonce=%q", challenge["nonce"]),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if algorithm := challenge["algorithm"]; algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if qop := challenge["qop"]; qop != "" {
+		if !slices.ContainsFunc(strings.Split(qop, ","), func(q string) bool { return strings.TrimSpace(q) == "auth" }) {
+			return "", fmt.Errorf("unsupported digest qop %q", qop)
+		}
+		cnonce := rand.Text()
+		fields = append(fields,
+			fmt.Sprintf("response=%q", h(ha1, challenge["nonce"], "00000001", cnonce, "auth", ha2)),
+			"qop=auth", "nc=00000001", fmt.Sprintf("cnonce=%q", cnonce))
+	} else {
+		fields = append(fields, fmt.Sprintf("response=%q", h(ha1, challenge["nonce"], ha2)))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// parseChallenge parses the comma-separated key=value parameters of a
+// WWW-Authenticate challenge; values may be quoted and contain commas
+func parseChallenge(params string) map[string]string {
+	challenge := make(map[string]string)
+	for params = strings.TrimSpace(params); params != ""; params = strings.TrimLeft(params, ", ") {
+		key, rest, ok := strings.Cut(params, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:end+1], rest[end+2:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		challenge[key] = strings.TrimSpace(value)
+	}
+	return challenge
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestDevice answers like a Gen2 device protected with the password secret
+func digestDevice(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			w.Header().Set("WWW-Authenticate", `Digest qop="auth", realm="shellyplusplugs-aabbcc", nonce="1700000000", algorithm=SHA-256`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		auth := parseChallenge(params)
+		ha1 := sha256Hex("admin", "shellyplusplugs-aabbcc", "secret")
+		ha2 := sha256Hex(r.Method, r.URL.RequestURI())
+		want := sha256Hex(ha1, "1700000000", auth["nc"], auth["cnonce"], "auth", ha2)
+		if auth["username"] != "admin" || auth["uri"] != r.URL.RequestURI() || auth["response"] != want {
+			t.Errorf("unexpected digest authorization %q", params)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"was_on":false}`)
+	})
+}
+
+// basicDevice answers like a Gen1 device protected with user:secret
+func basicDevice() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="shelly1-aabbcc"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"ison":true}`)
+	})
+}
+
+func TestAuthDoer(t *testing.T) {
+	secret := DeviceAuthConfig{Username: "user", Password: "secret"}
+	tests := []struct {
+		name        string
+		device      http.Handler
+		config      DeviceAuthConfig
+		generation  int  // Generation of the identified device, 0 for a discovery probe
+		authEnabled bool // Whether the device reports authentication
+		path        string
+		want        int
+		sent        bool // Whether credentials reach the device
+	}{
+		{"digest", digestDevice(t), secret, 2, true, "/rpc/Switch.Set?id=0&on=true", http.StatusOK, true},
+		{"basic", basicDevice(), secret, 1, true, "/relay/0?turn=on", http.StatusOK, true},
+		{"wrong password", basicDevice(), DeviceAuthConfig{Username: "user", Password: "wrong"}, 1, true, "/relay/0?turn=on", http.StatusUnauthorized, true},
+		{"no credentials", basicDevice(), DeviceAuthConfig{Username: "user"}, 1, true, "/relay/0?turn=on", http.StatusUnauthorized, false},
+		{"discovery probe", basicDevice(), secret, 0, false, "/shelly", http.StatusUnauthorized, false},
+		{"auth not reported", basicDevice(), secret, 1, false, "/relay/0?turn=on", http.StatusUnauthorized, false},
+		{"basic from gen2", basicDevice(), secret, 2, true, "/rpc/Switch.Set?id=0&on=true", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent = sent || r.Header.Get("Authorization") != ""
+				tt.device.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			if tt.generation > 0 {
+				dev := &ShellyDevice{IP: strings.TrimPrefix(server.URL, "http://"), Generation: tt.generation, AuthEnabled: &tt.authEnabled}
+				ctx = withDeviceAuth(ctx, dev)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := authDoer{next: server.Client(), auth: tt.config}.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeBody(resp)
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if sent != tt.sent {
+				t.Errorf("credentials sent: %v, want %v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	got := parseChallenge(`realm="a, b", qop="auth,auth-int", nonce=123, algorithm=SHA-256`)
+	want := map[string]string{"realm": "a, b", "qop": "auth,auth-int", "nonce": "123", "algorithm": "SHA-256"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s: got %q, want %q", key, got[key], value)
+		}
+	}
+}
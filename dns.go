@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// resolveDNSName sets the DNS name of a discovered device. Devices configured
+// by host name keep that name and are addressed by it, so it is re-resolved
+// on every request; devices found by address get the name of a reverse
+// lookup when enabled.
+func (e *ShellyExporter) resolveDNSName(ctx context.Context, dev *ShellyDevice) {
+	// Devices behind a range extender share the extender's address
+	if dev.Extender != "" {
+		return
+	}
+	host := dev.IP
+	if h, _, err := net.SplitHostPort(dev.IP); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		dev.DNSName = host
+		return
+	}
+	if !e.config.ReverseDNS {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.config.DiscoveryTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, host)
+	if err != nil || len(names) == 0 {
+		e.discoveryLog.Debug("No reverse DNS name", "device_id", dev.DeviceID, "ip", host, "error", err)
+		return
+	}
+	dev.DNSName = strings.TrimSuffix(names[0], ".")
+}
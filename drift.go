@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configSnapshot holds the security- and safety-relevant configuration of a
+// device watched for drift. Fields a device doesn't report are left out.
+type configSnapshot struct {
+	AuthEnabled  *bool              `json:"auth_enabled,omitempty"`
+	CloudEnabled *bool              `json:"cloud_enabled,omitempty"`
+	EcoMode      *bool              `json:"eco_mode,omitempty"`
+	MaxPower     map[string]float64 `json:"max_power,omitempty"` // Watts by channel
+}
+
+// hash returns a short hash identifying the snapshot
+func (s configSnapshot) hash() string {
+	// Map keys are sorted, so equal snapshots encode the same
+	data, _ := json.Marshal(s)
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// gen1Settings holds the watched fields of the settings of a Gen1 device
+type gen1Settings struct {
+	Cloud struct {
+		Enabled *bool `json:"enabled"`
+	} `json:"cloud"`
+	EcoModeEnabled *bool    `json:"eco_mode_enabled"`
+	MaxPower       *float64 `json:"max_power"`
+}
+
+// cachedSettings is the snapshot of the settings of a Gen1 device
+type cachedSettings struct {
+	cfgChanged *int // Configuration change counter when the settings were fetched
+	snapshot   configSnapshot
+}
+
+// refreshSettings fetches the settings of a Gen1 device when they aren't
+// cached or the device reports a configuration change since
+func (e *ShellyExporter) refreshSettings(ctx context.Context, dev *ShellyDevice, cfgChanged *int) {
+	e.gen1SettingsMutex.Lock()
+	cached, ok := e.gen1Settings[dev.DeviceID]
+	e.gen1SettingsMutex.Unlock()
+	if ok && (cfgChanged == nil || cached.cfgChanged != nil && *cached.cfgChanged == *cfgChanged) {
+		return
+	}
+
+	resp, err := e.deviceGet(ctx, fmt.Sprintf("http://%s/settings", dev.IP))
+	if err != nil {
+		e.collectionLog.Debug("Error getting settings", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		return
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		e.collectionLog.Debug("Unexpected response getting settings", "device_id", dev.DeviceID, "ip", dev.IP, "status", resp.Status)
+		return
+	}
+	var settings gen1Settings
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		e.collectionLog.Debug("Error decoding settings", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		return
+	}
+
+	snapshot := configSnapshot{CloudEnabled: settings.Cloud.Enabled, EcoMode: settings.EcoModeEnabled}
+	if settings.MaxPower != nil {
+		snapshot.MaxPower = map[string]float64{"0": *settings.MaxPower}
+	}
+	e.gen1SettingsMutex.Lock()
+	e.gen1Settings[dev.DeviceID] = &cachedSettings{cfgChanged: cfgChanged, snapshot: snapshot}
+	e.gen1SettingsMutex.Unlock()
+}
+
+// gen1ConfigSnapshot returns the configuration snapshot of a Gen1 device from
+// its cached settings, or nil before they were fetched
+func (e *ShellyExporter) gen1ConfigSnapshot(dev *ShellyDevice) *configSnapshot {
+	e.gen1SettingsMutex.Lock()
+	cached, ok := e.gen1Settings[dev.DeviceID]
+	e.gen1SettingsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	snapshot := cached.snapshot
+	snapshot.AuthEnabled = dev.AuthEnabled
+	return &snapshot
+}
+
+// gen2ConfigSnapshot returns the configuration snapshot of a Gen2+ device
+// from its cached configuration, or nil before it was fetched
+func (e *ShellyExporter) gen2ConfigSnapshot(dev *ShellyDevice) *configSnapshot {
+	config := e.cachedConfig(dev.DeviceID)
+	if config == nil {
+		return nil
+	}
+
+	var cloud struct {
+		Enable *bool `json:"enable"`
+	}
+	var sys struct {
+		Device struct {
+			EcoMode *bool `json:"eco_mode"`
+		} `json:"device"`
+	}
+	config.components.component("cloud", &cloud)
+	config.components.component("sys", &sys)
+	snapshot := configSnapshot{AuthEnabled: dev.AuthEnabled, CloudEnabled: cloud.Enable, EcoMode: sys.Device.EcoMode}
+	for _, key := range config.components.components("switch") {
+		var sw struct {
+			PowerLimit *float64 `json:"power_limit"`
+		}
+		if config.components.component(key, &sw) && sw.PowerLimit != nil {
+			if snapshot.MaxPower == nil {
+				snapshot.MaxPower = make(map[string]float64)
+			}
+			_, id, _ := splitComponentKey(key)
+			snapshot.MaxPower[strconv.Itoa(id)] = *sw.PowerLimit
+		}
+	}
+	return &snapshot
+}
+
+// configDriftSamples returns the hash of a device's configuration snapshot
+// and counts a drift when it differs from the previous one, so unexpected
+// reconfiguration, e.g. disabled authentication, can be alerted on
+func (e *ShellyExporter) configDriftSamples(reading *deviceReading, snapshot *configSnapshot) []deviceSample {
+	if snapshot == nil {
+		return nil
+	}
+	hash := snapshot.hash()
+	deviceID := reading.device.DeviceID
+
+	e.configHashesMutex.Lock()
+	previous, ok := e.configHashes[deviceID]
+	e.configHashes[deviceID] = hash
+	e.configHashesMutex.Unlock()
+	if ok && previous != hash {
+		e.configDrifts.WithLabelValues(deviceID).Inc()
+		e.collectionLog.Info("Device configuration changed", "device_id", deviceID, "previous_hash", previous, "hash", hash)
+	}
+
+	return []deviceSample{{
+		Desc: e.descs.system.configHash, ValueType: prometheus.GaugeValue, Value: 1, LabelValues: append(reading.labelValues(), hash),
+	}}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// emPhases are the phases of a three-phase energy meter, in status order
+var emPhases = []string{"a", "b", "c"}
+
+// phaseLabelNames identify a phase of an energy meter channel; single-phase
+// meters have an empty phase
+var phaseLabelNames = append(append([]string{}, channelLabelNames...), "phase")
+
+// emDescs holds the descriptors of energy meter and grid metrics
+type emDescs struct {
+	apparentPower *prometheus.Desc
+	reactivePower *prometheus.Desc
+	powerFactor   *prometheus.Desc
+	gridFrequency *prometheus.Desc
+	neutral       *prometheus.Desc
+	imbalance     *prometheus.Desc
+}
+
+// newEMDescs creates the descriptors of energy meter and grid metrics
+func newEMDescs() emDescs {
+	return emDescs{
+		apparentPower: prometheus.NewDesc(
+			"shelly_em_apparent_power_va",
+			"Apparent power of an energy meter phase in volt-amperes",
+			phaseLabelNames, nil,
+		),
+		reactivePower: prometheus.NewDesc(
+			"shelly_em_reactive_power_var",
+			"Reactive power of an energy meter phase in volt-amperes reactive",
+			phaseLabelNames, nil,
+		),
+		powerFactor: prometheus.NewDesc(
+			"shelly_em_power_factor",
+			"Power factor of an energy meter phase",
+			phaseLabelNames, nil,
+		),
+		neutral: prometheus.NewDesc(
+			"shelly_em_neutral_current_amperes",
+			"Neutral current of a three-phase energy meter in amperes, calculated from the phase currents",
+			channelLabelNames, nil,
+		),
+		imbalance: prometheus.NewDesc(
+			"shelly_em_phase_imbalance_percent",
+			"Largest deviation of a phase current from the average of the three phases in percent of the average",
+			channelLabelNames, nil,
+		),
+		gridFrequency: prometheus.NewDesc(
+			"shelly_grid_frequency_hz",
+			"Frequency of the grid measured by a Shelly device in hertz",
+			deviceLabelNames, nil,
+		),
+	}
+}
+
+// all returns all energy meter and grid metric descriptors
+func (d emDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.apparentPower,
+		d.reactivePower,
+		d.powerFactor,
+		d.neutral,
+		d.imbalance,
+		d.gridFrequency,
+	}
+}
+
+// gen1EMeter is a channel of a Gen1 energy meter. The Shelly EM reports two
+// independent channels, the Shelly 3EM one channel per phase.
+type gen1EMeter struct {
+	Power    float64  `json:"power"`
+	Reactive *float64 `json:"reactive"`
+	PF       *float64 `json:"pf"`
+	Voltage  *float64 `json:"voltage"`
+	Current  *float64 `json:"current"`
+	IsValid  bool     `json:"is_valid"`
+}
+
+// gen1EMSamples returns the per-phase samples of the energy meter channels
+// in the status of a Gen1 device
+func (e *ShellyExporter) gen1EMSamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	d := e.descs.em
+	threePhase := reading.device.DeviceType == "SHEM-3"
+
+	var samples []deviceSample
+	var currents []*float64
+	for i, meter := range status.EMeters {
+		if !meter.IsValid {
+			continue
+		}
+		channel, phase := strconv.Itoa(i), ""
+		if threePhase && i < len(emPhases) {
+			channel, phase = "0", emPhases[i]
+			currents = append(currents, meter.Current)
+		}
+		samples = appendValues(samples, append(reading.labelValues(), channel, "", phase),
+			optionalValue{d.reactivePower, prometheus.GaugeValue, meter.Reactive},
+			optionalValue{d.powerFactor, prometheus.GaugeValue, meter.PF},
+		)
+	}
+	if threePhase {
+		samples = append(samples, e.phaseBalanceSamples(append(reading.labelValues(), "0", ""), currents)...)
+	}
+	return samples
+}
+
+// phases splits the status of an em:N component into the status of its
+// phases, which report the fields of an em1:N component prefixed with the
+// phase, e.g. a_act_power
+func (s gen2Status) phases(key string) map[string]gen2EM1 {
+	var fields map[string]json.RawMessage
+	raw, ok := s[key]
+	if !ok || json.Unmarshal(raw, &fields) != nil {
+		return nil
+	}
+
+	phases := make(map[string]gen2EM1)
+	for _, phase := range emPhases {
+		phaseFields := make(map[string]json.RawMessage)
+		for name, value := range fields {
+			if field, ok := strings.CutPrefix(name, phase+"_"); ok {
+				phaseFields[field] = value
+			}
+		}
+		if len(phaseFields) == 0 {
+			continue
+		}
+		data, err := json.Marshal(phaseFields)
+		if err != nil {
+			continue
+		}
+		var em gen2EM1
+		if json.Unmarshal(data, &em) == nil {
+			phases[phase] = em
+		}
+	}
+	return phases
+}
+
+// gen2EMSamples returns the per-phase samples of the three-phase (em) and
+// single-phase (em1) energy meter components of a Gen2+ device, e.g. a Pro
+// 3EM. These devices don't report reactive power.
+func (e *ShellyExporter) gen2EMSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	d := e.descs.em
+	config := e.cachedConfig(reading.device.DeviceID)
+
+	var samples []deviceSample
+	for _, key := range status.components("em") {
+		phases := status.phases(key)
+		var currents []*float64
+		for _, phase := range emPhases {
+			em, ok := phases[phase]
+			currents = append(currents, em.Current)
+			if !ok {
+				continue
+			}
+			samples = appendValues(samples, append(channelLabelValues(reading, config, key), phase),
+				optionalValue{d.apparentPower, prometheus.GaugeValue, em.AprtPower},
+				optionalValue{d.powerFactor, prometheus.GaugeValue, em.PF},
+			)
+		}
+		samples = append(samples, e.phaseBalanceSamples(channelLabelValues(reading, config, key), currents)...)
+	}
+	for _, key := range status.components("em1") {
+		var em gen2EM1
+		if !reading.component(status, key, &em) {
+			continue
+		}
+		samples = appendValues(samples, append(channelLabelValues(reading, config, key), ""),
+			optionalValue{d.apparentPower, prometheus.GaugeValue, em.AprtPower},
+			optionalValue{d.powerFactor, prometheus.GaugeValue, em.PF},
+		)
+	}
+	return samples
+}
+
+// gridFrequency returns the grid frequency measured by the first energy
+// meter or metering channel of a Gen2+ device reporting it, or nil. All
+// phases and channels are connected to the same grid.
+func (s gen2Status) gridFrequency() *float64 {
+	for _, key := range s.components("em") {
+		phases := s.phases(key)
+		for _, phase := range emPhases {
+			if freq := phases[phase].Freq; freq != nil {
+				return freq
+			}
+		}
+	}
+	for _, key := range s.components("em1") {
+		var em gen2EM1
+		if s.component(key, &em) && em.Freq != nil {
+			return em.Freq
+		}
+	}
+	for _, kind := range gen2MeterKinds {
+		for _, key := range s.components(kind) {
+			var meter gen2Meter
+			if s.component(key, &meter) && meter.Freq != nil {
+				return meter.Freq
+			}
+		}
+	}
+	return nil
+}
+
+// phaseBalanceSamples returns the neutral current and the phase imbalance of
+// a three-phase meter from its phase currents. The neutral current is the sum
+// of the phase currents 120 degrees apart, which assumes similar power
+// factors on all phases; meters with a neutral clamp measure it more exactly.
+func (e *ShellyExporter) phaseBalanceSamples(labelValues []string, currents []*float64) []deviceSample {
+	if len(currents) != len(emPhases) || slices.Contains(currents, nil) {
+		return nil
+	}
+	a, b, c := *currents[0], *currents[1], *currents[2]
+
+	neutral := math.Sqrt(math.Max(0, a*a+b*b+c*c-a*b-b*c-c*a))
+	values := []optionalValue{{e.descs.em.neutral, prometheus.GaugeValue, &neutral}}
+	// Without load on any phase the imbalance is undefined
+	if average := (a + b + c) / 3; average > 0 {
+		deviation := max(math.Abs(a-average), math.Abs(b-average), math.Abs(c-average))
+		imbalance := deviation / average * 100
+		values = append(values, optionalValue{e.descs.em.imbalance, prometheus.GaugeValue, &imbalance})
+	}
+	return appendValues(nil, labelValues, values...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+)
+
+// gen2ComponentErrors holds the error conditions a Gen2+ component reports
+type gen2ComponentErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// trackErrors counts the error conditions a device component reports that
+// weren't active in its previous reading, so short protection trips are
+// counted even when no scrape sees the flag. An overpower condition is
+// additionally counted as overpower event of the component's channel.
+func (e *ShellyExporter) trackErrors(dev *ShellyDevice, component string, errs []string) {
+	e.activeErrorsMutex.Lock()
+	defer e.activeErrorsMutex.Unlock()
+
+	key := counterKey(dev, component)
+	previous := e.activeErrors[key]
+	active := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		active[err] = true
+		if previous[err] {
+			continue
+		}
+		e.deviceErrors.WithLabelValues(dev.DeviceID, err).Inc()
+		if err == "overpower" {
+			_, id, _ := splitComponentKey(component)
+			e.overpowerEvents.WithLabelValues(dev.DeviceID, strconv.Itoa(id)).Inc()
+		}
+	}
+	if len(active) == 0 {
+		delete(e.activeErrors, key)
+		return
+	}
+	e.activeErrors[key] = active
+}
+
+// trackGen1Errors tracks the error flags in the status of a Gen1 device
+func (e *ShellyExporter) trackGen1Errors(dev *ShellyDevice, status ShellyStatus) {
+	for i, relay := range status.Relays {
+		var errs []string
+		if relay.Overpower {
+			errs = append(errs, "overpower")
+		}
+		e.trackErrors(dev, "relay:"+strconv.Itoa(i), errs)
+	}
+
+	var errs []string
+	if status.Overtemperature {
+		errs = append(errs, "overtemp")
+	}
+	e.trackErrors(dev, "sys", errs)
+}
+
+// trackGen2Errors tracks the errors arrays of all components in the status
+// of a Gen2+ device
+func (e *ShellyExporter) trackGen2Errors(dev *ShellyDevice, status gen2Status) {
+	for key := range status {
+		var component gen2ComponentErrors
+		if status.component(key, &component) {
+			e.trackErrors(dev, key, component.Errors)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultMetricPrefix is the prefix of the exporter's metric names
+const defaultMetricPrefix = "shelly_"
+
+// Modes of handling volatile labels
+const (
+	volatileLabelsKeep   = "keep"
+	volatileLabelsDrop   = "drop"
+	volatileLabelsFreeze = "freeze"
+)
+
+// volatileLabelNames are device labels whose values can change for the same
+// device, e.g. when DHCP assigns a new address
+var volatileLabelNames = []string{"ip_address"}
+
+// exposition applies the configured label changes to gathered metrics
+// before they are served or pushed to a sink
+type exposition struct {
+	gatherer prometheus.Gatherer
+	exporter *ShellyExporter
+}
+
+// exposition wraps a gatherer so its metrics carry the configured labels
+func (e *ShellyExporter) exposition(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return &exposition{gatherer: gatherer, exporter: e}
+}
+
+// Gather implements prometheus.Gatherer
+func (x *exposition) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := x.gatherer.Gather()
+
+	var haLabels map[string]string
+	if x.exporter.config.HA.enabled() {
+		haLabels = map[string]string{"ha_role": x.exporter.haRole()}
+	}
+
+	// Device labels are looked up once per device and scrape
+	deviceLabels := make(map[string]map[string]string)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			addLabels(m, x.exporter.config.ConstLabels)
+			addLabels(m, haLabels)
+
+			deviceID := labelValue(m, "device_id")
+			if deviceID == "" {
+				continue
+			}
+			labels, ok := deviceLabels[deviceID]
+			if !ok {
+				labels = x.exporter.deviceLabels(deviceID)
+				deviceLabels[deviceID] = labels
+			}
+			addLabels(m, labels)
+			x.exporter.handleVolatileLabels(deviceID, m)
+		}
+	}
+
+	if rules := x.exporter.config.RelabelConfigs; len(rules) > 0 {
+		kept := mfs[:0]
+		for _, mf := range mfs {
+			if mf.Metric = relabel(mf, rules); len(mf.Metric) > 0 {
+				kept = append(kept, mf)
+			}
+		}
+		mfs = kept
+	}
+
+	// Rename the exporter's own metrics; runtime metrics keep their names
+	if prefix := x.exporter.config.MetricPrefix; prefix != defaultMetricPrefix {
+		for _, mf := range mfs {
+			if name, ok := strings.CutPrefix(mf.GetName(), defaultMetricPrefix); ok {
+				mf.Name = proto.String(prefix + name)
+			}
+		}
+		sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	}
+	return mfs, err
+}
+
+// handleVolatileLabels drops the volatile labels of a device's series or
+// freezes them to the first value seen for the device, depending on the mode
+func (e *ShellyExporter) handleVolatileLabels(deviceID string, m *dto.Metric) {
+	switch e.config.VolatileLabels {
+	case volatileLabelsDrop:
+		m.Label = slices.DeleteFunc(m.Label, func(label *dto.LabelPair) bool {
+			return slices.Contains(volatileLabelNames, label.GetName())
+		})
+	case volatileLabelsFreeze:
+		e.frozenLabelsMutex.Lock()
+		defer e.frozenLabelsMutex.Unlock()
+		for _, label := range m.Label {
+			if !slices.Contains(volatileLabelNames, label.GetName()) {
+				continue
+			}
+			key := deviceID + "\xff" + label.GetName()
+			if frozen, ok := e.frozenLabels[key]; ok {
+				label.Value = proto.String(frozen)
+			} else {
+				e.frozenLabels[key] = label.GetValue()
+			}
+		}
+	}
+}
+
+// deviceLabels returns the static labels configured for a device and its
+// DNS name, if known
+func (e *ShellyExporter) deviceLabels(deviceID string) map[string]string {
+	var mac, dnsName string
+	if device := e.deviceByID(deviceID); device != nil {
+		mac, dnsName = device.Mac, device.DNSName
+	}
+	labels := e.config.deviceConfig(deviceID, mac).Labels
+	if dnsName == "" {
+		return labels
+	}
+	labels = maps.Clone(labels)
+	if labels == nil {
+		labels = make(map[string]string, 1)
+	}
+	labels["dns_name"] = dnsName
+	return labels
+}
+
+// labelValue returns the value of a metric's label, or "" if it isn't set
+func labelValue(m *dto.Metric, name string) string {
+	for _, label := range m.Label {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// addLabels adds labels to a metric; labels the metric already has are kept
+func addLabels(m *dto.Metric, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	for name, value := range labels {
+		if labelValue(m, name) != "" {
+			continue
+		}
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// apClientList is the WiFi.ListAPClients result of a Gen2+ device in range
+// extender mode
+type apClientList struct {
+	APClients []struct {
+		Mac   string `json:"mac"`
+		IP    string `json:"ip"`
+		MPort int    `json:"mport"`
+	} `json:"ap_clients"`
+}
+
+// discoverExtenderClients returns the devices connected to a Gen2+ device
+// acting as range extender. Clients are reached through ports the extender
+// maps to them, so their address is the extender's IP with the mapped port.
+func (e *ShellyExporter) discoverExtenderClients(ctx context.Context, extender *ShellyDevice) []*ShellyDevice {
+	if extender.Generation < 2 {
+		return nil
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, e.config.DiscoveryTimeout)
+	defer cancel()
+
+	resp, err := e.deviceGet(listCtx, fmt.Sprintf("http://%s/rpc/WiFi.ListAPClients", extender.IP))
+	if err != nil {
+		return nil
+	}
+	defer closeBody(resp)
+
+	// Devices without the access point enabled answer with an error
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var list apClientList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil
+	}
+
+	var clients []*ShellyDevice
+	for _, client := range list.APClients {
+		if client.MPort == 0 {
+			continue
+		}
+		addr := net.JoinHostPort(extender.IP, strconv.Itoa(client.MPort))
+		if device := e.discoverShellyDevice(ctx, addr); device != nil {
+			device.Extender = extender.DeviceID
+			clients = append(clients, device)
+			e.discoveryLog.Debug("Found device behind range extender", "device_id", device.DeviceID, "extender_id", extender.DeviceID, "address", addr)
+		}
+	}
+	return clients
+}
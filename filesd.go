@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// FileSDConfig configures writing the discovered devices as a Prometheus
+// file_sd target file
+type FileSDConfig struct {
+	// Path of the target file; a .yml or .yaml extension selects YAML, any
+	// other JSON
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// enabled reports whether the file_sd writer is configured
+func (c FileSDConfig) enabled() bool {
+	return c.Path != ""
+}
+
+// fileSDTargetGroup is a target group of a file_sd file
+type fileSDTargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// runFileSD writes the discovered devices to the file_sd file every
+// interval until ctx is cancelled
+func (e *ShellyExporter) runFileSD(ctx context.Context, log *slog.Logger) {
+	ticker := time.NewTicker(e.config.FileSD.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.writeFileSD(); err != nil {
+			log.Warn("Error writing file_sd targets", "path", e.config.FileSD.Path, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeFileSD writes one target group per device, addressed by its IP
+// address and labeled with its identity
+func (e *ShellyExporter) writeFileSD() error {
+	devices := e.apiDevices()
+	groups := make([]fileSDTargetGroup, 0, len(devices))
+	for _, device := range devices {
+		if device.IP == "" {
+			continue
+		}
+		groups = append(groups, fileSDTargetGroup{
+			Targets: []string{device.IP},
+			Labels: map[string]string{
+				"device_id":   device.ID,
+				"device_name": device.Name,
+				"device_type": device.Type,
+				"mac":         device.MAC,
+				"generation":  strconv.Itoa(device.Generation),
+				"source":      device.Source,
+			},
+		})
+	}
+
+	var data []byte
+	var err error
+	switch filepath.Ext(e.config.FileSD.Path) {
+	case ".yml", ".yaml":
+		data, err = yaml.Marshal(groups)
+	default:
+		data, err = json.MarshalIndent(groups, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("encoding targets: %w", err)
+	}
+	return writeFileAtomic(e.config.FileSD.Path, data)
+}
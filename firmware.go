@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Firmware update stages
+const (
+	stageStable = "stable"
+	stageBeta   = "beta"
+)
+
+// updateResult is the JSON response of a firmware update command
+type updateResult struct {
+	DeviceID string `json:"device_id"`
+	Stage    string `json:"stage"`
+}
+
+// updateHandler starts the OTA firmware update of a device, e.g.
+// POST /api/devices/shellyplug-s-ddeeff/update?stage=beta. The stable
+// release is installed by default. The device downloads and installs the
+// update on its own and restarts, which shows up in shelly_device_restarts_total.
+func (e *ShellyExporter) updateHandler(w http.ResponseWriter, r *http.Request) {
+	device := e.controlledDevice(w, r)
+	if device == nil {
+		return
+	}
+
+	stage := r.FormValue("stage")
+	switch stage {
+	case "":
+		stage = stageStable
+	case stageStable, stageBeta:
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "stage must be stable or beta"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.collectTimeout(device))
+	defer cancel()
+	if err := e.updateFirmware(ctx, device, stage); err != nil {
+		e.collectionLog.Warn("Error starting firmware update", "device_id", device.DeviceID, "stage", stage, "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	e.collectionLog.Info("Firmware update started", "device_id", device.DeviceID, "stage", stage, "firmware", device.Firmware, "remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, updateResult{DeviceID: device.DeviceID, Stage: stage})
+}
+
+// updateFirmware starts the OTA update of a device through the Gen1 ota
+// endpoint or the Shelly.Update RPC of Gen2+ devices
+func (e *ShellyExporter) updateFirmware(ctx context.Context, dev *ShellyDevice, stage string) error {
+	url := fmt.Sprintf("http://%s/rpc/Shelly.Update?stage=%%22%s%%22", dev.IP, stage)
+	if dev.Generation == 1 {
+		url = fmt.Sprintf("http://%s/ota?update=1", dev.IP)
+		if stage == stageBeta {
+			url = fmt.Sprintf("http://%s/ota?beta=1", dev.IP)
+		}
+	}
+
+	resp, err := e.deviceGet(withDeviceAuth(ctx, dev), url)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	// Gen2+ devices explain failed calls, e.g. when no update is available
+	var rpcErr struct {
+		Message string `json:"message"`
+	}
+	if body, err := io.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil && json.Unmarshal(body, &rpcErr) == nil && rpcErr.Message != "" {
+		return fmt.Errorf("device refused update: %s", rpcErr.Message)
+	}
+	return fmt.Errorf("unexpected response: %s", resp.Status)
+}
+
+// firmwareDevice is the firmware of a device in the fleet report
+type firmwareDevice struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Firmware string `json:"firmware"`
+	// Channel is the update stage the installed firmware belongs to
+	Channel         string `json:"channel"`
+	AvailableStable string `json:"available_stable,omitempty"`
+	AvailableBeta   string `json:"available_beta,omitempty"`
+	UpdateAvailable bool   `json:"update_available"`
+}
+
+// firmwareModel groups the devices of a model in the fleet report
+type firmwareModel struct {
+	Model      string `json:"model"`
+	Generation int    `json:"gen"`
+	// Versions counts the devices running each firmware version
+	Versions map[string]int   `json:"versions"`
+	Devices  []firmwareDevice `json:"devices"`
+}
+
+// availableFirmware holds the firmware updates a device's status offers:
+// update of Gen1 and sys.available_updates of Gen2+ devices
+type availableFirmware struct {
+	Update *struct {
+		HasUpdate   bool   `json:"has_update"`
+		NewVersion  string `json:"new_version"`
+		BetaVersion string `json:"beta_version"`
+	} `json:"update"`
+	Sys *struct {
+		AvailableUpdates struct {
+			Stable *struct {
+				Version string `json:"version"`
+			} `json:"stable"`
+			Beta *struct {
+				Version string `json:"version"`
+			} `json:"beta"`
+		} `json:"available_updates"`
+	} `json:"sys"`
+}
+
+// firmwareReport returns the firmware of all known devices grouped by model,
+// with the updates offered in their latest status
+func (e *ShellyExporter) firmwareReport() []firmwareModel {
+	readings := e.readings.Readings()
+
+	models := make(map[string]*firmwareModel)
+	for _, device := range e.apiDevices() {
+		d := firmwareDevice{ID: device.ID, Name: device.Name, Firmware: device.Firmware, Channel: stageStable}
+		if strings.Contains(device.Firmware, stageBeta) {
+			d.Channel = stageBeta
+		}
+
+		var available availableFirmware
+		if reading, ok := readings[device.ID]; ok && json.Unmarshal(reading.raw, &available) == nil {
+			switch {
+			case available.Update != nil:
+				if available.Update.HasUpdate {
+					d.AvailableStable = available.Update.NewVersion
+				}
+				if available.Update.BetaVersion != device.Firmware {
+					d.AvailableBeta = available.Update.BetaVersion
+				}
+			case available.Sys != nil:
+				if stable := available.Sys.AvailableUpdates.Stable; stable != nil {
+					d.AvailableStable = stable.Version
+				}
+				if beta := available.Sys.AvailableUpdates.Beta; beta != nil {
+					d.AvailableBeta = beta.Version
+				}
+			}
+		}
+		d.UpdateAvailable = d.AvailableStable != "" || d.Channel == stageBeta && d.AvailableBeta != ""
+
+		model, ok := models[device.Type]
+		if !ok {
+			model = &firmwareModel{Model: device.Type, Generation: device.Generation, Versions: make(map[string]int)}
+			models[device.Type] = model
+		}
+		model.Versions[device.Firmware]++
+		model.Devices = append(model.Devices, d)
+	}
+
+	report := make([]firmwareModel, 0, len(models))
+	for _, model := range models {
+		report = append(report, *model)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Model < report[j].Model })
+	return report
+}
+
+// firmwareHandler serves the firmware report of the fleet as JSON, so
+// upgrades can be planned without querying every device
+func (e *ShellyExporter) firmwareHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.firmwareReport())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gen1ExtTemperature is a DS18B20 or DHT22 temperature reading of a Gen1
+// device like the Shelly Uni, keyed by sensor index in the status
+type gen1ExtTemperature struct {
+	HwID string   `json:"hwID"`
+	TC   *float64 `json:"tC"`
+}
+
+// gen1ExtHumidity is a DHT22 humidity reading of a Gen1 device
+type gen1ExtHumidity struct {
+	HwID string   `json:"hwID"`
+	Hum  *float64 `json:"hum"`
+}
+
+// gen1SensorSamples returns the ADC voltages and the external sensor values
+// in the status of a Gen1 device. Sensors are labeled with their index as
+// channel and their hardware ID as channel name.
+func (e *ShellyExporter) gen1SensorSamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	d := e.descs.sensors
+
+	var samples []deviceSample
+	for i, adc := range status.ADCs {
+		samples = appendValues(samples, append(reading.labelValues(), strconv.Itoa(i), ""),
+			optionalValue{d.adcVoltage, prometheus.GaugeValue, adc.Voltage})
+	}
+	for _, index := range sortedSensorIndexes(status.ExtTemperature) {
+		t := status.ExtTemperature[index]
+		samples = appendValues(samples, append(reading.labelValues(), index, t.HwID),
+			optionalValue{d.temperature, prometheus.GaugeValue, t.TC})
+	}
+	for _, index := range sortedSensorIndexes(status.ExtHumidity) {
+		h := status.ExtHumidity[index]
+		samples = appendValues(samples, append(reading.labelValues(), index, h.HwID),
+			optionalValue{d.humidity, prometheus.GaugeValue, h.Hum})
+	}
+	return samples
+}
+
+// sortedSensorIndexes returns the indexes of external sensors in numeric order
+func sortedSensorIndexes[T any](sensors map[string]T) []string {
+	indexes := make([]string, 0, len(sensors))
+	for index := range sensors {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, _ := strconv.Atoi(indexes[i])
+		b, _ := strconv.Atoi(indexes[j])
+		return a < b
+	})
+	return indexes
+}
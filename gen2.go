@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// gen2Status is the Shelly.GetStatus result of a Gen2+ device, keyed by
+// component, e.g. "switch:0" or "sys"
+type gen2Status map[string]json.RawMessage
+
+// gen2Meter holds the metering fields shared by switch, pm1, cover and light components
+type gen2Meter struct {
+	APower  *float64 `json:"apower"`
+	AEnergy *struct {
+		Total float64 `json:"total"` // Watt-hours since the last reset
+	} `json:"aenergy"`
+	Voltage *float64 `json:"voltage"`
+	Freq    *float64 `json:"freq"`
+}
+
+// gen2EM is the status of a three-phase energy meter (em:N) component
+type gen2EM struct {
+	TotalActPower *float64 `json:"total_act_power"`
+}
+
+// gen2EMData is the status of a three-phase energy counter (emdata:N) component
+type gen2EMData struct {
+	TotalAct *float64 `json:"total_act"` // Watt-hours
+}
+
+// gen2EM1 is the status of a single-phase energy meter (em1:N) component
+type gen2EM1 struct {
+	ActPower  *float64 `json:"act_power"`
+	AprtPower *float64 `json:"aprt_power"`
+	PF        *float64 `json:"pf"`
+	Voltage   *float64 `json:"voltage"`
+	Current   *float64 `json:"current"`
+	Freq      *float64 `json:"freq"`
+}
+
+// gen2EM1Data is the status of a single-phase energy counter (em1data:N) component
+type gen2EM1Data struct {
+	TotalActEnergy *float64 `json:"total_act_energy"` // Watt-hours
+}
+
+// gen2MeterKinds are the component kinds reporting apower and aenergy
+var gen2MeterKinds = []string{"switch", "pm1", "cover", "light"}
+
+// splitComponentKey splits a component key like "switch:1" into its kind and ID
+var splitComponentKey = shelly.SplitComponentKey
+
+// components returns the keys of all components of the given kind, ordered by ID
+func (s gen2Status) components(kind string) []string {
+	var keys []string
+	ids := make(map[string]int)
+	for key := range s {
+		if k, id, ok := splitComponentKey(key); ok && k == kind {
+			keys = append(keys, key)
+			ids[key] = id
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return ids[keys[i]] < ids[keys[j]] })
+	return keys
+}
+
+// component decodes the status of a single component into v, leniently
+// when it doesn't decode strictly
+func (s gen2Status) component(key string, v any) bool {
+	ok, _ := s.decodeComponent(key, v)
+	return ok
+}
+
+// decodeComponent decodes the status of a single component into v like
+// decodeLenient and returns the warnings of the fields that needed it
+func (s gen2Status) decodeComponent(key string, v any) (bool, []parseWarning) {
+	raw, ok := s[key]
+	if !ok {
+		return false, nil
+	}
+	if json.Unmarshal(raw, v) == nil {
+		return true, nil
+	}
+	warnings, err := decodeLenient(raw, v)
+	return err == nil, warnings
+}
+
+// component decodes a component of a Gen2+ status into v like
+// gen2Status.component and records the fields that only decoded leniently.
+// A field decoded by several sample builders is only counted once.
+func (r *deviceReading) component(status gen2Status, key string, v any) bool {
+	ok, warnings := status.decodeComponent(key, v)
+	for _, warning := range warnings {
+		if r.parseWarnings == nil {
+			r.parseWarnings = make(map[string]string)
+		}
+		r.parseWarnings[joinPath(key, warning.Field)] = warning.Reason
+	}
+	return ok
+}
+
+// newGen2Device creates a device from the /shelly response of a Gen2+ device,
+// which already carries the device ID and name
+func newGen2Device(ip string, info ShellyInfo) *ShellyDevice {
+	if info.ID == "" {
+		return nil
+	}
+	deviceName := info.Name
+	if deviceName == "" {
+		deviceName = info.ID
+	}
+	return &ShellyDevice{
+		IP:          ip,
+		DeviceID:    info.ID,
+		DeviceName:  deviceName,
+		DeviceType:  info.Model,
+		Mac:         info.Mac,
+		Firmware:    info.Ver,
+		Generation:  info.Gen,
+		Source:      sourceLocal,
+		AuthEnabled: &info.AuthEn,
+		LastSeen:    time.Now(),
+	}
+}
+
+// newGen2Reading builds a device reading from the status of a Gen2+ device
+func (e *ShellyExporter) newGen2Reading(dev *ShellyDevice, status gen2Status) *deviceReading {
+	reading := newDeviceReading(dev)
+	var powers []float64
+	var energy float64
+	hasEnergy := false
+
+	for _, kind := range gen2MeterKinds {
+		for _, key := range status.components(kind) {
+			var meter gen2Meter
+			if !reading.component(status, key, &meter) {
+				continue
+			}
+			if meter.APower != nil {
+				powers = append(powers, *meter.APower)
+			}
+			if meter.AEnergy != nil {
+				energy += e.counters.monotonic(counterKey(dev, key), meter.AEnergy.Total)
+				hasEnergy = true
+			}
+		}
+	}
+	for _, key := range status.components("em") {
+		var em gen2EM
+		if reading.component(status, key, &em) && em.TotalActPower != nil {
+			powers = append(powers, *em.TotalActPower)
+		}
+	}
+	for _, key := range status.components("emdata") {
+		var data gen2EMData
+		if reading.component(status, key, &data) && data.TotalAct != nil {
+			energy += e.counters.monotonic(counterKey(dev, key), *data.TotalAct)
+			hasEnergy = true
+		}
+	}
+	for _, key := range status.components("em1") {
+		var em gen2EM1
+		if reading.component(status, key, &em) && em.ActPower != nil {
+			powers = append(powers, *em.ActPower)
+		}
+	}
+	for _, key := range status.components("em1data") {
+		var data gen2EM1Data
+		if reading.component(status, key, &data) && data.TotalActEnergy != nil {
+			energy += e.counters.monotonic(counterKey(dev, key), *data.TotalActEnergy)
+			hasEnergy = true
+		}
+	}
+
+	e.trackGen2Errors(dev, status)
+	e.trackGen2Voltages(dev, status)
+
+	// Like the energy, the power of all metering components is summed;
+	// per-channel power is exported by the switch and energy meter metrics
+	if len(powers) > 0 {
+		var power float64
+		for _, p := range powers {
+			power += p
+		}
+		reading.samples = append(reading.samples, deviceSample{
+			Desc: e.descs.power, ValueType: prometheus.GaugeValue, Value: power, LabelValues: reading.labelValues(),
+		})
+		reading.power = &power
+	}
+	if hasEnergy {
+		e.setEnergy(reading, energy)
+	}
+
+	reading.samples = append(reading.samples, e.switchSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen2EMSamples(reading, status)...)
+	reading.samples = appendValues(reading.samples, reading.labelValues(),
+		optionalValue{e.descs.em.gridFrequency, prometheus.GaugeValue, status.gridFrequency()})
+	reading.samples = append(reading.samples, e.sensorSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen2InputSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.virtualSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen2SystemSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen2MatterSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.configDriftSamples(reading, e.gen2ConfigSnapshot(dev))...)
+	reading.samples = append(reading.samples, e.gen2NetworkSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.bluSamples(dev, status)...)
+	reading.samples = append(reading.samples, e.loraSamples(reading, status)...)
+	return reading
+}
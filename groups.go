@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric groups that can be disabled to reduce cardinality
+const (
+	metricGroupPower   = "power"
+	metricGroupEnergy  = "energy"
+	metricGroupRelay   = "relay"
+	metricGroupWiFi    = "wifi"
+	metricGroupSensors = "sensors"
+	metricGroupSystem  = "system"
+)
+
+// metricGroups are all metric groups
+var metricGroups = []string{
+	metricGroupPower, metricGroupEnergy, metricGroupRelay, metricGroupWiFi, metricGroupSensors, metricGroupSystem,
+}
+
+// groups returns the metric group of each per-device metric descriptor
+func (d deviceDescs) groups() map[*prometheus.Desc]string {
+	groups := make(map[*prometheus.Desc]string)
+	add := func(group string, descs ...*prometheus.Desc) {
+		for _, desc := range descs {
+			groups[desc] = group
+		}
+	}
+	add(metricGroupPower, append([]*prometheus.Desc{d.power, d.switches.power, d.switches.voltage, d.switches.current}, d.em.all()...)...)
+	add(metricGroupEnergy, d.energy, d.cost, d.switches.energy)
+	add(metricGroupRelay, append([]*prometheus.Desc{d.switches.output, d.switches.temperature}, d.relays.all()...)...)
+	add(metricGroupWiFi, append(d.network.all(), d.lora.all()...)...)
+	add(metricGroupSensors, slices.Concat([]*prometheus.Desc{d.inputState, d.inputPercent}, d.sensors.all(), d.virtual.all(), d.blu.all())...)
+	add(metricGroupSystem, append([]*prometheus.Desc{d.collectDuration, d.lastSeen, d.extenderClient}, d.system.all()...)...)
+	return groups
+}
+
+// disabledDescs returns the descriptors of the metrics in disabled groups
+func (d deviceDescs) disabledDescs(disabled []string) map[*prometheus.Desc]bool {
+	descs := make(map[*prometheus.Desc]bool)
+	for desc, group := range d.groups() {
+		if slices.Contains(disabled, group) {
+			descs[desc] = true
+		}
+	}
+	return descs
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Roles of a replica in active/standby mode, exported as the ha_role label
+const (
+	haRoleActive  = "active"
+	haRoleStandby = "standby"
+)
+
+// HAConfig configures active/standby mode: replicas compete for a lease in
+// a shared file and only its holder polls devices
+type HAConfig struct {
+	LeaseFile     string        `yaml:"lease_file"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	// Identity names the replica in the lease; the host name when empty
+	Identity string `yaml:"identity"`
+}
+
+// enabled reports whether active/standby mode is configured
+func (c HAConfig) enabled() bool {
+	return c.LeaseFile != ""
+}
+
+// haLease is the content of the lease file
+type haLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseHolder acquires and renews the lease of a replica
+type leaseHolder struct {
+	cfg      HAConfig
+	exporter *ShellyExporter
+	log      *slog.Logger
+	expires  time.Time // End of the lease held by this replica
+}
+
+// newLeaseHolder creates the lease holder of the exporter. Until the lease
+// is acquired, the exporter is on standby.
+func (e *ShellyExporter) newLeaseHolder(cfg HAConfig, log *slog.Logger) (*leaseHolder, error) {
+	if cfg.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("determining identity: %w", err)
+		}
+		cfg.Identity = hostname
+	}
+	e.standby.Store(true)
+	return &leaseHolder{cfg: cfg, exporter: e, log: log}, nil
+}
+
+// run periodically renews the lease until ctx is cancelled and releases it
+// on exit, so the standby takes over without waiting for the lease to expire
+func (l *leaseHolder) run(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if !l.exporter.standby.Load() {
+				if err := l.release(); err != nil {
+					l.log.Warn("Error releasing lease", "path", l.cfg.LeaseFile, "error", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			// Devices are only known from the scans made while active. The
+			// discovery loop scans, so renewals aren't delayed by a sweep.
+			if l.renew(time.Now()) {
+				select {
+				case l.exporter.discoverNow <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// renew acquires or renews the lease and switches the exporter's role. It
+// reports whether the exporter took over as the active replica.
+func (l *leaseHolder) renew(now time.Time) bool {
+	held, err := l.acquire(now)
+	if err != nil {
+		l.log.Warn("Error renewing lease", "path", l.cfg.LeaseFile, "error", err)
+		// Another replica may take over once the lease expired
+		held = now.Before(l.expires)
+	}
+
+	if standby := !held; l.exporter.standby.Swap(standby) != standby {
+		role := haRoleActive
+		if standby {
+			role = haRoleStandby
+		}
+		l.log.Info("High availability role changed", "role", role, "identity", l.cfg.Identity)
+		// Relays weren't observed on standby, the time since doesn't count
+		l.exporter.forgetRelayOn("")
+		select {
+		case l.exporter.roleChanged <- struct{}{}:
+		default:
+		}
+		return !standby
+	}
+	return false
+}
+
+// acquire takes the lease if it's free, expired or already held by this
+// replica. While another replica updates the lease, the role is kept until
+// the lease held by this replica expires.
+func (l *leaseHolder) acquire(now time.Time) (bool, error) {
+	unlock, err := l.lock(now)
+	if errors.Is(err, errLeaseLocked) {
+		return now.Before(l.expires), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != l.cfg.Identity && now.Before(current.Expires) {
+		return false, nil
+	}
+
+	expires := now.Add(l.cfg.LeaseDuration)
+	if err := l.write(haLease{Holder: l.cfg.Identity, Expires: expires}); err != nil {
+		return false, err
+	}
+	l.expires = expires
+	return true, nil
+}
+
+// release frees the lease if this replica still holds it
+func (l *leaseHolder) release() error {
+	unlock, err := l.lock(time.Now())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil || current.Holder != l.cfg.Identity {
+		return err
+	}
+	return l.write(haLease{Holder: l.cfg.Identity})
+}
+
+// errLeaseLocked is returned while another replica updates the lease
+var errLeaseLocked = errors.New("lease locked by another replica")
+
+// lock makes the replica the only one updating the lease, through a lock
+// file created exclusively next to it, and returns the function removing it.
+// A lock left behind by a crashed replica is removed once it's older than
+// the lease duration; replicas stalled for that long while holding the lock
+// may then race.
+func (l *leaseHolder) lock(now time.Time) (func(), error) {
+	path := l.cfg.LeaseFile + ".lock"
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		if info, statErr := os.Stat(path); statErr == nil && now.Sub(info.ModTime()) > l.cfg.LeaseDuration {
+			l.log.Warn("Removing stale lease lock", "path", path)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		return nil, errLeaseLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+// read returns the current lease; a missing or corrupt file is a free lease
+func (l *leaseHolder) read() (haLease, error) {
+	var lease haLease
+	data, err := os.ReadFile(l.cfg.LeaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, err
+	}
+	if json.Unmarshal(data, &lease) != nil {
+		return haLease{}, nil
+	}
+	return lease, nil
+}
+
+// write replaces the lease file
+func (l *leaseHolder) write(lease haLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.cfg.LeaseFile, data)
+}
+
+// haRole returns the role of the exporter in active/standby mode
+func (e *ShellyExporter) haRole() string {
+	if e.standby.Load() {
+		return haRoleStandby
+	}
+	return haRoleActive
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yggdrion/shelly-exporter/pkg/collector"
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// deviceInfo returns the identification of a device as handlers see it,
+// rebuilt from the device, which may have been discovered through the cloud
+// or a push connection instead of the /shelly endpoint
+func deviceInfo(dev *ShellyDevice) *shelly.Info {
+	info := &shelly.Info{Mac: dev.Mac, Name: dev.DeviceName}
+	if dev.Generation >= 2 {
+		info.ID, info.Model, info.Gen, info.Ver = dev.DeviceID, dev.DeviceType, dev.Generation, dev.Firmware
+	} else {
+		info.Type, info.FwVersion = dev.DeviceType, dev.Firmware
+	}
+	if dev.AuthEnabled != nil {
+		info.AuthEnabled, info.AuthEn = *dev.AuthEnabled, *dev.AuthEnabled
+	}
+	return info
+}
+
+// handlerSamples returns the metrics of the handlers registered for a
+// device, labeled with the device labels. Failing handlers are logged and
+// counted, without affecting the built-in metrics of the device.
+func (e *ShellyExporter) handlerSamples(ctx context.Context, reading *deviceReading) []deviceSample {
+	dev := reading.device
+	info := deviceInfo(&dev)
+	handlers := collector.DefaultRegistry.Handlers(info)
+	if len(handlers) == 0 {
+		return nil
+	}
+
+	device := collector.Device{Addr: dev.IP, Info: info, Client: e.shelly}
+	var samples []deviceSample
+	for _, h := range handlers {
+		metrics, err := h.Collect(ctx, device)
+		if err != nil {
+			e.collectionLog.Warn("Error collecting metrics with handler", "device_id", dev.DeviceID, "ip", dev.IP, "handler", handlerName(h), "error", err)
+			e.collectErrors.WithLabelValues(dev.DeviceID, "handler").Inc()
+			continue
+		}
+		for _, m := range metrics {
+			sample, err := m.Sample(deviceLabelNames, reading.labelValues())
+			if err != nil {
+				e.collectionLog.Debug("Invalid handler metric", "device_id", dev.DeviceID, "handler", handlerName(h), "metric", m.Name, "error", err)
+				continue
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// handlerName returns the type name of a handler for logging
+func handlerName(h collector.Handler) string {
+	return fmt.Sprintf("%T", h)
+}
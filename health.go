@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loopHealth tracks whether a periodic loop is alive and completing its work
+type loopHealth struct {
+	name     string
+	interval time.Duration
+	running  atomic.Bool
+	lastRun  atomic.Int64 // Unix nanoseconds of the last completed run or progress
+}
+
+// newLoopHealth creates health tracking for a loop running at the given interval
+func newLoopHealth(name string, interval time.Duration) *loopHealth {
+	return &loopHealth{name: name, interval: interval}
+}
+
+// start marks the loop as running; the start counts as a run so the loop
+// gets a grace period before its first completion
+func (h *loopHealth) start() {
+	h.lastRun.Store(time.Now().UnixNano())
+	h.running.Store(true)
+}
+
+// stop marks the loop as no longer running
+func (h *loopHealth) stop() {
+	h.running.Store(false)
+}
+
+// markRun records a completed run of the loop
+func (h *loopHealth) markRun() {
+	h.lastRun.Store(time.Now().UnixNano())
+}
+
+// markProgress records that a run is still advancing, so runs outlasting the
+// deadline, e.g. rate-limited discovery scans of large ranges, don't count as
+// stalled
+func (h *loopHealth) markProgress() {
+	h.lastRun.Store(time.Now().UnixNano())
+}
+
+// check returns a description of the problem if the loop has stopped or has
+// not completed a run within maxIntervals of its interval
+func (h *loopHealth) check(maxIntervals int) string {
+	if !h.running.Load() {
+		return fmt.Sprintf("%s loop is not running", h.name)
+	}
+	since := time.Since(time.Unix(0, h.lastRun.Load()))
+	if since > time.Duration(maxIntervals)*h.interval {
+		return fmt.Sprintf("%s loop has not completed for %s", h.name, since.Round(time.Second))
+	}
+	return ""
+}
+
+// healthzHandler reports 200 while the discovery and collection loops are
+// alive and 503 if either has stopped or stalled
+func (e *ShellyExporter) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	loops := []*loopHealth{e.discoveryLoop}
+	if !e.collectOnScrape {
+		loops = append(loops, e.collectionLoop)
+	}
+
+	var problems []string
+	for _, loop := range loops {
+		if problem := loop.check(e.config.HealthMaxIntervals); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	_, _ = fmt.Fprintln(w, "OK")
+}
+
+// readyzHandler reports 200 once the initial discovery scan has completed
+// and 503 before that
+func (e *ShellyExporter) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !e.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, "initial device discovery has not completed")
+		return
+	}
+	_, _ = fmt.Fprintln(w, "OK")
+}
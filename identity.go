@@ -0,0 +1,52 @@
+package main
+
+// deviceIdentity is the cached name of a Gen1 device, which is only
+// available from its settings
+type deviceIdentity struct {
+	firmware string
+	name     string
+	// cfgChanged is the device's configuration change counter when the
+	// name was fetched, or -1 before the first reading
+	cfgChanged int
+}
+
+// cachedDeviceName returns the cached name of the device with the given MAC
+// address, provided its firmware didn't change since
+func (e *ShellyExporter) cachedDeviceName(mac, firmware string) (string, bool) {
+	e.identitiesMutex.Lock()
+	defer e.identitiesMutex.Unlock()
+
+	identity, ok := e.identities[normalizeDeviceKey(mac)]
+	if !ok || identity.firmware != firmware {
+		return "", false
+	}
+	return identity.name, true
+}
+
+// cacheDeviceName caches the name of the device with the given MAC address
+func (e *ShellyExporter) cacheDeviceName(mac, firmware, name string) {
+	e.identitiesMutex.Lock()
+	defer e.identitiesMutex.Unlock()
+
+	e.identities[normalizeDeviceKey(mac)] = &deviceIdentity{firmware: firmware, name: name, cfgChanged: -1}
+}
+
+// trackConfigChanges invalidates the cached name of a device when its
+// configuration changed, so the next discovery fetches its settings again
+func (e *ShellyExporter) trackConfigChanges(dev *ShellyDevice, cfgChanged *int) {
+	if cfgChanged == nil {
+		return
+	}
+	e.identitiesMutex.Lock()
+	defer e.identitiesMutex.Unlock()
+
+	key := normalizeDeviceKey(dev.Mac)
+	identity, ok := e.identities[key]
+	switch {
+	case !ok:
+	case identity.cfgChanged == -1:
+		identity.cfgChanged = *cfgChanged
+	case identity.cfgChanged != *cfgChanged:
+		delete(e.identities, key)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// InfluxDBConfig configures writing metrics to InfluxDB in line protocol
+type InfluxDBConfig struct {
+	// URL of the InfluxDB v2 server, or of any line protocol write endpoint
+	// when Org and Bucket are empty
+	URL      string        `yaml:"url"`
+	Org      string        `yaml:"org"`
+	Bucket   string        `yaml:"bucket"`
+	Token    string        `yaml:"token"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// enabled reports whether the InfluxDB sink is configured
+func (c InfluxDBConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// writeURL returns the URL line protocol batches are posted to
+func (c InfluxDBConfig) writeURL() (string, error) {
+	if c.Org == "" && c.Bucket == "" {
+		return c.URL, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	u = u.JoinPath("/api/v2/write")
+	query := u.Query()
+	query.Set("org", c.Org)
+	query.Set("bucket", c.Bucket)
+	query.Set("precision", "ms")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// influxWriter periodically writes all gathered metrics to InfluxDB
+type influxWriter struct {
+	cfg      InfluxDBConfig
+	url      string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	log      *slog.Logger
+}
+
+// newInfluxWriter creates a writer for the gathered metrics
+func newInfluxWriter(cfg InfluxDBConfig, gatherer prometheus.Gatherer, log *slog.Logger) (*influxWriter, error) {
+	writeURL, err := cfg.writeURL()
+	if err != nil {
+		return nil, err
+	}
+	return &influxWriter{
+		cfg:      cfg,
+		url:      writeURL,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		log:      log,
+	}, nil
+}
+
+// run writes metrics every interval until the context is cancelled
+func (w *influxWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.write(ctx); err != nil {
+				w.log.Warn("Error writing metrics to InfluxDB", "url", w.cfg.URL, "error", err)
+			}
+		}
+	}
+}
+
+// write gathers the metrics and posts them as one line protocol batch
+func (w *influxWriter) write(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+
+	var body bytes.Buffer
+	writeLineProtocol(&body, families, time.Now())
+	if body.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// writeLineProtocol encodes metric families as InfluxDB line protocol with
+// millisecond timestamps, one measurement per metric name and labels as tags
+func writeLineProtocol(buf *bytes.Buffer, families []*dto.MetricFamily, now time.Time) {
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			fields := metricFields(family.GetType(), metric)
+			if len(fields) == 0 {
+				continue
+			}
+
+			buf.WriteString(influxEscape(family.GetName(), ", "))
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == "" {
+					continue
+				}
+				buf.WriteByte(',')
+				buf.WriteString(influxEscape(label.GetName(), ", ="))
+				buf.WriteByte('=')
+				buf.WriteString(influxEscape(label.GetValue(), ", ="))
+			}
+
+			keys := make([]string, 0, len(fields))
+			for key := range fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for i, key := range keys {
+				if i == 0 {
+					buf.WriteByte(' ')
+				} else {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(key)
+				buf.WriteByte('=')
+				buf.WriteString(strconv.FormatFloat(fields[key], 'g', -1, 64))
+			}
+
+			timestamp := now.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(timestamp, 10))
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// metricFields returns the line protocol fields of a metric, skipping
+// values line protocol cannot represent
+func metricFields(metricType dto.MetricType, metric *dto.Metric) map[string]float64 {
+	fields := make(map[string]float64)
+	switch metricType {
+	case dto.MetricType_GAUGE:
+		fields["value"] = metric.GetGauge().GetValue()
+	case dto.MetricType_COUNTER:
+		fields["value"] = metric.GetCounter().GetValue()
+	case dto.MetricType_UNTYPED:
+		fields["value"] = metric.GetUntyped().GetValue()
+	case dto.MetricType_SUMMARY:
+		fields["sum"] = metric.GetSummary().GetSampleSum()
+		fields["count"] = float64(metric.GetSummary().GetSampleCount())
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		fields["sum"] = metric.GetHistogram().GetSampleSum()
+		fields["count"] = float64(metric.GetHistogram().GetSampleCount())
+	}
+	for key, value := range fields {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			delete(fields, key)
+		}
+	}
+	return fields
+}
+
+// influxEscape backslash-escapes the given special characters
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
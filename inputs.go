@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gen1InputEvents maps the event codes of Gen1 inputs to the event names
+// Gen2+ devices use
+var gen1InputEvents = map[string]string{
+	"S":   "single_push",
+	"SS":  "double_push",
+	"SSS": "triple_push",
+	"L":   "long_push",
+	"SL":  "short_long_push",
+	"LS":  "long_short_push",
+}
+
+// inputEventAliases maps the action names of i3/i4 action URLs and short
+// forms to input event names
+var inputEventAliases = map[string]string{
+	"single":             "single_push",
+	"shortpush":          "single_push",
+	"double":             "double_push",
+	"double_shortpush":   "double_push",
+	"triple":             "triple_push",
+	"triple_shortpush":   "triple_push",
+	"long":               "long_push",
+	"longpush":           "long_push",
+	"shortpush_longpush": "short_long_push",
+	"longpush_shortpush": "long_short_push",
+}
+
+// inputEventNames are the input events that are counted
+var inputEventNames = []string{
+	"single_push", "double_push", "triple_push", "long_push",
+	"short_long_push", "long_short_push", "hold", "btn_down", "btn_up",
+}
+
+// inputDeviceModels are the models of input-only Gen2+ devices like the
+// Plus i4. They report button events only as notifications, so they are
+// always collected over a WebSocket RPC connection.
+var inputDeviceModels = []string{"SNSN-0024X", "SNSN-0D24X", "S3SN-0024X"}
+
+// inputEvent normalizes an input event name and reports whether it is counted
+func inputEvent(name string) (string, bool) {
+	if alias, ok := inputEventAliases[name]; ok {
+		name = alias
+	}
+	return name, slices.Contains(inputEventNames, name)
+}
+
+// gen2Input is the status of an input:N component; buttons have no state
+// and analog inputs, e.g. of the Plus Add-on, report a percentage instead
+type gen2Input struct {
+	State   *bool    `json:"state"`
+	Percent *float64 `json:"percent"`
+}
+
+// gen2EventNotification is the params of a NotifyEvent notification
+type gen2EventNotification struct {
+	Events []struct {
+		Component string `json:"component"`
+		Event     string `json:"event"`
+	} `json:"events"`
+}
+
+// gen1InputSamples returns the input states in the status of a Gen1 device
+// and counts the push events that occurred since the previous reading
+func (e *ShellyExporter) gen1InputSamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	var samples []deviceSample
+	for i, input := range status.Inputs {
+		channel := strconv.Itoa(i)
+		state := float64(input.Input)
+		samples = appendValues(samples, append(reading.labelValues(), channel, ""),
+			optionalValue{e.descs.inputState, prometheus.GaugeValue, &state})
+
+		// The status only holds the last event, so events between two
+		// readings are all counted as the last one
+		count := e.inputEventCount(counterKey(&reading.device, "input:"+channel), input.EventCnt)
+		if event, ok := gen1InputEvents[input.Event]; ok && count > 0 {
+			e.inputEvents.WithLabelValues(reading.device.DeviceID, channel, event).Add(float64(count))
+		}
+	}
+	return samples
+}
+
+// inputEventCount returns the number of events since the previous event
+// counter value of an input; the counter restarts when the device reboots
+func (e *ShellyExporter) inputEventCount(key string, counter int) int {
+	e.inputCountersMutex.Lock()
+	defer e.inputCountersMutex.Unlock()
+
+	previous, ok := e.inputCounters[key]
+	e.inputCounters[key] = counter
+	switch {
+	case !ok:
+		return 0
+	case counter < previous:
+		return counter
+	}
+	return counter - previous
+}
+
+// gen2InputSamples returns the states and analog values of the input
+// components of a Gen2+ device
+func (e *ShellyExporter) gen2InputSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	config := e.cachedConfig(reading.device.DeviceID)
+
+	var samples []deviceSample
+	for _, key := range status.components("input") {
+		var input gen2Input
+		if reading.component(status, key, &input) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{e.descs.inputState, prometheus.GaugeValue, boolValue(input.State)},
+				optionalValue{e.descs.inputPercent, prometheus.GaugeValue, input.Percent},
+			)
+		}
+	}
+	return samples
+}
+
+// countGen2Events counts the input and LoRa add-on events of a NotifyEvent
+// notification
+func (e *ShellyExporter) countGen2Events(dev *ShellyDevice, params json.RawMessage) {
+	var notification gen2EventNotification
+	if err := json.Unmarshal(params, &notification); err != nil {
+		return
+	}
+	for _, event := range notification.Events {
+		kind, id, ok := splitComponentKey(event.Component)
+		if !ok {
+			continue
+		}
+		if kind == "lora" && event.Event != "" {
+			e.loraEvents.WithLabelValues(dev.DeviceID, strconv.Itoa(id), event.Event).Inc()
+			continue
+		}
+		if kind != "input" {
+			continue
+		}
+		if name, ok := inputEvent(event.Event); ok {
+			e.inputEvents.WithLabelValues(dev.DeviceID, strconv.Itoa(id), name).Inc()
+		}
+	}
+}
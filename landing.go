@@ -0,0 +1,58 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//go:embed templates/index.html
+var landingTemplateText string
+
+// landingTemplate renders the landing page
+var landingTemplate = template.Must(template.New("index").Parse(landingTemplateText))
+
+// landingDevice is a known device as listed on the landing page
+type landingDevice struct {
+	apiDevice
+	Metered bool    // Whether the latest reading has a power value
+	Power   float64 // Watts of the latest reading
+}
+
+// landingPage holds the data the landing page is rendered from
+type landingPage struct {
+	NetworkRange      string
+	DiscoveryInterval time.Duration
+	MetricsInterval   time.Duration
+	Devices           []landingDevice
+}
+
+// landingHandler serves the landing page listing the known devices
+func (e *ShellyExporter) landingHandler(w http.ResponseWriter, r *http.Request) {
+	// Other paths fall through to the landing page's pattern
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	readings := e.readings.Readings()
+	page := landingPage{
+		NetworkRange:      e.networkRange,
+		DiscoveryInterval: e.discoveryInterval,
+		MetricsInterval:   e.metricsInterval,
+	}
+	for _, device := range e.apiDevices() {
+		d := landingDevice{apiDevice: device}
+		if reading, ok := readings[device.ID]; ok && reading.power != nil {
+			d.Metered, d.Power = true, *reading.power
+		}
+		page.Devices = append(page.Devices, d)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, page); err != nil {
+		slog.Error("Error writing HTTP response", "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"maps"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// markSeen records the collection time of a device's latest reading
+func (e *ShellyExporter) markSeen(reading *deviceReading) {
+	e.lastSeenMutex.Lock()
+	defer e.lastSeenMutex.Unlock()
+	e.lastSeen[reading.device.DeviceID] = reading.collectedAt
+}
+
+// forgetLastSeen drops the collection times of devices that are no longer known
+func (e *ShellyExporter) forgetLastSeen(known map[string]bool) {
+	e.lastSeenMutex.Lock()
+	defer e.lastSeenMutex.Unlock()
+	maps.DeleteFunc(e.lastSeen, func(deviceID string, _ time.Time) bool { return !known[deviceID] })
+}
+
+// collectLastSeen sends the time of the latest successful collection of every
+// known device. Unlike the readings, it's kept while collections fail, so
+// alerts on devices that stopped responding don't depend on the other
+// metrics disappearing.
+func (e *ShellyExporter) collectLastSeen(ch chan<- prometheus.Metric) {
+	desc := e.descs.lastSeen
+	if e.disabledDescs[desc] {
+		return
+	}
+
+	e.lastSeenMutex.Lock()
+	lastSeen := maps.Clone(e.lastSeen)
+	e.lastSeenMutex.Unlock()
+
+	e.devicesMutex.RLock()
+	defer e.devicesMutex.RUnlock()
+	// Pushed and cloud devices take precedence, like in the API
+	devices := make(map[string]*ShellyDevice, len(e.knownDevices)+len(e.pushedDevices)+len(e.cloudDevices))
+	for _, device := range e.knownDevices {
+		devices[device.DeviceID] = device
+	}
+	maps.Copy(devices, e.pushedDevices)
+	maps.Copy(devices, e.cloudDevices)
+	for deviceID, device := range devices {
+		if seen, ok := lastSeen[deviceID]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(seen.UnixNano())/1e9, device.labelValues()...)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Device event types: lifecycle events and the state changes of alerts
+const (
+	eventDiscovered    = "discovered"
+	eventOnline        = "online"
+	eventOffline       = "offline"
+	eventIPChanged     = "ip_changed"
+	eventAlertFiring   = "alert_firing"
+	eventAlertResolved = "alert_resolved"
+)
+
+var deviceEventTypes = []string{eventDiscovered, eventOnline, eventOffline, eventIPChanged, eventAlertFiring, eventAlertResolved}
+
+// deviceEvent is a change of a device's presence on the network or of an
+// alert about it
+type deviceEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	DeviceType string    `json:"device_type"`
+	IP         string    `json:"ip_address"`
+	PreviousIP string    `json:"previous_ip_address,omitempty"`
+	Alert      string    `json:"alert,omitempty"`
+	// Value is the value of the metric an alert fired on
+	Value *float64 `json:"value,omitempty"`
+}
+
+// newDeviceEvent creates an event of a device happening now
+func newDeviceEvent(event string, dev *ShellyDevice) deviceEvent {
+	return deviceEvent{
+		Event:      event,
+		Time:       time.Now(),
+		DeviceID:   dev.DeviceID,
+		DeviceName: dev.DeviceName,
+		DeviceType: dev.DeviceType,
+		IP:         dev.IP,
+	}
+}
+
+// WebhookConfig configures an outbound webhook fired on device events
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events selects the event types sent; all when empty
+	Events  []string          `yaml:"events"`
+	Headers map[string]string `yaml:"headers"`
+	// Template renders the request body from the event's fields, e.g.
+	// {{.DeviceName}}; the json function quotes a value as a JSON string.
+	// The event is sent as JSON when empty.
+	Template string `yaml:"template"`
+
+	template *template.Template
+}
+
+// compile validates the webhook and parses its template
+func (c *WebhookConfig) compile() error {
+	if c.URL == "" {
+		return fmt.Errorf("invalid webhook: missing url")
+	}
+	for _, event := range c.Events {
+		if !slices.Contains(deviceEventTypes, event) {
+			return fmt.Errorf("invalid webhook event '%s': must be one of %s", event, strings.Join(deviceEventTypes, ", "))
+		}
+	}
+	if c.Template == "" {
+		return nil
+	}
+	tmpl, err := template.New(c.URL).Funcs(template.FuncMap{"json": templateJSON}).Parse(c.Template)
+	if err != nil {
+		return fmt.Errorf("invalid template of webhook %s: %w", c.URL, err)
+	}
+	c.template = tmpl
+	return nil
+}
+
+// templateJSON encodes a value as JSON for use in payload templates
+func templateJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// wants reports whether events of the given type are sent to the webhook
+func (c *WebhookConfig) wants(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// payload renders the request body for an event
+func (c *WebhookConfig) payload(event deviceEvent) ([]byte, error) {
+	if c.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := c.template.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// trackLifecycle compares the devices found by a discovery scan with the
+// previously known ones and publishes the resulting events
+func (e *ShellyExporter) trackLifecycle(previous, found map[string]*ShellyDevice) {
+	e.seenDevicesMutex.Lock()
+	defer e.seenDevicesMutex.Unlock()
+
+	for deviceID, device := range found {
+		lastIP, seen := e.seenDevices[deviceID]
+		e.seenDevices[deviceID] = device.IP
+		if !seen {
+			e.deviceEvents.publish(newDeviceEvent(eventDiscovered, device))
+			continue
+		}
+		if _, known := previous[deviceID]; !known {
+			e.deviceEvents.publish(newDeviceEvent(eventOnline, device))
+		}
+		// Devices may also come back online with a new address
+		if lastIP != device.IP {
+			event := newDeviceEvent(eventIPChanged, device)
+			event.PreviousIP = lastIP
+			e.deviceEvents.publish(event)
+		}
+	}
+	for deviceID, device := range previous {
+		if _, ok := found[deviceID]; !ok {
+			e.deviceEvents.publish(newDeviceEvent(eventOffline, device))
+		}
+	}
+}
+
+// eventSink is a destination of device events: a webhook or a notifier
+type eventSink interface {
+	// wants reports whether events of the given type are sent to the sink
+	wants(event string) bool
+	send(ctx context.Context, client *http.Client, event deviceEvent) error
+	// String identifies the sink in logs
+	String() string
+}
+
+// eventSinks returns the configured destinations of device events
+func (c *Config) eventSinks() []eventSink {
+	sinks := make([]eventSink, 0, len(c.Webhooks)+len(c.Notifiers))
+	for i := range c.Webhooks {
+		sinks = append(sinks, &c.Webhooks[i])
+	}
+	for i := range c.Notifiers {
+		sinks = append(sinks, &c.Notifiers[i])
+	}
+	return sinks
+}
+
+// runEventSinks sends the device events to the sinks until ctx is cancelled
+func runEventSinks(ctx context.Context, sinks []eventSink, events <-chan deviceEvent, log *slog.Logger) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			for _, sink := range sinks {
+				if !sink.wants(event.Event) {
+					continue
+				}
+				if err := sink.send(ctx, client, event); err != nil {
+					log.Warn("Error sending device event", "sink", sink, "event", event.Event, "device_id", event.DeviceID, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// String identifies the webhook in logs
+func (c *WebhookConfig) String() string {
+	return c.URL
+}
+
+// send posts an event to the webhook
+func (c *WebhookConfig) send(ctx context.Context, client *http.Client, event deviceEvent) error {
+	body, err := c.payload(event)
+	if err != nil {
+		return fmt.Errorf("rendering payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	return postEvent(client, req)
+}
+
+// postEvent sends a request delivering an event and checks its response
+func postEvent(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+// capDevices limits the devices found by a discovery scan, keyed by IP, to
+// the configured maximum so a scan of a huge network can't explode the
+// number of series. Devices pushing over WebSocket or collected from the
+// Shelly Cloud count against the same limit. Previously known devices are
+// kept first, the others in the order of their IDs, so the same devices are
+// collected on every scan. The caller must hold devicesMutex.
+func (e *ShellyExporter) capDevices(found map[string]*ShellyDevice, previous map[string]*ShellyDevice) map[string]*ShellyDevice {
+	ids := make(map[string]bool, len(found))
+	devices := make([]*ShellyDevice, 0, len(found))
+	for _, device := range found {
+		ids[device.DeviceID] = true
+		devices = append(devices, device)
+	}
+	limit := e.remainingDevices(ids, e.pushedDevices, e.cloudDevices)
+	kept, dropped := keepDevices(devices, previous, limit)
+	e.setOverLimit("discovery", dropped)
+	if len(dropped) == 0 {
+		return found
+	}
+
+	capped := make(map[string]*ShellyDevice, len(kept))
+	for _, device := range kept {
+		capped[device.IP] = device
+	}
+	return capped
+}
+
+// capCloudDevices limits the devices of the Shelly Cloud account, keyed by
+// ID, to the device slots left by the other sources. The caller must hold
+// devicesMutex.
+func (e *ShellyExporter) capCloudDevices(found map[string]*ShellyDevice) map[string]*ShellyDevice {
+	ids := make(map[string]bool, len(found))
+	devices := make([]*ShellyDevice, 0, len(found))
+	for id, device := range found {
+		ids[id] = true
+		devices = append(devices, device)
+	}
+	limit := e.remainingDevices(ids, e.knownDevices, e.pushedDevices)
+	kept, dropped := keepDevices(devices, e.cloudDevices, limit)
+	e.setOverLimit(sourceCloud, dropped)
+	if len(dropped) == 0 {
+		return found
+	}
+
+	capped := make(map[string]*ShellyDevice, len(kept))
+	for _, device := range kept {
+		capped[device.DeviceID] = device
+	}
+	return capped
+}
+
+// acceptPushedDevice registers a device connecting over WebSocket unless the
+// device limit is reached and it isn't known yet. The caller must hold
+// devicesMutex.
+func (e *ShellyExporter) acceptPushedDevice(device *ShellyDevice) bool {
+	limit := e.config.MaxDevices
+	if limit > 0 {
+		known := make(map[string]bool, len(e.knownDevices)+len(e.pushedDevices)+len(e.cloudDevices))
+		for _, d := range e.knownDevices {
+			known[d.DeviceID] = true
+		}
+		for deviceID := range e.pushedDevices {
+			known[deviceID] = true
+		}
+		for deviceID := range e.cloudDevices {
+			known[deviceID] = true
+		}
+		if !known[device.DeviceID] && len(known) >= limit {
+			return false
+		}
+	}
+	e.pushedDevices[device.DeviceID] = device
+	return true
+}
+
+// remainingDevices returns how many of the given device IDs can be collected
+// next to the devices of the other sources, or -1 without limit. own holds
+// the IDs of the devices being capped. Devices
+// known from several sources only take one slot.
+func (e *ShellyExporter) remainingDevices(own map[string]bool, others ...map[string]*ShellyDevice) int {
+	limit := e.config.MaxDevices
+	if limit <= 0 {
+		return -1
+	}
+	taken := make(map[string]bool)
+	for _, devices := range others {
+		for _, device := range devices {
+			if !own[device.DeviceID] {
+				taken[device.DeviceID] = true
+			}
+		}
+	}
+	return max(limit-len(taken), 0)
+}
+
+// keepDevices splits devices into the ones kept under limit and the dropped
+// ones. Previously known devices are kept first, the others in the order of
+// their IDs. A negative limit keeps all devices.
+func keepDevices(devices []*ShellyDevice, previous map[string]*ShellyDevice, limit int) (kept, dropped []*ShellyDevice) {
+	if limit < 0 || len(devices) <= limit {
+		return devices, nil
+	}
+	slices.SortFunc(devices, func(a, b *ShellyDevice) int {
+		_, aKnown := previous[a.DeviceID]
+		_, bKnown := previous[b.DeviceID]
+		if aKnown != bKnown {
+			if aKnown {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.DeviceID, b.DeviceID)
+	})
+	return devices[:limit], devices[limit:]
+}
+
+// setOverLimit records the devices of a source ignored because of the device
+// limit. The caller must hold devicesMutex.
+func (e *ShellyExporter) setOverLimit(source string, dropped []*ShellyDevice) {
+	e.overLimit[source] = len(dropped)
+	total := 0
+	for _, n := range e.overLimit {
+		total += n
+	}
+	e.self.devicesOverLimit.Set(float64(total))
+	if len(dropped) == 0 {
+		return
+	}
+	e.discoveryLog.Warn("Found more devices than allowed, ignoring some", "source", source, "max_devices", e.config.MaxDevices, "ignored", len(dropped))
+	for _, device := range dropped {
+		e.discoveryLog.Debug("Ignoring device over the device limit", "source", source, "device_id", device.DeviceID, "ip", device.IP)
+	}
+}
+
+// applySeriesBudget drops the samples of a reading beyond the configured
+// number of series per device. Samples are built in a fixed order, so the
+// same series are dropped every time.
+func (e *ShellyExporter) applySeriesBudget(reading *deviceReading) {
+	budget := e.config.MaxDeviceSeries
+	deviceID := reading.device.DeviceID
+	dropped := 0
+	if budget > 0 && len(reading.samples) > budget {
+		dropped = len(reading.samples) - budget
+		reading.samples = reading.samples[:budget]
+	}
+
+	// Warn when the number of dropped series changes rather than on every
+	// collection
+	e.overBudgetMutex.Lock()
+	defer e.overBudgetMutex.Unlock()
+	if e.overBudget[deviceID] == dropped {
+		return
+	}
+	if dropped == 0 {
+		delete(e.overBudget, deviceID)
+		e.self.seriesOverBudget.DeleteLabelValues(deviceID)
+		return
+	}
+	e.overBudget[deviceID] = dropped
+	e.self.seriesOverBudget.WithLabelValues(deviceID).Set(float64(dropped))
+	e.collectionLog.Warn("Device exceeds its series budget, dropping series", "device_id", deviceID, "max_device_series", budget, "dropped", dropped)
+}
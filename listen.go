@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// ListenConfig configures an additional address the HTTP server listens on
+type ListenConfig struct {
+	// Address is a host:port or unix:// socket path like HTTP_LISTEN
+	Address string `yaml:"address"`
+	// Auth replaces the global authentication settings for requests
+	// received on this address; an empty block disables authentication
+	Auth *AuthConfig `yaml:"auth"`
+}
+
+// auth returns the authentication settings of the listener
+func (c ListenConfig) auth(global AuthConfig) AuthConfig {
+	if c.Auth != nil {
+		return *c.Auth
+	}
+	return global
+}
+
+// unixListenPrefix marks a listen address as a Unix domain socket path
+const unixListenPrefix = "unix://"
+
+// listenAddress returns the address the HTTP server listens on: the
+// configured listen address, or all interfaces on the configured port
+func (c *Config) listenAddress() string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+	return c.Port
+}
+
+// listen opens the listener of the HTTP server. Addresses prefixed with
+// unix:// are Unix domain socket paths; a socket left behind by a previous
+// run is replaced.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixListenPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+)
+
+// Log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Logging subsystems whose verbosity can be raised individually
+const (
+	subsystemDiscovery  = "discovery"
+	subsystemCollection = "collection"
+)
+
+var logSubsystems = []string{subsystemDiscovery, subsystemCollection}
+
+// logging creates loggers sharing one output handler with per-subsystem levels
+type logging struct {
+	handler slog.Handler
+	level   slog.Level
+	debug   []string
+}
+
+// newLogging creates the logging setup writing in the configured format
+func newLogging(cfg Config, w io.Writer) (*logging, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s': %w", cfg.LogLevel, err)
+	}
+
+	// The shared handler accepts everything; levels are enforced per logger
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	if cfg.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	return &logging{handler: handler, level: level, debug: cfg.LogDebug}, nil
+}
+
+// logger returns the main logger using the global log level
+func (l *logging) logger() *slog.Logger {
+	return slog.New(&levelHandler{level: l.level, handler: l.handler})
+}
+
+// subsystem returns a logger for the named subsystem, logging at debug level
+// if debug logging has been enabled for it
+func (l *logging) subsystem(name string) *slog.Logger {
+	level := l.level
+	if slices.Contains(l.debug, name) {
+		level = min(level, slog.LevelDebug)
+	}
+	return slog.New(&levelHandler{level: level, handler: l.handler.WithAttrs([]slog.Attr{slog.String("subsystem", name)})})
+}
+
+// levelHandler drops records below a minimum level before passing them on
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+// Enabled implements slog.Handler
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loraDescs holds the descriptors of LoRa add-on metrics
+type loraDescs struct {
+	rssi *prometheus.Desc
+	snr  *prometheus.Desc
+}
+
+// newLoRaDescs creates the descriptors of LoRa add-on metrics
+func newLoRaDescs() loraDescs {
+	return loraDescs{
+		rssi: prometheus.NewDesc(
+			"shelly_lora_rssi_dbm",
+			"Signal strength of the last message received by a LoRa add-on in dBm",
+			channelLabelNames, nil,
+		),
+		snr: prometheus.NewDesc(
+			"shelly_lora_snr_db",
+			"Signal-to-noise ratio of the last message received by a LoRa add-on in dB",
+			channelLabelNames, nil,
+		),
+	}
+}
+
+// all returns all LoRa add-on metric descriptors
+func (d loraDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.rssi,
+		d.snr,
+	}
+}
+
+// gen2LoRa is the status of a lora:N component of the Gen4 LoRa add-on
+type gen2LoRa struct {
+	RSSI *float64 `json:"rssi"`
+	SNR  *float64 `json:"snr"`
+}
+
+// loraSamples returns the link quality of the LoRa add-ons of a Gen2+
+// device. Values of remote sensors relayed over LoRa are published by
+// scripts in virtual components and exported as those.
+func (e *ShellyExporter) loraSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	config := e.cachedConfig(reading.device.DeviceID)
+
+	var samples []deviceSample
+	for _, key := range status.components("lora") {
+		var lora gen2LoRa
+		if reading.component(status, key, &lora) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{e.descs.lora.rssi, prometheus.GaugeValue, lora.RSSI},
+				optionalValue{e.descs.lora.snr, prometheus.GaugeValue, lora.SNR},
+			)
+		}
+	}
+	return samples
+}
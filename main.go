@@ -2,18 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yggdrion/shelly-exporter/pkg/collector"
+	"github.com/yggdrion/shelly-exporter/pkg/discovery"
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
 )
 
 // ShellyStatus represents the status response from a Shelly device
@@ -23,8 +42,10 @@ type ShellyStatus struct {
 		IsValid   bool      `json:"is_valid"`
 		Timestamp int64     `json:"timestamp"`
 		Counters  []float64 `json:"counters"`
+		Total     float64   `json:"total"` // Watt-minutes since the last reset
 	} `json:"meters"`
-	Relays []struct {
+	EMeters []gen1EMeter `json:"emeters"`
+	Relays  []struct {
 		IsOn           bool   `json:"ison"`
 		HasTimer       bool   `json:"has_timer"`
 		TimerStarted   int64  `json:"timer_started"`
@@ -33,17 +54,30 @@ type ShellyStatus struct {
 		Overpower      bool   `json:"overpower"`
 		Source         string `json:"source"`
 	} `json:"relays"`
+	Inputs []struct {
+		Input    int    `json:"input"`
+		Event    string `json:"event"`
+		EventCnt int    `json:"event_cnt"`
+	} `json:"inputs"`
+	Overtemperature bool        `json:"overtemperature"`
+	RAMTotal        *float64    `json:"ram_total"`
+	RAMFree         *float64    `json:"ram_free"`
+	FSFree          *float64    `json:"fs_free"`
+	Uptime          *float64    `json:"uptime"`
+	Unixtime        *float64    `json:"unixtime"`
+	CfgChangedCnt   *int        `json:"cfg_changed_cnt"`
+	WiFiSta         gen1WiFiSta `json:"wifi_sta"`
+
+	// Shelly Uni and devices with the temperature add-on
+	ADCs []struct {
+		Voltage *float64 `json:"voltage"`
+	} `json:"adcs"`
+	ExtTemperature map[string]gen1ExtTemperature `json:"ext_temperature"`
+	ExtHumidity    map[string]gen1ExtHumidity    `json:"ext_humidity"`
 }
 
 // ShellyInfo represents device info from a Shelly device
-type ShellyInfo struct {
-	Type        string `json:"type"`
-	Mac         string `json:"mac"`
-	AuthEnabled bool   `json:"auth"`
-	FwVersion   string `json:"fw"`
-	NumOutputs  int    `json:"num_outputs"`
-	NumMeters   int    `json:"num_meters"`
-}
+type ShellyInfo = shelly.Info
 
 // ShellySettings represents device settings from a Shelly device
 type ShellySettings struct {
@@ -63,194 +97,951 @@ type ShellyDevice struct {
 	DeviceID   string
 	DeviceName string
 	DeviceType string
-	LastSeen   time.Time
+	Mac        string
+	Firmware   string
+	Generation int
+	Source     string
+	Extender   string // Device ID of the range extender the device is reached through
+	DNSName    string // Configured host name or reverse DNS name
+	// AuthEnabled is whether the device requires authentication, when known
+	AuthEnabled *bool
+	LastSeen    time.Time
+}
+
+// selfMetrics holds the exporter's internal operational metrics
+type selfMetrics struct {
+	discoveryDuration          prometheus.Gauge
+	discoveryRuns              prometheus.Counter
+	devicesDiscovered          prometheus.Gauge
+	discoveryLastSuccess       prometheus.Gauge
+	collectionDuration         prometheus.Gauge
+	collectionCycles           prometheus.Counter
+	collectionLastSuccess      prometheus.Gauge
+	collectionDevicesCollected prometheus.Gauge
+	devicesOverLimit           prometheus.Gauge
+	discoveryProbes            *prometheus.CounterVec
+	seriesOverBudget           *prometheus.GaugeVec
+	requestDuration            *prometheus.HistogramVec
+	clientInFlight             prometheus.Gauge
+	clientRequests             *prometheus.CounterVec
+	buildInfo                  prometheus.Gauge
+}
+
+// newSelfMetrics creates the exporter's internal operational metrics
+func newSelfMetrics() selfMetrics {
+	m := selfMetrics{
+		discoveryDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_discovery_duration_seconds",
+			Help: "Duration of the last device discovery scan in seconds",
+		}),
+		discoveryRuns: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "shelly_discovery_runs_total",
+			Help: "Total number of device discovery scans performed",
+		}),
+		devicesDiscovered: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_devices_discovered",
+			Help: "Number of Shelly devices found by the last discovery scan",
+		}),
+		discoveryLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_discovery_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last completed device discovery scan",
+		}),
+		collectionDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_collection_duration_seconds",
+			Help: "Duration of the last metrics collection cycle in seconds",
+		}),
+		collectionCycles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "shelly_collection_cycles_total",
+			Help: "Total number of metrics collection cycles performed",
+		}),
+		collectionLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_collection_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last collection cycle that collected at least one device",
+		}),
+		collectionDevicesCollected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_collection_devices_collected",
+			Help: "Number of devices successfully collected in the last collection cycle",
+		}),
+		devicesOverLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_devices_over_limit",
+			Help: "Number of discovered and Shelly Cloud devices that are ignored because MAX_DEVICES was exceeded",
+		}),
+		discoveryProbes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shelly_discovery_probe_total",
+			Help: "Total number of addresses probed by device discovery by result: shelly, not_shelly, timeout or error",
+		}, []string{"result"}),
+		seriesOverBudget: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "shelly_device_series_over_budget",
+			Help: "Number of series of a device dropped because MAX_DEVICE_SERIES was exceeded",
+		}, []string{"device_id"}),
+		// Classic buckets for text scrapes, native buckets for scrapers that
+		// negotiate them
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                            "shelly_http_request_duration_seconds",
+			Help:                            "Duration of device status requests in seconds by device generation",
+			Buckets:                         []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: time.Hour,
+		}, []string{"generation"}),
+		clientInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_http_client_in_flight_requests",
+			Help: "Number of HTTP requests to Shelly devices and the Shelly Cloud waiting for their response",
+		}),
+		clientRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shelly_http_client_requests_total",
+			Help: "Total number of HTTP requests to Shelly devices and the Shelly Cloud answered, by response code and method",
+		}, []string{"code", "method"}),
+		buildInfo: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shelly_exporter_build_info",
+			Help: "A metric with a constant '1' value labeled by the version, Go version and commit the exporter was built from",
+			ConstLabels: prometheus.Labels{
+				"version":   version,
+				"goversion": runtime.Version(),
+				"commit":    orUnknown(commit),
+			},
+		}),
+	}
+	for _, result := range []string{"shelly", "not_shelly", "timeout", "error"} {
+		m.discoveryProbes.WithLabelValues(result)
+	}
+	m.buildInfo.Set(1)
+	return m
+}
+
+// collectors returns all internal metrics as a list of collectors
+func (m selfMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.discoveryDuration,
+		m.discoveryRuns,
+		m.devicesDiscovered,
+		m.discoveryLastSuccess,
+		m.collectionDuration,
+		m.collectionCycles,
+		m.collectionLastSuccess,
+		m.collectionDevicesCollected,
+		m.devicesOverLimit,
+		m.discoveryProbes,
+		m.seriesOverBudget,
+		m.requestDuration,
+		m.clientInFlight,
+		m.clientRequests,
+		m.buildInfo,
+	}
+}
+
+// instrumentTransport wraps the transport of the device HTTP client to count
+// in-flight requests and responses by code, which show how close polling
+// gets to the connection limits. Requests failing without a response are
+// only counted as collection or discovery errors.
+func (m selfMetrics) instrumentTransport(transport http.RoundTripper) http.RoundTripper {
+	return promhttp.InstrumentRoundTripperInFlight(m.clientInFlight,
+		promhttp.InstrumentRoundTripperCounter(m.clientRequests, transport))
+}
+
+// deviceLabelNames are the labels identifying a device on per-device metrics
+var deviceLabelNames = []string{"device_id", "device_name", "device_type", "ip_address", "source"}
+
+// deviceDescs holds the descriptors of per-device metrics
+type deviceDescs struct {
+	power           *prometheus.Desc
+	energy          *prometheus.Desc
+	cost            *prometheus.Desc
+	collectDuration *prometheus.Desc
+	lastSeen        *prometheus.Desc
+	extenderClient  *prometheus.Desc
+	inputState      *prometheus.Desc
+	inputPercent    *prometheus.Desc
+	switches        switchDescs
+	em              emDescs
+	relays          relayDescs
+	sensors         sensorDescs
+	virtual         virtualDescs
+	system          systemDescs
+	network         networkDescs
+	lora            loraDescs
+	blu             bluDescs
+}
+
+// newDeviceDescs creates the descriptors of per-device metrics
+func newDeviceDescs() deviceDescs {
+	return deviceDescs{
+		power: prometheus.NewDesc(
+			"shelly_power_watts",
+			"Current power consumption in watts from Shelly devices, summed over all channels like shelly_energy_total_wh",
+			deviceLabelNames, nil,
+		),
+		energy: prometheus.NewDesc(
+			"shelly_energy_total_wh",
+			"Total energy consumed in watt-hours, kept monotonic across device counter resets",
+			deviceLabelNames, nil,
+		),
+		cost: prometheus.NewDesc(
+			"shelly_energy_cost_total",
+			"Cost of the energy consumed in the configured currency by tariff, accumulated at the price when it was consumed",
+			append(slices.Clone(deviceLabelNames), "currency", "tariff"), nil,
+		),
+		collectDuration: prometheus.NewDesc(
+			"shelly_collect_duration_seconds",
+			"Duration of the last status request to each Shelly device in seconds",
+			[]string{"device_id"}, nil,
+		),
+		lastSeen: prometheus.NewDesc(
+			"shelly_device_last_seen_timestamp_seconds",
+			"Unix time of the latest successful collection from a known Shelly device",
+			deviceLabelNames, nil,
+		),
+		extenderClient: prometheus.NewDesc(
+			"shelly_range_extender_client_info",
+			"Devices reached through a Shelly range extender, labeled with the extender's device ID",
+			[]string{"device_id", "extender_id"}, nil,
+		),
+		inputState: prometheus.NewDesc(
+			"shelly_input_state",
+			"Whether a physical input is on (1) or off (0)",
+			channelLabelNames, nil,
+		),
+		inputPercent: prometheus.NewDesc(
+			"shelly_input_analog_percent",
+			"Value of an analog input in percent of its range",
+			channelLabelNames, nil,
+		),
+		switches: newSwitchDescs(),
+		em:       newEMDescs(),
+		relays:   newRelayDescs(),
+		sensors:  newSensorDescs(),
+		virtual:  newVirtualDescs(),
+		system:   newSystemDescs(),
+		network:  newNetworkDescs(),
+		lora:     newLoRaDescs(),
+		blu:      newBLUDescs(),
+	}
+}
+
+// all returns all per-device metric descriptors
+func (d deviceDescs) all() []*prometheus.Desc {
+	return append([]*prometheus.Desc{
+		d.power,
+		d.energy,
+		d.cost,
+		d.collectDuration,
+		d.lastSeen,
+		d.extenderClient,
+		d.inputState,
+		d.inputPercent,
+	}, slices.Concat(d.switches.all(), d.em.all(), d.relays.all(), d.sensors.all(), d.virtual.all(), d.system.all(), d.network.all(), d.lora.all(), d.blu.all())...)
+}
+
+// deviceSample is a single metric value collected from a device
+type deviceSample = collector.Sample
+
+// optionalValue is a metric value a device may not report
+type optionalValue struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     *float64
+}
+
+// appendValues appends a sample for each reported value to samples
+func appendValues(samples []deviceSample, labelValues []string, values ...optionalValue) []deviceSample {
+	for _, v := range values {
+		if v.value != nil {
+			samples = append(samples, deviceSample{Desc: v.desc, ValueType: v.valueType, Value: *v.value, LabelValues: labelValues})
+		}
+	}
+	return samples
+}
+
+// boolValue converts an optional boolean to an optional 1 or 0
+func boolValue(b *bool) *float64 {
+	if b == nil {
+		return nil
+	}
+	v := 0.0
+	if *b {
+		v = 1
+	}
+	return &v
+}
+
+// deviceReading holds the samples collected from a device in one collection
+type deviceReading struct {
+	device      ShellyDevice
+	samples     []deviceSample
+	power       *float64
+	energyWh    *float64
+	collectedAt time.Time
+	raw         json.RawMessage // Status document the reading was built from
+	// parseWarnings holds the reason of every component field of a Gen2+
+	// status that only decoded leniently, by path
+	parseWarnings map[string]string
+}
+
+// newDeviceReading creates an empty reading of a device collected now
+func newDeviceReading(dev *ShellyDevice) *deviceReading {
+	return &deviceReading{device: *dev, collectedAt: time.Now()}
+}
+
+// Samples implements collector.Reading
+func (r *deviceReading) Samples() []deviceSample {
+	return r.samples
+}
+
+// CollectedAt implements collector.Reading
+func (r *deviceReading) CollectedAt() time.Time {
+	return r.collectedAt
+}
+
+// labelValues returns the device label values of the reading's device
+func (r *deviceReading) labelValues() []string {
+	return r.device.labelValues()
+}
+
+// labelValues returns the device label values of the device
+func (d *ShellyDevice) labelValues() []string {
+	return []string{d.DeviceID, d.DeviceName, d.DeviceType, d.IP, d.Source}
+}
+
+// newDeviceHTTPClient creates the HTTP client shared by all device requests.
+// Timeouts are applied per request through contexts, so keep-alive
+// connections to devices are reused across collection cycles.
+func newDeviceHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        512,
+			MaxIdleConnsPerHost: 2,
+			MaxConnsPerHost:     4,
+			IdleConnTimeout:     90 * time.Second,
+			DisableCompression:  false,
+		},
+	}
 }
 
 // ShellyExporter implements prometheus.Collector
 type ShellyExporter struct {
-	powerGauge        *prometheus.GaugeVec
-	mutex             sync.RWMutex
-	devicesMutex      sync.RWMutex
-	knownDevices      map[string]*ShellyDevice
-	networkRange      string
-	discoveryInterval time.Duration
-	metricsInterval   time.Duration
+	config             Config
+	client             *http.Client
+	doer               shelly.Doer // Sends device requests, authenticating when challenged
+	shelly             *shelly.Client
+	discoveryLog       *slog.Logger
+	collectionLog      *slog.Logger
+	descs              deviceDescs
+	disabledDescs      map[*prometheus.Desc]bool
+	collectErrors      *prometheus.CounterVec
+	webhookEvents      *prometheus.CounterVec
+	overpowerEvents    *prometheus.CounterVec
+	deviceErrors       *prometheus.CounterVec
+	inputEvents        *prometheus.CounterVec
+	deviceRestarts     *prometheus.CounterVec
+	voltageSags        *prometheus.CounterVec
+	voltageSwells      *prometheus.CounterVec
+	wifiReassociations *prometheus.CounterVec
+	loraEvents         *prometheus.CounterVec
+	configDrifts       *prometheus.CounterVec
+	statusRetries      *prometheus.CounterVec
+	breakerStates      *prometheus.GaugeVec
+	parseWarnings      *prometheus.CounterVec
+	self               selfMetrics
+	readings           *collector.Collector[*deviceReading]
+	devicesMutex       sync.RWMutex
+	scrapeMutex        sync.Mutex
+	discoveryMutex     sync.Mutex
+	knownDevices       map[string]*ShellyDevice
+	pushedDevices      map[string]*ShellyDevice
+	cloudDevices       map[string]*ShellyDevice
+	gen2Configs        map[string]*gen2Config
+	gen2ConfigsMutex   sync.RWMutex
+	gen1Settings       map[string]*cachedSettings
+	gen1SettingsMutex  sync.Mutex
+	configHashes       map[string]string // Last configuration snapshot hash of every device
+	configHashesMutex  sync.Mutex
+	frozenLabels       map[string]string
+	counters           *counterStore
+	activeErrors       map[string]map[string]bool
+	activeErrorsMutex  sync.Mutex
+	voltageStates      map[string]int // Measuring points outside the voltage band
+	voltageStatesMutex sync.Mutex
+	inputCounters      map[string]int
+	inputCountersMutex sync.Mutex
+	uptimes            map[string]float64
+	uptimesMutex       sync.Mutex
+	wifiAPs            map[string]string // Last access point of every device
+	wifiAPsMutex       sync.Mutex
+	pollTimes          map[string]time.Time
+	pollTimesMutex     sync.Mutex
+	identities         map[string]*deviceIdentity
+	identitiesMutex    sync.Mutex
+	relayOn            map[string]*relayOnState
+	relayOnMutex       sync.Mutex
+	seenDevices        map[string]string // Last address of every device seen since startup
+	seenDevicesMutex   sync.Mutex
+	lastSeen           map[string]time.Time // Time of the latest reading of every device
+	lastSeenMutex      sync.Mutex
+	breakers           map[string]*breaker
+	breakersMutex      sync.Mutex
+	frozenLabelsMutex  sync.Mutex
+	networkRange       string
+	discoveryInterval  time.Duration
+	metricsInterval    time.Duration
+	collectOnScrape    bool
+	scrapeTimeout      time.Duration
+	scrapeCacheTTL     time.Duration
+	discoveryLoop      *loopHealth
+	collectionLoop     *loopHealth
+	ready              atomic.Bool
+	standby            atomic.Bool        // Set while another replica holds the HA lease
+	roleChanged        chan struct{}      // Signalled when the HA role switches
+	discoverNow        chan struct{}      // Signalled to start a full discovery ahead of the next interval
+	refreshes          chan *ShellyDevice // Devices to collect ahead of their next poll
+	overBudget         map[string]int     // Dropped series of devices over their budget
+	overLimit          map[string]int     // Ignored devices over MAX_DEVICES by source, guarded by devicesMutex
+	overBudgetMutex    sync.Mutex
+	discoverLimiter    sync.Mutex
+	lastDiscoverCall   time.Time
+	events             *broadcaster[readingEvent]
+	deviceEvents       *broadcaster[deviceEvent]
 }
 
 // NewShellyExporter creates a new Shelly exporter
-func NewShellyExporter(networkRange string, discoveryInterval, metricsInterval time.Duration) *ShellyExporter {
-	return &ShellyExporter{
-		powerGauge: prometheus.NewGaugeVec(
+func NewShellyExporter(cfg Config, logs *logging) *ShellyExporter {
+	self := newSelfMetrics()
+	client := newDeviceHTTPClient()
+	client.Transport = self.instrumentTransport(client.Transport)
+	doer := authDoer{next: tracedDoer{client}, auth: cfg.DeviceAuth}
+	e := &ShellyExporter{
+		config:        cfg,
+		client:        client,
+		doer:          doer,
+		shelly:        shelly.NewClient(doer),
+		discoveryLog:  logs.subsystem(subsystemDiscovery),
+		collectionLog: logs.subsystem(subsystemCollection),
+		descs:         newDeviceDescs(),
+		collectErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_collect_errors_total",
+				Help: "Total number of failed metric collections from Shelly devices by reason",
+			},
+			[]string{"device_id", "reason"},
+		),
+		webhookEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_webhook_events_total",
+				Help: "Total number of events received from Shelly devices via action URL webhooks",
+			},
+			[]string{"device_id", "event"},
+		),
+		overpowerEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_overpower_events_total",
+				Help: "Total number of overpower protection trips of Shelly device channels",
+			},
+			[]string{"device_id", "channel"},
+		),
+		deviceErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_device_errors_total",
+				Help: "Total number of error conditions raised by Shelly devices, e.g. overpower or overtemp",
+			},
+			[]string{"device_id", "error"},
+		),
+		inputEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_input_events_total",
+				Help: "Total number of push events of Shelly device inputs by event type",
+			},
+			[]string{"device_id", "channel", "event"},
+		),
+		deviceRestarts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_device_restarts_total",
+				Help: "Total number of Shelly device restarts, detected from decreasing uptime",
+			},
+			[]string{"device_id"},
+		),
+		voltageSags: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_voltage_sag_events_total",
+				Help: "Total number of times the voltage measured by a Shelly device fell below the configured band",
+			},
+			[]string{"device_id"},
+		),
+		voltageSwells: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_voltage_swell_events_total",
+				Help: "Total number of times the voltage measured by a Shelly device rose above the configured band",
+			},
+			[]string{"device_id"},
+		),
+		wifiReassociations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_wifi_reassociations_total",
+				Help: "Total number of times a Shelly device was found associated with another WiFi access point than in its previous reading",
+			},
+			[]string{"device_id"},
+		),
+		loraEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_lora_events_total",
+				Help: "Total number of events of LoRa add-ons, e.g. received messages, pushed by Shelly devices over WebSocket",
+			},
+			[]string{"device_id", "channel", "event"},
+		),
+		configDrifts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_config_drift_total",
+				Help: "Total number of changes of the watched configuration of Shelly devices, see shelly_config_hash",
+			},
+			[]string{"device_id"},
+		),
+		statusRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_status_retries_total",
+				Help: "Total number of status requests to Shelly devices retried after a transient failure",
+			},
+			[]string{"device_id"},
+		),
+		parseWarnings: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shelly_parse_warnings_total",
+				Help: "Total number of fields of Shelly device statuses that were converted from a string or ignored to decode the rest of the status",
+			},
+			[]string{"device_id", "reason"},
+		),
+		breakerStates: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "shelly_power_watts",
-				Help: "Current power consumption in watts from Shelly devices",
+				Name: "shelly_circuit_breaker_state",
+				Help: "State of the circuit breaker of a Shelly device: 0 closed (polled), 1 open (paused after repeated failures), 2 half-open (testing recovery)",
 			},
-			[]string{"device_id", "device_name", "device_type", "ip_address"},
+			[]string{"device_id"},
 		),
+		self:              self,
 		knownDevices:      make(map[string]*ShellyDevice),
-		networkRange:      networkRange,
-		discoveryInterval: discoveryInterval,
-		metricsInterval:   metricsInterval,
+		pushedDevices:     make(map[string]*ShellyDevice),
+		overLimit:         make(map[string]int),
+		roleChanged:       make(chan struct{}, 1),
+		discoverNow:       make(chan struct{}, 1),
+		refreshes:         make(chan *ShellyDevice, refreshQueueSize),
+		gen2Configs:       make(map[string]*gen2Config),
+		gen1Settings:      make(map[string]*cachedSettings),
+		configHashes:      make(map[string]string),
+		frozenLabels:      make(map[string]string),
+		counters:          newCounterStore(cfg.StateFile),
+		activeErrors:      make(map[string]map[string]bool),
+		voltageStates:     make(map[string]int),
+		inputCounters:     make(map[string]int),
+		uptimes:           make(map[string]float64),
+		wifiAPs:           make(map[string]string),
+		pollTimes:         make(map[string]time.Time),
+		identities:        make(map[string]*deviceIdentity),
+		relayOn:           make(map[string]*relayOnState),
+		seenDevices:       make(map[string]string),
+		lastSeen:          make(map[string]time.Time),
+		breakers:          make(map[string]*breaker),
+		overBudget:        make(map[string]int),
+		networkRange:      cfg.NetworkRange,
+		discoveryInterval: cfg.DiscoveryInterval,
+		metricsInterval:   cfg.MetricsInterval,
+		collectOnScrape:   cfg.CollectionMode == collectionModeScrape,
+		scrapeTimeout:     cfg.ScrapeTimeout,
+		scrapeCacheTTL:    cfg.ScrapeCacheTTL,
+		discoveryLoop:     newLoopHealth(subsystemDiscovery, cfg.DiscoveryInterval),
+		collectionLoop:    newLoopHealth(subsystemCollection, cfg.MetricsInterval),
+		events:            newBroadcaster[readingEvent](),
+		deviceEvents:      newBroadcaster[deviceEvent](),
 	}
+	e.disabledDescs = e.descs.disabledDescs(cfg.DisabledGroups)
+	e.counters.persist("collect_errors", e.collectErrors)
+	e.counters.persist("webhook_events", e.webhookEvents)
+	e.counters.persist("overpower_events", e.overpowerEvents)
+	e.counters.persist("device_errors", e.deviceErrors)
+	e.counters.persist("input_events", e.inputEvents)
+	e.counters.persist("device_restarts", e.deviceRestarts)
+	e.counters.persist("voltage_sags", e.voltageSags)
+	e.counters.persist("voltage_swells", e.voltageSwells)
+	e.counters.persist("wifi_reassociations", e.wifiReassociations)
+	e.counters.persist("lora_events", e.loraEvents)
+	e.counters.persist("config_drifts", e.configDrifts)
+	e.counters.persist("status_retries", e.statusRetries)
+	e.counters.persist("parse_warnings", e.parseWarnings)
+	e.readings = collector.New[*deviceReading]()
+	e.readings.Skip = func(desc *prometheus.Desc) bool { return e.disabledDescs[desc] }
+	e.readings.Timestamps = cfg.SampleTimestamps
+	return e
+}
+
+// collectors returns all metric collectors owned by the exporter
+func (e *ShellyExporter) collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{
+		e.collectErrors,
+		e.webhookEvents,
+		e.overpowerEvents,
+		e.deviceErrors,
+		e.inputEvents,
+		e.deviceRestarts,
+		e.voltageSags,
+		e.voltageSwells,
+		e.wifiReassociations,
+		e.loraEvents,
+		e.configDrifts,
+		e.statusRetries,
+		e.breakerStates,
+		e.parseWarnings,
+	}, e.self.collectors()...)
 }
 
 // Describe implements prometheus.Collector
 func (e *ShellyExporter) Describe(ch chan<- *prometheus.Desc) {
-	e.powerGauge.Describe(ch)
+	for _, desc := range e.descs.all() {
+		if !e.disabledDescs[desc] {
+			ch <- desc
+		}
+	}
+	for _, c := range e.collectors() {
+		c.Describe(ch)
+	}
 }
 
 // Collect implements prometheus.Collector
 func (e *ShellyExporter) Collect(ch chan<- prometheus.Metric) {
-	e.mutex.RLock()
-	defer e.mutex.RUnlock()
+	if e.collectOnScrape {
+		e.refreshOnScrape()
+	}
+	e.collectCached(ch)
+}
+
+// cachedExporter exposes the exporter's metrics without refreshing devices in
+// scrape mode, for sinks gathering on their own schedule
+type cachedExporter struct {
+	exporter *ShellyExporter
+}
+
+// Describe implements prometheus.Collector
+func (c cachedExporter) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c cachedExporter) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collectCached(ch)
+}
+
+// collectCached sends the metrics of the readings at hand
+func (e *ShellyExporter) collectCached(ch chan<- prometheus.Metric) {
+	e.readings.Collect(ch)
+
+	e.collectLastSeen(ch)
+
+	for _, c := range e.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// refreshOnScrape collects fresh metrics from devices whose cached values
+// are older than the scrape cache TTL, bounded by the scrape timeout
+func (e *ShellyExporter) refreshOnScrape() {
+	// Serialize concurrent scrapes so devices aren't queried twice
+	e.scrapeMutex.Lock()
+	defer e.scrapeMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.scrapeTimeout)
+	defer cancel()
+
+	e.collectMetricsFromKnownDevices(ctx, e.scrapeCacheTTL)
+}
+
+// forgetDevice removes the cached readings and relay observations of a
+// device that could not be collected
+func (e *ShellyExporter) forgetDevice(deviceID string) {
+	e.readings.Delete(deviceID)
+	e.forgetRelayOn(deviceID)
+}
 
-	e.powerGauge.Collect(ch)
+// discoveryResult summarizes a device discovery scan
+type discoveryResult struct {
+	Duration float64  `json:"duration_seconds"`
+	Devices  int      `json:"devices"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
 }
 
 // discoverDevices scans the network for Shelly devices and updates the known devices list
-func (e *ShellyExporter) discoverDevices(ctx context.Context) {
-	// log.Printf("Starting device discovery scan...")
+func (e *ShellyExporter) discoverDevices(ctx context.Context) discoveryResult {
+	return e.scanDevices(ctx, append(e.getIPRange(), e.config.Targets...))
+}
+
+// rediscoverDevices re-probes only the addresses of the known devices and the
+// configured targets. Devices behind range extenders are found through their
+// extender.
+func (e *ShellyExporter) rediscoverDevices(ctx context.Context) discoveryResult {
+	e.devicesMutex.RLock()
+	ips := make([]string, 0, len(e.knownDevices)+len(e.config.Targets))
+	for _, device := range e.knownDevices {
+		if device.Extender == "" {
+			ips = append(ips, device.IP)
+		}
+	}
+	e.devicesMutex.RUnlock()
+
+	for _, target := range e.config.Targets {
+		if !slices.Contains(ips, target) {
+			ips = append(ips, target)
+		}
+	}
+	return e.scanDevices(ctx, ips)
+}
+
+// discoveryConcurrency bounds the probes in flight during discovery, so
+// large ranges don't exhaust sockets
+const discoveryConcurrency = 64
+
+// scanDevices probes the given addresses for Shelly devices and replaces the
+// known devices with the ones found
+func (e *ShellyExporter) scanDevices(ctx context.Context, ips []string) discoveryResult {
+	// Only the active replica talks to devices
+	if e.standby.Load() {
+		e.discoveryLog.Debug("Skipping device discovery on standby")
+		return discoveryResult{Added: []string{}, Removed: []string{}}
+	}
+
+	// Periodic and on-demand scans must not overlap
+	e.discoveryMutex.Lock()
+	defer e.discoveryMutex.Unlock()
+
+	ctx, span := tracer.Start(ctx, "discovery", trace.WithAttributes(attribute.Int("shelly.addresses", len(ips))))
+	defer span.End()
+
+	e.discoveryLog.Debug("Starting device discovery scan", "network_range", e.networkRange, "addresses", len(ips))
 	start := time.Now()
 
-	var wg sync.WaitGroup
+	// Optionally cap the probe rate so routers and IDS don't flag the sweep
+	opts := discovery.Options{Concurrency: discoveryConcurrency, Rate: e.config.DiscoveryRate}
+	probed := discovery.Scan(ctx, ips, opts, func(ctx context.Context, ip string) ([]*ShellyDevice, bool) {
+		e.discoveryLoop.markProgress()
+		device := e.discoverShellyDevice(ctx, ip)
+		if device == nil {
+			return nil, false
+		}
+		e.resolveDNSName(ctx, device)
+		return append([]*ShellyDevice{device}, e.discoverExtenderClients(ctx, device)...), true
+	})
+
 	foundDevices := 0
-	var foundMutex sync.Mutex
 	tempDevices := make(map[string]*ShellyDevice)
+	for _, device := range slices.Concat(probed...) {
+		if e.config.excludedType(device.DeviceType) || !e.config.inShard(device) {
+			continue
+		}
+		foundDevices++
+		tempDevices[device.IP] = device
+	}
 
-	// Get local network range
-	ips := e.getIPRange()
-
-	// Scan each IP address
-	for _, ip := range ips {
-		wg.Add(1)
-		go func(ipAddr string) {
-			defer wg.Done()
+	duration := time.Since(start).Seconds()
+	result := discoveryResult{Duration: duration, Devices: foundDevices, Added: []string{}, Removed: []string{}}
 
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
+	e.self.discoveryRuns.Inc()
+	e.self.discoveryDuration.Set(duration)
 
-			if device := e.discoverShellyDevice(ipAddr); device != nil {
-				foundMutex.Lock()
-				foundDevices++
-				tempDevices[device.IP] = device
-				foundMutex.Unlock()
-			}
-		}(ip)
+	// An interrupted scan is incomplete, keep the previous devices
+	if ctx.Err() != nil {
+		e.discoveryLog.Info("Device discovery interrupted", "duration", duration)
+		return result
 	}
 
-	wg.Wait()
-
 	// Update known devices list
 	e.devicesMutex.Lock()
+	previous := make(map[string]*ShellyDevice, len(e.knownDevices))
+	for _, device := range e.knownDevices {
+		previous[device.DeviceID] = device
+	}
+	tempDevices = e.capDevices(tempDevices, previous)
 	e.knownDevices = tempDevices
 	e.devicesMutex.Unlock()
 
-	duration := time.Since(start).Seconds()
+	found := make(map[string]*ShellyDevice, len(tempDevices))
+	for _, device := range tempDevices {
+		found[device.DeviceID] = device
+		if _, ok := previous[device.DeviceID]; !ok {
+			result.Added = append(result.Added, device.DeviceID)
+		}
+	}
+	for deviceID := range previous {
+		if _, ok := found[deviceID]; !ok {
+			result.Removed = append(result.Removed, deviceID)
+		}
+	}
+	e.trackLifecycle(previous, found)
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+
+	e.self.devicesDiscovered.Set(float64(foundDevices))
+	e.self.discoveryLastSuccess.SetToCurrentTime()
+	span.SetAttributes(attribute.Int("shelly.devices", foundDevices))
 
-	log.Printf("Device discovery completed in %.2f seconds, found %d Shelly devices", duration, foundDevices)
+	e.discoveryLog.Info("Device discovery completed", "duration", duration, "devices", foundDevices, "added", len(result.Added), "removed", len(result.Removed))
+	return result
 }
 
-// discoverShellyDevice checks if the given IP is a Shelly device and returns device info
-func (e *ShellyExporter) discoverShellyDevice(ip string) *ShellyDevice {
-	client := &http.Client{Timeout: 2 * time.Second}
+// discoverShellyDevice checks if the given IP is a Shelly device and returns
+// device info. The outcome is counted by result.
+func (e *ShellyExporter) discoverShellyDevice(ctx context.Context, ip string) *ShellyDevice {
+	device, err := e.probeShellyDevice(ctx, ip)
+	e.self.discoveryProbes.WithLabelValues(probeResult(err)).Inc()
+	return device
+}
+
+// probeShellyDevice identifies the device at an address. It returns
+// shelly.ErrNotShelly for hosts that aren't Shelly devices.
+func (e *ShellyExporter) probeShellyDevice(ctx context.Context, ip string) (*ShellyDevice, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.config.DiscoveryTimeout)
+	defer cancel()
 
 	// Check if it's a Shelly device
-	resp, err := client.Get(fmt.Sprintf("http://%s/shelly", ip))
+	info, err := e.shelly.Info(ctx, ip)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Printf("Error closing response body: %v", err)
-		}
-	}()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	if info.Gen >= 2 {
+		if device := newGen2Device(ip, *info); device != nil {
+			return device, nil
+		}
+		return nil, shelly.ErrNotShelly
 	}
 
-	var info ShellyInfo
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return nil
+	// Generate device ID from MAC address
+	deviceID := info.DeviceID()
+	if deviceID == "" {
+		return nil, shelly.ErrNotShelly
 	}
 
-	if info.Type == "" {
-		return nil
+	// Get device settings for device name, unless the name is cached
+	deviceName, ok := e.cachedDeviceName(info.Mac, info.FwVersion)
+	if !ok {
+		deviceName = e.fetchDeviceName(ctx, ip, deviceID)
+		e.cacheDeviceName(info.Mac, info.FwVersion, deviceName)
 	}
 
-	// Generate device ID from MAC address
-	deviceID := fmt.Sprintf("shelly%s-%s", strings.ToLower(info.Type), strings.ToLower(info.Mac[len(info.Mac)-6:]))
+	return &ShellyDevice{
+		IP:          ip,
+		DeviceID:    deviceID,
+		DeviceName:  deviceName,
+		DeviceType:  info.Type,
+		Mac:         info.Mac,
+		Firmware:    info.FwVersion,
+		Generation:  1,
+		Source:      sourceLocal,
+		AuthEnabled: &info.AuthEnabled,
+		LastSeen:    time.Now(),
+	}, nil
+}
 
-	// Get device settings for device name
-	var deviceName string
-	settingsResp, err := client.Get(fmt.Sprintf("http://%s/settings", ip))
+// fetchDeviceName returns the name of a Gen1 device from its settings,
+// falling back to the device ID
+func (e *ShellyExporter) fetchDeviceName(ctx context.Context, ip, deviceID string) string {
+	settingsResp, err := e.deviceGet(ctx, fmt.Sprintf("http://%s/settings", ip))
 	if err != nil {
-		deviceName = deviceID // Fallback to device ID
-	} else {
-		defer func() {
-			if err := settingsResp.Body.Close(); err != nil {
-				log.Printf("Error closing response body: %v", err)
-			}
-		}()
-		var settings ShellySettings
-		if err := json.NewDecoder(settingsResp.Body).Decode(&settings); err != nil {
-			deviceName = deviceID // Fallback to device ID
-		} else {
-			// Try to get device name from various possible locations
-			if settings.Name != "" {
-				deviceName = settings.Name
-			} else if settings.Device.Name != "" {
-				deviceName = settings.Device.Name
-			} else if settings.Device.Hostname != "" {
-				deviceName = settings.Device.Hostname
-			} else if settings.Hostname != "" {
-				deviceName = settings.Hostname
-			} else {
-				deviceName = deviceID // Final fallback
-			}
-		}
+		return deviceID
 	}
+	defer closeBody(settingsResp)
 
-	return &ShellyDevice{
-		IP:         ip,
-		DeviceID:   deviceID,
-		DeviceName: deviceName,
-		DeviceType: info.Type,
-		LastSeen:   time.Now(),
+	var settings ShellySettings
+	if err := json.NewDecoder(settingsResp.Body).Decode(&settings); err != nil {
+		return deviceID
 	}
+	// Try to get device name from various possible locations
+	switch {
+	case settings.Name != "":
+		return settings.Name
+	case settings.Device.Name != "":
+		return settings.Device.Name
+	case settings.Device.Hostname != "":
+		return settings.Device.Hostname
+	case settings.Hostname != "":
+		return settings.Hostname
+	}
+	return deviceID
 }
 
 // collectMetricsFromKnownDevices collects metrics from all known Shelly devices
-func (e *ShellyExporter) collectMetricsFromKnownDevices(ctx context.Context) {
+// whose last successful collection is older than maxAge
+func (e *ShellyExporter) collectMetricsFromKnownDevices(ctx context.Context, maxAge time.Duration) {
+	// The standby serves the readings collected while it was active
+	if e.standby.Load() {
+		return
+	}
+
 	e.devicesMutex.RLock()
 	devices := make([]*ShellyDevice, 0, len(e.knownDevices))
+	known := make(map[string]bool, len(e.knownDevices)+len(e.pushedDevices)+len(e.cloudDevices))
 	for _, device := range e.knownDevices {
-		devices = append(devices, device)
+		known[device.DeviceID] = true
+		// Devices pushing their status over a WebSocket aren't polled
+		if _, ok := e.pushedDevices[device.DeviceID]; !ok {
+			devices = append(devices, device)
+		}
+	}
+	for deviceID := range e.pushedDevices {
+		known[deviceID] = true
+	}
+	for deviceID := range e.cloudDevices {
+		known[deviceID] = true
 	}
 	e.devicesMutex.RUnlock()
 
+	// Drop readings of devices that are no longer known
+	e.readings.Update(func(readings map[string]*deviceReading) {
+		for deviceID := range readings {
+			if !known[deviceID] {
+				delete(readings, deviceID)
+			}
+		}
+	})
+	e.forgetLastSeen(known)
+	e.forgetBreakers(known)
+
+	// Skip devices whose cached values are still fresh enough
+	if maxAge > 0 {
+		readings := e.readings.Readings()
+		stale := devices[:0]
+		for _, device := range devices {
+			if reading, ok := readings[device.DeviceID]; !ok || time.Since(reading.collectedAt) >= maxAge {
+				stale = append(stale, device)
+			}
+		}
+		devices = stale
+	} else {
+		devices = e.dueDevices(devices)
+	}
+	devices = e.allowedDevices(devices)
+	e.markPolled(devices)
+
+	if len(known) == 0 {
+		e.collectionLog.Info("No known devices to collect metrics from")
+		e.self.collectionCycles.Inc()
+		e.self.collectionDevicesCollected.Set(0)
+		return
+	}
 	if len(devices) == 0 {
-		log.Printf("No known devices to collect metrics from")
 		return
 	}
 
-	// log.Printf("Collecting metrics from %d known devices...", len(devices))
-	start := time.Now()
+	ctx, span := tracer.Start(ctx, "collection", trace.WithAttributes(attribute.Int("shelly.devices", len(devices))))
+	defer span.End()
 
-	e.mutex.Lock()
-	// Reset metrics
-	e.powerGauge.Reset()
-	e.mutex.Unlock()
+	e.collectionLog.Debug("Collecting metrics from known devices", "devices", len(devices))
+	start := time.Now()
 
 	var wg sync.WaitGroup
 	successCount := 0
 	var successMutex sync.Mutex
 
-	// Collect metrics from each known device
-	for _, device := range devices {
+	// Collect metrics from each known device, spread across the interval
+	// when configured
+	delays := e.collectionDelays(devices, maxAge == 0)
+	for i, device := range devices {
 		wg.Add(1)
 		go func(dev *ShellyDevice) {
 			defer wg.Done()
@@ -258,124 +1049,413 @@ func (e *ShellyExporter) collectMetricsFromKnownDevices(ctx context.Context) {
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case <-time.After(delays[i]):
 			}
 
-			if e.collectShellyMetrics(dev.IP, dev.DeviceID, dev.DeviceName, dev.DeviceType) {
-				successMutex.Lock()
-				successCount++
-				successMutex.Unlock()
+			if !e.collectDevice(ctx, dev) {
+				return
 			}
+			successMutex.Lock()
+			successCount++
+			successMutex.Unlock()
 		}(device)
 	}
 
 	wg.Wait()
 
 	duration := time.Since(start).Seconds()
-	log.Printf("Metrics collection completed in %.2f seconds, collected from %d/%d devices", duration, successCount, len(devices))
+
+	e.self.collectionCycles.Inc()
+	e.self.collectionDuration.Set(duration)
+	e.self.collectionDevicesCollected.Set(float64(successCount))
+	if successCount > 0 {
+		e.self.collectionLastSuccess.SetToCurrentTime()
+	}
+
+	e.collectionLog.Info("Metrics collection completed", "duration", duration, "collected", successCount, "devices", len(devices))
+}
+
+// collectDevice collects a device and updates its circuit breaker. The
+// readings of a device that can't be collected are dropped.
+func (e *ShellyExporter) collectDevice(ctx context.Context, dev *ShellyDevice) bool {
+	ok := e.collectShellyMetrics(ctx, dev)
+	e.recordCollection(dev, ok)
+	if !ok {
+		e.forgetDevice(dev.DeviceID)
+	}
+	return ok
 }
 
 // getIPRange returns a list of IP addresses in the local network range
 func (e *ShellyExporter) getIPRange() []string {
-	var ips []string
+	if e.networkRange == "" {
+		return nil
+	}
 
-	// Parse the network range (assuming CIDR notation like 192.168.1.0/24)
-	_, ipNet, err := net.ParseCIDR(e.networkRange)
+	ips, err := discovery.Hosts(e.networkRange)
 	if err != nil {
-		log.Printf("Error parsing network range %s: %v", e.networkRange, err)
-		return ips
+		e.discoveryLog.Error("Error parsing network range", "network_range", e.networkRange, "error", err)
+		return nil
 	}
+	return ips
+}
+
+// collectShellyMetrics collects metrics from a Shelly device using known device info
+func (e *ShellyExporter) collectShellyMetrics(ctx context.Context, dev *ShellyDevice) (ok bool) {
+	ctx, cancel := context.WithTimeout(withDeviceAuth(ctx, dev), e.collectTimeout(dev))
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "collect "+dev.DeviceID, trace.WithAttributes(deviceAttributes(dev)...))
+	defer func() {
+		if !ok {
+			span.SetStatus(codes.Error, "collection failed")
+		}
+		span.End()
+	}()
+	start := time.Now()
 
-	// Generate IP addresses in the range
-	for ip := ipNet.IP.Mask(ipNet.Mask); ipNet.Contains(ip); inc(ip) {
-		ips = append(ips, ip.String())
+	var reading *deviceReading
+	var unixtime *float64
+	var raw json.RawMessage
+	if e.config.useModbus(dev) {
+		var status gen2Status
+		if status, raw, ok = e.fetchModbusStatus(ctx, dev); !ok {
+			return false
+		}
+		reading = e.newGen2Reading(dev, status)
+	} else if dev.Generation >= 2 {
+		var status gen2Status
+		if raw, ok = e.fetchStatus(ctx, dev, &status); !ok {
+			return false
+		}
+		var sys gen2Sys
+		if status.component("sys", &sys) {
+			unixtime = sys.Unixtime
+		}
+		e.refreshConfig(ctx, dev, status)
+		reading = e.newGen2Reading(dev, status)
+	} else {
+		var status ShellyStatus
+		if raw, ok = e.fetchStatus(ctx, dev, &status); !ok {
+			return false
+		}
+		unixtime = status.Unixtime
+		e.refreshSettings(ctx, dev, status.CfgChangedCnt)
+		reading = e.newGen1Reading(dev, status)
+	}
+	duration := time.Since(start).Seconds()
+	reading.raw = raw
+
+	// The device clock is compared against the middle of the request. Pushed
+	// and cloud statuses may be stale, so drift is only known when polling.
+	if unixtime != nil && *unixtime > 0 {
+		requestTime := float64(start.UnixNano())/1e9 + duration/2
+		reading.samples = append(reading.samples, deviceSample{
+			Desc: e.descs.system.timeDrift, ValueType: prometheus.GaugeValue, Value: *unixtime - requestTime, LabelValues: reading.labelValues(),
+		})
 	}
 
-	// Remove network and broadcast addresses
-	if len(ips) > 2 {
-		return ips[1 : len(ips)-1]
+	reading.samples = append(reading.samples, deviceSample{
+		Desc: e.descs.collectDuration, ValueType: prometheus.GaugeValue, Value: duration, LabelValues: []string{dev.DeviceID},
+	})
+	if dev.Extender != "" {
+		reading.samples = append(reading.samples, deviceSample{
+			Desc: e.descs.extenderClient, ValueType: prometheus.GaugeValue, Value: 1, LabelValues: []string{dev.DeviceID, dev.Extender},
+		})
 	}
-	return ips
+	reading.samples = append(reading.samples, e.handlerSamples(ctx, reading)...)
+	e.storeReading(reading)
+
+	e.collectionLog.Debug("Collected metrics from Shelly device", "device_id", dev.DeviceID, "device_name", dev.DeviceName, "device_type", dev.DeviceType, "ip", dev.IP, "duration", duration)
+	return true
 }
 
-// inc increments an IP address
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+// fetchStatus requests the status of a device, decodes it into status and
+// returns it undecoded. Failures are logged and counted by reason.
+func (e *ShellyExporter) fetchStatus(ctx context.Context, dev *ShellyDevice, status any) (json.RawMessage, bool) {
+	ip, deviceID := dev.IP, dev.DeviceID
+
+	raw, err := e.requestStatus(ctx, dev, status)
+	var statusErr *shelly.StatusError
+	var decodeErr *shelly.DecodeError
+	switch {
+	case err == nil:
+		return raw, true
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden):
+		e.collectionLog.Warn("Authentication failed getting status", "device_id", deviceID, "ip", ip, "status", statusErr.Status)
+		e.collectErrors.WithLabelValues(deviceID, "auth").Inc()
+	case errors.As(err, &statusErr):
+		e.collectionLog.Warn("Unexpected response getting status", "device_id", deviceID, "ip", ip, "status", statusErr.Status)
+		e.collectErrors.WithLabelValues(deviceID, "http_status").Inc()
+	case errors.As(err, &decodeErr):
+		if warnings, lenientErr := decodeLenient(decodeErr.Body, status); lenientErr == nil {
+			e.collectionLog.Debug("Decoded status leniently", "device_id", deviceID, "ip", ip, "warnings", warnings, "error", err)
+			for _, warning := range warnings {
+				e.parseWarnings.WithLabelValues(deviceID, warning.Reason).Inc()
+			}
+			return decodeErr.Body, true
 		}
+		e.collectionLog.Warn("Error decoding status", "device_id", deviceID, "ip", ip, "error", err)
+		e.collectErrors.WithLabelValues(deviceID, "decode").Inc()
+	default:
+		e.collectionLog.Warn("Error getting status", "device_id", deviceID, "ip", ip, "error", err)
+		e.collectErrors.WithLabelValues(deviceID, collectErrorReason(err)).Inc()
 	}
+	return nil, false
 }
 
-// collectShellyMetrics collects metrics from a Shelly device using known device info
-func (e *ShellyExporter) collectShellyMetrics(ip, deviceID, deviceName, deviceType string) bool {
-	client := &http.Client{Timeout: 5 * time.Second}
+// requestStatus requests the status of a device, retrying transient failures
+// with an exponential backoff as long as the collection timeout allows. Some
+// firmware drops the first connection under load.
+func (e *ShellyExporter) requestStatus(ctx context.Context, dev *ShellyDevice, status any) (json.RawMessage, error) {
+	backoff := e.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		raw, err := e.shelly.Status(ctx, dev.IP, dev.Generation, status)
+		// Failed requests are left out, their duration is mostly the timeout
+		if responded(err) {
+			e.self.requestDuration.WithLabelValues(strconv.Itoa(dev.Generation)).Observe(time.Since(start).Seconds())
+		}
+		if err == nil || attempt >= e.config.StatusRetries || !retryable(err) {
+			return raw, err
+		}
 
-	// Get device status
-	statusResp, err := client.Get(fmt.Sprintf("http://%s/status", ip))
-	if err != nil {
-		log.Printf("Error getting status from %s: %v", ip, err)
-		return false
-	}
-	defer func() {
-		if err := statusResp.Body.Close(); err != nil {
-			log.Printf("Error closing response body: %v", err)
+		e.collectionLog.Debug("Retrying status request", "device_id", dev.DeviceID, "ip", dev.IP, "attempt", attempt+1, "backoff", backoff, "error", err)
+		e.statusRetries.WithLabelValues(dev.DeviceID).Inc()
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
 		}
-	}()
+		backoff *= 2
+	}
+}
 
-	var status ShellyStatus
-	if err := json.NewDecoder(statusResp.Body).Decode(&status); err != nil {
-		log.Printf("Error decoding status from %s: %v", ip, err)
+// responded reports whether a request failing with err got a response
+func responded(err error) bool {
+	var statusErr *shelly.StatusError
+	var decodeErr *shelly.DecodeError
+	return err == nil || errors.As(err, &statusErr) || errors.As(err, &decodeErr)
+}
+
+// retryable reports whether a status request failing with err may succeed
+// when repeated: dropped connections and server errors. Timeouts used up the
+// collection timeout, client errors and undecodable responses would repeat.
+func retryable(err error) bool {
+	var statusErr *shelly.StatusError
+	var decodeErr *shelly.DecodeError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &decodeErr):
 		return false
+	default:
+		return collectErrorReason(err) != "timeout" && !errors.Is(err, context.Canceled)
 	}
+}
 
-	e.mutex.Lock()
-	defer e.mutex.Unlock()
-
-	// Set power metrics for each meter
+// newGen1Reading builds a device reading from the status of a Gen1 device
+func (e *ShellyExporter) newGen1Reading(dev *ShellyDevice, status ShellyStatus) *deviceReading {
+	reading := newDeviceReading(dev)
+	e.trackGen1Errors(dev, status)
+	e.trackGen1Voltages(dev, status)
+	e.trackConfigChanges(dev, status.CfgChangedCnt)
+
+	// Set power metric from the meters; like the energy, the power of all
+	// valid meters of multi-channel devices is summed
+	var power float64
+	hasPower := false
 	for _, meter := range status.Meters {
 		if meter.IsValid {
-			e.powerGauge.WithLabelValues(
-				deviceID,
-				deviceName,
-				deviceType,
-				ip,
-			).Set(meter.Power)
+			power += meter.Power
+			hasPower = true
 		}
 	}
+	if hasPower {
+		reading.samples = append(reading.samples, deviceSample{
+			Desc: e.descs.power, ValueType: prometheus.GaugeValue, Value: power, LabelValues: reading.labelValues(),
+		})
+		reading.power = &power
+	}
 
-	// log.Printf("Collected metrics from Shelly device %s ('%s', %s) at %s", deviceID, deviceName, deviceType, ip)
-	return true
+	// Total energy of all valid meters, converted from watt-minutes
+	var energy float64
+	hasEnergy := false
+	for i, meter := range status.Meters {
+		if meter.IsValid {
+			energy += e.counters.monotonic(counterKey(dev, fmt.Sprintf("meter:%d", i)), meter.Total/60)
+			hasEnergy = true
+		}
+	}
+	if hasEnergy {
+		e.setEnergy(reading, energy)
+	}
+
+	reading.samples = append(reading.samples, e.gen1RelaySamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen1EMSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen1InputSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen1SensorSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen1SystemSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.gen1NetworkSamples(reading, status)...)
+	reading.samples = append(reading.samples, e.configDriftSamples(reading, e.gen1ConfigSnapshot(dev))...)
+	return reading
+}
+
+// setEnergy sets the total energy of a reading, which is exported as a counter
+func (e *ShellyExporter) setEnergy(reading *deviceReading, energy float64) {
+	reading.energyWh = &energy
+	reading.samples = append(reading.samples, deviceSample{
+		Desc: e.descs.energy, ValueType: prometheus.CounterValue, Value: energy, LabelValues: reading.labelValues(),
+	})
+	if e.config.Pricing.enabled() {
+		reading.samples = append(reading.samples, e.costSamples(reading, energy)...)
+	}
+}
+
+// counterKey identifies a counter of a device component in the counter store
+func counterKey(dev *ShellyDevice, component string) string {
+	return dev.DeviceID + "/" + component
+}
+
+// storeReading makes a reading visible to scrapes and publishes it to subscribers
+func (e *ShellyExporter) storeReading(reading *deviceReading) {
+	e.applySeriesBudget(reading)
+	for _, reason := range reading.parseWarnings {
+		e.parseWarnings.WithLabelValues(reading.device.DeviceID, reason).Inc()
+	}
+	e.readings.Store(reading.device.DeviceID, reading)
+	e.markSeen(reading)
+	e.events.publish(newReadingEvent(reading))
+}
+
+// collectTimeout returns the status request timeout for a device, honoring per-device overrides
+func (e *ShellyExporter) collectTimeout(dev *ShellyDevice) time.Duration {
+	if timeout := e.config.deviceConfig(dev.DeviceID, dev.Mac).CollectTimeout; timeout > 0 {
+		return timeout
+	}
+	return e.config.CollectTimeout
+}
+
+// deviceGet performs a GET request against a device using the shared client
+// and the configured device credentials. The request is traced up to the
+// response headers.
+func (e *ShellyExporter) deviceGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return e.doer.Do(req)
+}
+
+// tracedDoer sends device requests through a client, tracing them up to the
+// response headers
+type tracedDoer struct {
+	client *http.Client
+}
+
+// Do implements shelly.Doer
+func (d tracedDoer) Do(req *http.Request) (*http.Response, error) {
+	ctx, span := startRequestSpan(req.Context(), req)
+	resp, err := d.client.Do(req.WithContext(ctx))
+	endRequestSpan(span, resp, err)
+	return resp, err
+}
+
+// closeBody drains and closes a response body so the connection can be reused
+func closeBody(resp *http.Response) {
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		slog.Debug("Error draining response body", "error", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		slog.Debug("Error closing response body", "error", err)
+	}
+}
+
+// probeResult classifies the outcome of a discovery probe
+func probeResult(err error) string {
+	switch {
+	case err == nil:
+		return "shelly"
+	case errors.Is(err, shelly.ErrNotShelly):
+		return "not_shelly"
+	case collectErrorReason(err) == "timeout":
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// collectErrorReason classifies a request error into a short reason label
+func collectErrorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
 }
 
 // startPeriodicDiscovery starts the periodic device discovery
 func (e *ShellyExporter) startPeriodicDiscovery(ctx context.Context) {
+	e.discoveryLoop.start()
+	defer e.discoveryLoop.stop()
+
 	// Initial discovery
 	e.discoverDevices(ctx)
+	e.discoveryLoop.markRun()
+	e.ready.Store(true)
 
 	ticker := time.NewTicker(e.discoveryInterval)
 	defer ticker.Stop()
 
+	// With a full discovery interval, only the known devices are re-probed
+	// in between full sweeps; a missing device triggers a full sweep early
+	// in case it got a new address
+	lastFull := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			if full := e.config.FullSweepInterval; full > 0 && time.Since(lastFull) < full {
+				if result := e.rediscoverDevices(ctx); len(result.Removed) == 0 || ctx.Err() != nil {
+					e.discoveryLoop.markRun()
+					continue
+				}
+				e.discoveryLog.Info("Known devices missing, starting a full discovery sweep")
+			}
+			e.discoverDevices(ctx)
+			lastFull = time.Now()
+			e.discoveryLoop.markRun()
+		case <-e.discoverNow:
 			e.discoverDevices(ctx)
+			lastFull = time.Now()
+			e.discoveryLoop.markRun()
 		}
 	}
 }
 
 // startPeriodicMetricsCollection starts the periodic metrics collection from known devices
 func (e *ShellyExporter) startPeriodicMetricsCollection(ctx context.Context) {
+	e.collectionLoop.start()
+	defer e.collectionLoop.stop()
+
 	// Wait a bit for initial discovery to complete
-	time.Sleep(5 * time.Second)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(5 * time.Second):
+	}
 
 	// Initial metrics collection
-	e.collectMetricsFromKnownDevices(ctx)
+	e.collectMetricsFromKnownDevices(ctx, 0)
+	e.collectionLoop.markRun()
 
-	ticker := time.NewTicker(e.metricsInterval)
+	ticker := time.NewTicker(e.config.collectionTick())
 	defer ticker.Stop()
 
 	for {
@@ -383,82 +1463,322 @@ func (e *ShellyExporter) startPeriodicMetricsCollection(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			e.collectMetricsFromKnownDevices(ctx)
+			e.collectMetricsFromKnownDevices(ctx, 0)
+			e.collectionLoop.markRun()
 		}
 	}
 }
 
-// getEnv gets an environment variable with a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			if err := runSimulator(os.Args[2:]); err != nil {
+				slog.Error("Simulator failed", "error", err)
+				os.Exit(1)
+			}
+			return
+		case "record":
+			if err := runRecorder(os.Args[2:]); err != nil {
+				slog.Error("Recording fixtures failed", "error", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
 	}
-	return defaultValue
-}
 
-func main() {
-	// Configuration - can be overridden by environment variables
-	networkRange := getEnv("NETWORK_RANGE", "10.10.10.0/24")
-	discoveryIntervalStr := getEnv("DISCOVERY_INTERVAL", "60s")
-	metricsIntervalStr := getEnv("METRICS_INTERVAL", "10s")
-	port := getEnv("HTTP_PORT", ":8080")
-
-	// Parse intervals
-	discoveryInterval, err := time.ParseDuration(discoveryIntervalStr)
+	// Configuration - read from the optional config file and environment variables
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Invalid discovery interval '%s': %v", discoveryIntervalStr, err)
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
 	}
-
-	metricsInterval, err := time.ParseDuration(metricsIntervalStr)
+	logs, err := newLogging(cfg, os.Stderr)
 	if err != nil {
-		log.Fatalf("Invalid metrics interval '%s': %v", metricsIntervalStr, err)
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
 	}
-
-	// Ensure port starts with ':'
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
+	slog.SetDefault(logs.logger())
+	networkRange := cfg.NetworkRange
+	discoveryInterval := cfg.DiscoveryInterval
+	metricsInterval := cfg.MetricsInterval
+	address := cfg.listenAddress()
+
+	slog.Info("Starting Shelly Prometheus Exporter",
+		"version", version,
+		"network_range", networkRange,
+		"discovery_interval", discoveryInterval,
+		"collection_mode", cfg.CollectionMode,
+	)
+	if cfg.CollectionMode == collectionModeScrape {
+		slog.Info("Collecting metrics on scrape", "scrape_timeout", cfg.ScrapeTimeout, "scrape_cache_ttl", cfg.ScrapeCacheTTL)
+	} else {
+		slog.Info("Collecting metrics periodically", "metrics_interval", metricsInterval)
+	}
+	if cfg.ShardTotal > 1 {
+		slog.Info("Polling a shard of the devices", "shard_index", cfg.ShardIndex, "shard_total", cfg.ShardTotal)
+	}
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		scheme = "https"
+	}
+	if path, ok := strings.CutPrefix(address, unixListenPrefix); ok {
+		slog.Info("Metrics endpoint", "socket", path, "path", "/metrics")
+	} else {
+		slog.Info("Metrics endpoint", "url", fmt.Sprintf("%s://localhost%s/metrics", scheme, address))
 	}
-
-	log.Printf("Starting Shelly Prometheus Exporter")
-	log.Printf("Network range: %s", networkRange)
-	log.Printf("Device discovery interval: %s", discoveryInterval)
-	log.Printf("Metrics collection interval: %s", metricsInterval)
-	log.Printf("Metrics endpoint: http://localhost%s/metrics", port)
 
 	// Create exporter
-	exporter := NewShellyExporter(networkRange, discoveryInterval, metricsInterval)
+	exporter := NewShellyExporter(cfg, logs)
+	if err := exporter.counters.load(); err != nil {
+		slog.Error("Error loading counter state", "error", err)
+		os.Exit(1)
+	}
 
 	// Register with Prometheus
 	prometheus.MustRegister(exporter)
 
-	// Start periodic processes in background
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Start periodic processes in background; SIGINT/SIGTERM cancel them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Registry of the exporter's own metrics for push-based sinks, which
+	// must not query devices in scrape mode
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cachedExporter{exporter})
+	sinkGatherer := exporter.exposition(registry)
+
+	// Push the device metrics over OTLP in addition to serving them
+	shutdownOTLP := func(context.Context) error { return nil }
+	if cfg.OTLP.enabled() {
+		shutdownOTLP, err = startOTLPExport(ctx, cfg.OTLP, sinkGatherer)
+		if err != nil {
+			slog.Error("Error starting OTLP export", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Exporting metrics over OTLP", "endpoint", cfg.OTLP.Endpoint, "protocol", cfg.OTLP.Protocol, "interval", cfg.OTLP.Interval)
+	}
 
-	go exporter.startPeriodicDiscovery(ctx)
-	go exporter.startPeriodicMetricsCollection(ctx)
-
-	// Setup HTTP server for metrics
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		if _, err := fmt.Fprintf(w, `
-<html>
-<head><title>Shelly Prometheus Exporter</title></head>
-<body>
-<h1>Shelly Prometheus Exporter</h1>
-<p><a href="/metrics">Metrics</a></p>
-<p>Network range: %s</p>
-<p>Device discovery interval: %s</p>
-<p>Metrics collection interval: %s</p>
-</body>
-</html>`, networkRange, discoveryInterval, metricsInterval); err != nil {
-			log.Printf("Error writing HTTP response: %v", err)
+	// Trace discovery and collection cycles
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.enabled() {
+		shutdownTracing, err = startTracing(ctx, cfg.Tracing)
+		if err != nil {
+			slog.Error("Error starting tracing", "error", err)
+			os.Exit(1)
 		}
-	})
+		slog.Info("Exporting traces over OTLP", "endpoint", cfg.Tracing.Endpoint, "protocol", cfg.Tracing.Protocol, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+
+	var loops sync.WaitGroup
+	if cfg.HA.enabled() {
+		lease, err := exporter.newLeaseHolder(cfg.HA, slog.Default())
+		if err != nil {
+			slog.Error("Invalid high availability configuration", "error", err)
+			os.Exit(1)
+		}
+		// The role is known before the loops start polling
+		lease.renew(time.Now())
+		slog.Info("High availability enabled", "lease_file", cfg.HA.LeaseFile, "identity", lease.cfg.Identity, "role", exporter.haRole())
+		loops.Go(func() { lease.run(ctx) })
+	}
+	if len(cfg.Alerts) > 0 {
+		alerts := exporter.newAlertEvaluator(cfg.Alerts, sinkGatherer, slog.Default())
+		lifecycle := exporter.deviceEvents.subscribe()
+		slog.Info("Evaluating alerts", "alerts", len(cfg.Alerts), "interval", cfg.AlertInterval)
+		loops.Go(func() {
+			defer exporter.deviceEvents.unsubscribe(lifecycle)
+			alerts.run(ctx, cfg.AlertInterval, lifecycle)
+		})
+	}
+	if sinks := cfg.eventSinks(); len(sinks) > 0 {
+		// Subscribed before discovery starts so no event is missed
+		events := exporter.deviceEvents.subscribe()
+		slog.Info("Sending device events", "webhooks", len(cfg.Webhooks), "notifiers", len(cfg.Notifiers))
+		loops.Go(func() {
+			defer exporter.deviceEvents.unsubscribe(events)
+			runEventSinks(ctx, sinks, events, slog.Default())
+		})
+	}
+	loops.Go(func() { exporter.startPeriodicDiscovery(ctx) })
+	if cfg.StateFile != "" {
+		loops.Go(func() { exporter.counters.run(ctx, cfg.StateFlushInterval, slog.Default()) })
+	}
+	if cfg.CollectionMode == collectionModeInterval {
+		loops.Go(func() { exporter.startPeriodicMetricsCollection(ctx) })
+	}
+	if cfg.Cloud.enabled() {
+		slog.Info("Collecting devices from Shelly Cloud", "server", cfg.Cloud.Server, "interval", cfg.Cloud.Interval)
+		loops.Go(func() { exporter.runCloudCollector(ctx) })
+	}
+	loops.Go(func() { exporter.runRPCClients(ctx) })
+	loops.Go(func() { exporter.runRefreshes(ctx) })
+	if cfg.FileSD.enabled() {
+		slog.Info("Writing file_sd targets", "path", cfg.FileSD.Path, "interval", cfg.FileSD.Interval)
+		loops.Go(func() { exporter.runFileSD(ctx, slog.Default()) })
+	}
+	if cfg.InfluxDB.enabled() {
+		influx, err := newInfluxWriter(cfg.InfluxDB, sinkGatherer, slog.Default())
+		if err != nil {
+			slog.Error("Invalid InfluxDB configuration", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Writing metrics to InfluxDB", "url", cfg.InfluxDB.URL, "interval", cfg.InfluxDB.Interval)
+		loops.Go(func() { influx.run(ctx) })
+	}
+	if cfg.Textfile.enabled() {
+		slog.Info("Writing metrics textfile", "path", cfg.Textfile.Path, "interval", cfg.Textfile.Interval)
+		loops.Go(func() { runTextfile(ctx, cfg.Textfile, sinkGatherer, slog.Default()) })
+	}
+	if cfg.Backfill.enabled() {
+		backfill, err := exporter.newBackfiller(cfg.Backfill, slog.Default())
+		if err != nil {
+			slog.Error("Error loading backfill state", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Backfilling energy history over remote write", "url", cfg.Backfill.RemoteWriteURL, "max_age", cfg.Backfill.MaxAge, "interval", cfg.Backfill.Interval)
+		loops.Go(func() { backfill.run(ctx) })
+	}
+	if cfg.MQTT.enabled() {
+		publisher := newMQTTPublisher(cfg.MQTT, slog.Default())
+		events := exporter.events.subscribe()
+		slog.Info("Publishing readings to MQTT", "broker", cfg.MQTT.Broker, "discovery_prefix", cfg.MQTT.DiscoveryPrefix)
+		loops.Go(func() {
+			defer exporter.events.unsubscribe(events)
+			publisher.run(ctx, events)
+		})
+	}
 
-	log.Printf("Starting HTTP server on %s", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatalf("Error starting HTTP server: %v", err)
+	// Setup HTTP server for metrics; health probes stay unauthenticated
+	protect := requireAuth(cfg.Auth)
+	manage := requireAPIToken(cfg.APIAuth, protect)
+	actuate := requireWritable(cfg.ReadOnly)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", protect(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(exporter.exposition(prometheus.DefaultGatherer), promhttp.HandlerOpts{
+			EnableOpenMetrics: cfg.SampleTimestamps,
+		}),
+	)))
+	mux.HandleFunc("/healthz", exporter.healthzHandler)
+	mux.HandleFunc("/readyz", exporter.readyzHandler)
+	mux.Handle("GET /api/devices", protect(http.HandlerFunc(exporter.devicesHandler)))
+	mux.Handle("GET /api/devices/{id}/raw", protect(http.HandlerFunc(exporter.rawStatusHandler)))
+	mux.Handle("GET /api/firmware", protect(http.HandlerFunc(exporter.firmwareHandler)))
+	mux.Handle("POST /api/discover", manage(http.HandlerFunc(exporter.discoverHandler)))
+	mux.Handle("POST /api/devices/{id}/relay/{n}", manage(actuate(http.HandlerFunc(exporter.relayHandler))))
+	mux.Handle("POST /api/devices/{id}/update", manage(actuate(http.HandlerFunc(exporter.updateHandler))))
+	mux.Handle("GET /api/stream", protect(http.HandlerFunc(exporter.streamHandler)))
+	mux.Handle("/webhook/{device_id}", protect(http.HandlerFunc(exporter.webhookHandler)))
+	if cfg.WSServerEnabled {
+		// Authenticates on its own, devices can only pass a token in the URL
+		mux.HandleFunc("GET /ws/shelly", exporter.pushHandler)
+	}
+	if cfg.PprofEnabled {
+		slog.Info("Profiling endpoints enabled", "path", "/debug/pprof/")
+		mux.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+	}
+	mux.Handle("/", protect(http.HandlerFunc(exporter.landingHandler)))
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.enabled() {
+		tlsConfig, err = cfg.TLS.serverConfig()
+		if err != nil {
+			slog.Error("Invalid TLS configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// The same endpoints are served on every address; additional listeners
+	// may authenticate differently
+	var handler http.Handler = mux
+	if cfg.AccessLog != "" {
+		handler = accessLog(cfg.AccessLog, os.Stdout)(mux)
+	}
+	listeners := append([]ListenConfig{{Address: address}}, cfg.Listeners...)
+	servers := make([]*http.Server, 0, len(listeners))
+	serverErr := make(chan error, len(listeners))
+	for _, lc := range listeners {
+		server := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+			TLSConfig:         tlsConfig,
+		}
+		auth := lc.auth(cfg.Auth)
+		if lc.Auth != nil {
+			server.BaseContext = func(net.Listener) context.Context {
+				return withListenerAuth(context.Background(), auth)
+			}
+		}
+		// End event streams so Shutdown doesn't wait on them
+		server.RegisterOnShutdown(exporter.events.close)
+
+		listener, err := listen(lc.Address)
+		if err != nil {
+			slog.Error("Error starting HTTP server", "address", lc.Address, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Starting HTTP server", "address", lc.Address, "tls", tlsConfig != nil, "auth", auth.enabled())
+		go func() {
+			if server.TLSConfig != nil {
+				serverErr <- server.ServeTLS(listener, "", "")
+			} else {
+				serverErr <- server.Serve(listener)
+			}
+		}()
+		servers = append(servers, server)
+	}
+
+	select {
+	case err := <-serverErr:
+		slog.Error("Error starting HTTP server", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests and drain in-flight scrapes
+	var shutdowns sync.WaitGroup
+	for _, server := range servers {
+		shutdowns.Go(func() {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Error shutting down HTTP server", "error", err)
+			}
+		})
+	}
+	shutdowns.Wait()
+
+	// Push the final metrics before exiting
+	if err := shutdownOTLP(shutdownCtx); err != nil {
+		slog.Error("Error shutting down OTLP export", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error shutting down trace export", "error", err)
+	}
+
+	// Wait for the loops to finish their in-flight device requests
+	done := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Shutdown complete")
+	case <-shutdownCtx.Done():
+		slog.Warn("Shutdown timed out waiting for background loops")
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modbusPort is the Modbus TCP port of Shelly Pro devices
+const modbusPort = "502"
+
+// modbusReadInputRegisters is the Modbus function code reading input registers
+const modbusReadInputRegisters = 0x04
+
+// Input registers of the Pro 3EM. Values are 32-bit floats stored low word
+// first; every phase has a block of the same layout.
+const (
+	modbusEMStart         = 31000
+	modbusEMTotalCurrent  = 31011 // Amperes
+	modbusEMTotalActPower = 31013 // Watts
+	modbusEMTotalAprt     = 31015 // Volt-amperes
+	modbusEMPhaseStart    = 31020
+	modbusEMPhaseSize     = 20
+	modbusEMDataStart     = 31160
+	modbusEMDataTotalAct  = 31162 // Watt-hours
+)
+
+// modbusPhaseFields are the fields of the em:N component in the register
+// block of a phase, by offset from its start
+var modbusPhaseFields = []struct {
+	offset uint16
+	field  string
+}{
+	{0, "voltage"},
+	{2, "current"},
+	{4, "act_power"},
+	{6, "aprt_power"},
+	{8, "pf"},
+}
+
+// useModbus reports whether a device is collected over Modbus TCP instead of
+// HTTP, which is only supported by the Pro 3EM
+func (c *Config) useModbus(dev *ShellyDevice) bool {
+	if dev.Generation < 2 {
+		return false
+	}
+	return c.DeviceTypes[strings.ToUpper(dev.DeviceType)].Modbus || c.deviceConfig(dev.DeviceID, dev.Mac).Modbus
+}
+
+// modbusConn is a Modbus TCP connection to a device
+type modbusConn struct {
+	conn          net.Conn
+	transactionID uint16
+}
+
+// dialModbus connects to the Modbus TCP server of a device
+func dialModbus(ctx context.Context, ip string) (*modbusConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, modbusPort))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &modbusConn{conn: conn}, nil
+}
+
+// readInputRegisters reads count input registers starting at address
+func (c *modbusConn) readInputRegisters(address, count uint16) ([]uint16, error) {
+	c.transactionID++
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint16(request[0:], c.transactionID)
+	binary.BigEndian.PutUint16(request[2:], 0) // Modbus protocol
+	binary.BigEndian.PutUint16(request[4:], 6) // Length of the rest
+	request[6] = 1                             // Unit ID
+	request[7] = modbusReadInputRegisters
+	binary.BigEndian.PutUint16(request[8:], address)
+	binary.BigEndian.PutUint16(request[10:], count)
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	if id := binary.BigEndian.Uint16(header[0:]); id != c.transactionID {
+		return nil, fmt.Errorf("unexpected transaction ID %d", id)
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 {
+		return nil, errors.New("short response")
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, pdu); err != nil {
+		return nil, err
+	}
+	if pdu[0] == modbusReadInputRegisters|0x80 && len(pdu) > 1 {
+		return nil, fmt.Errorf("modbus exception %d", pdu[1])
+	}
+	if pdu[0] != modbusReadInputRegisters || len(pdu) < 2 || int(pdu[1]) != 2*int(count) || len(pdu) < 2+2*int(count) {
+		return nil, errors.New("malformed response")
+	}
+
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return registers, nil
+}
+
+// modbusFloat decodes the 32-bit float at address of a register block
+// starting at start. It's rounded to its shortest decimal representation, so
+// e.g. a power factor of 0.91 isn't exported as 0.9100000262260437.
+func modbusFloat(registers []uint16, start, address uint16) float64 {
+	i := address - start
+	value := math.Float32frombits(uint32(registers[i+1])<<16 | uint32(registers[i]))
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return rounded
+}
+
+// fetchModbusStatus reads the energy meter registers of a Pro 3EM and returns
+// them as the em:0 and emdata:0 components of a status, so the reading is
+// built the same way as from Shelly.GetStatus. Failures are logged and
+// counted by reason.
+func (e *ShellyExporter) fetchModbusStatus(ctx context.Context, dev *ShellyDevice) (gen2Status, json.RawMessage, bool) {
+	start := time.Now()
+	status, err := readModbusStatus(ctx, dev.IP)
+	if err != nil {
+		e.collectionLog.Warn("Error reading Modbus registers", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		e.collectErrors.WithLabelValues(dev.DeviceID, collectErrorReason(err)).Inc()
+		return nil, nil, false
+	}
+	e.self.requestDuration.WithLabelValues(strconv.Itoa(dev.Generation)).Observe(time.Since(start).Seconds())
+
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return nil, nil, false
+	}
+	return status, raw, true
+}
+
+// readModbusStatus reads the energy meter registers of a Pro 3EM
+func readModbusStatus(ctx context.Context, ip string) (gen2Status, error) {
+	conn, err := dialModbus(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.conn.Close()
+
+	const emCount = modbusEMPhaseStart + 3*modbusEMPhaseSize - modbusEMStart
+	em, err := conn.readInputRegisters(modbusEMStart, emCount)
+	if err != nil {
+		return nil, fmt.Errorf("reading em registers: %w", err)
+	}
+	emData, err := conn.readInputRegisters(modbusEMDataStart, 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading emdata registers: %w", err)
+	}
+
+	fields := map[string]float64{
+		"total_current":    modbusFloat(em, modbusEMStart, modbusEMTotalCurrent),
+		"total_act_power":  modbusFloat(em, modbusEMStart, modbusEMTotalActPower),
+		"total_aprt_power": modbusFloat(em, modbusEMStart, modbusEMTotalAprt),
+	}
+	for i, phase := range emPhases {
+		phaseStart := modbusEMPhaseStart + uint16(i)*modbusEMPhaseSize
+		for _, f := range modbusPhaseFields {
+			fields[phase+"_"+f.field] = modbusFloat(em, modbusEMStart, phaseStart+f.offset)
+		}
+	}
+	data := map[string]float64{
+		"total_act": modbusFloat(emData, modbusEMDataStart, modbusEMDataTotalAct),
+	}
+
+	status := make(gen2Status)
+	for key, component := range map[string]map[string]float64{"em:0": fields, "emdata:0": data} {
+		// Values the meter doesn't measure are NaN
+		maps.DeleteFunc(component, func(_ string, value float64) bool { return math.IsNaN(value) })
+		raw, err := json.Marshal(component)
+		if err != nil {
+			return nil, err
+		}
+		status[key] = raw
+	}
+	return status, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig configures publishing readings to an MQTT broker using Home
+// Assistant's MQTT discovery schema
+type MQTTConfig struct {
+	Broker          string `yaml:"broker"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	ClientID        string `yaml:"client_id"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	TopicPrefix     string `yaml:"topic_prefix"`
+}
+
+// enabled reports whether MQTT publishing is configured
+func (c MQTTConfig) enabled() bool {
+	return c.Broker != ""
+}
+
+// haDevice is the device block of a Home Assistant discovery message
+type haDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections,omitempty"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model"`
+	SwVersion    string      `json:"sw_version,omitempty"`
+}
+
+// haSensor is a Home Assistant MQTT discovery message for a sensor
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	Device            haDevice `json:"device"`
+}
+
+// mqttPublisher publishes device readings and Home Assistant discovery messages
+type mqttPublisher struct {
+	cfg       MQTTConfig
+	client    mqtt.Client
+	log       *slog.Logger
+	mutex     sync.Mutex
+	announced map[string]bool
+}
+
+// newMQTTPublisher creates a publisher connecting to the configured broker
+func newMQTTPublisher(cfg MQTTConfig, log *slog.Logger) *mqttPublisher {
+	p := &mqttPublisher{cfg: cfg, log: log, announced: make(map[string]bool)}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			log.Info("Connected to MQTT broker", "broker", cfg.Broker)
+			client.Publish(p.availabilityTopic(), 1, true, "online")
+			// Re-announce devices in case the broker lost retained messages
+			p.mutex.Lock()
+			p.announced = make(map[string]bool)
+			p.mutex.Unlock()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warn("Lost connection to MQTT broker", "broker", cfg.Broker, "error", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+// availabilityTopic is the topic announcing whether the exporter is online
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.cfg.TopicPrefix + "/status"
+}
+
+// stateTopic is the topic a device's sensor values are published to
+func (p *mqttPublisher) stateTopic(deviceID, sensor string) string {
+	return fmt.Sprintf("%s/%s/%s", p.cfg.TopicPrefix, deviceID, sensor)
+}
+
+// run publishes readings from the events until the context is cancelled
+func (p *mqttPublisher) run(ctx context.Context, events chan readingEvent) {
+	// Connecting retries in the background, publishes are queued meanwhile
+	p.client.Connect()
+	defer func() {
+		p.client.Publish(p.availabilityTopic(), 1, true, "offline").WaitTimeout(time.Second)
+		p.client.Disconnect(250)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			p.publish(event)
+		}
+	}
+}
+
+// publish announces a device on first sight and publishes its readings
+func (p *mqttPublisher) publish(event readingEvent) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	p.mutex.Lock()
+	announced := p.announced[event.DeviceID]
+	p.announced[event.DeviceID] = true
+	p.mutex.Unlock()
+	if !announced {
+		p.announce(event)
+	}
+
+	if event.PowerWatts != nil {
+		p.client.Publish(p.stateTopic(event.DeviceID, "power"), 0, false, strconv.FormatFloat(*event.PowerWatts, 'f', -1, 64))
+	}
+	if event.EnergyWh != nil {
+		p.client.Publish(p.stateTopic(event.DeviceID, "energy"), 0, false, strconv.FormatFloat(*event.EnergyWh, 'f', 3, 64))
+	}
+}
+
+// announce publishes retained Home Assistant discovery messages for a device's sensors
+func (p *mqttPublisher) announce(event readingEvent) {
+	device := haDevice{
+		Identifiers:  []string{event.DeviceID},
+		Name:         event.DeviceName,
+		Manufacturer: "Shelly",
+		Model:        event.DeviceType,
+		SwVersion:    event.Firmware,
+	}
+	if event.MAC != "" {
+		device.Connections = [][2]string{{"mac", formatMAC(event.MAC)}}
+	}
+
+	sensors := map[string]haSensor{
+		"power": {
+			Name: "Power", DeviceClass: "power", StateClass: "measurement", UnitOfMeasurement: "W",
+		},
+		"energy": {
+			Name: "Energy", DeviceClass: "energy", StateClass: "total_increasing", UnitOfMeasurement: "Wh",
+		},
+	}
+	for key, sensor := range sensors {
+		sensor.UniqueID = event.DeviceID + "_" + key
+		sensor.StateTopic = p.stateTopic(event.DeviceID, key)
+		sensor.AvailabilityTopic = p.availabilityTopic()
+		sensor.Device = device
+
+		payload, err := json.Marshal(sensor)
+		if err != nil {
+			p.log.Error("Error encoding MQTT discovery message", "device_id", event.DeviceID, "error", err)
+			continue
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", p.cfg.DiscoveryPrefix, event.DeviceID, key)
+		p.client.Publish(topic, 1, true, payload)
+	}
+	p.log.Info("Announced device to Home Assistant", "device_id", event.DeviceID)
+}
+
+// formatMAC formats a bare MAC address as colon-separated lowercase pairs
+func formatMAC(mac string) string {
+	mac = strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(mac) != 12 {
+		return mac
+	}
+	pairs := make([]string, 0, 6)
+	for i := 0; i < 12; i += 2 {
+		pairs = append(pairs, mac[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Network interfaces of a device, exported as the interface label
+const (
+	interfaceEthernet = "eth"
+	interfaceWiFi     = "wifi"
+)
+
+// networkDescs holds the descriptors of device network metrics
+type networkDescs struct {
+	ethLinkUp *prometheus.Desc
+	iface     *prometheus.Desc
+	wifiAP    *prometheus.Desc
+	zigbee    *prometheus.Desc
+}
+
+// newNetworkDescs creates the descriptors of device network metrics
+func newNetworkDescs() networkDescs {
+	return networkDescs{
+		ethLinkUp: prometheus.NewDesc(
+			"shelly_eth_link_up",
+			"Whether the Ethernet interface of a Shelly Pro device is connected with an address (1) or not (0)",
+			deviceLabelNames, nil,
+		),
+		iface: prometheus.NewDesc(
+			"shelly_network_interface_info",
+			"Network interface a Shelly device is reached through, eth or wifi",
+			append(append([]string{}, deviceLabelNames...), "interface"), nil,
+		),
+		wifiAP: prometheus.NewDesc(
+			"shelly_wifi_ap_info",
+			"WiFi network and access point a Shelly device is associated with; the BSSID is only reported by Gen2+ devices",
+			append(append([]string{}, deviceLabelNames...), "ssid", "bssid"), nil,
+		),
+		zigbee: prometheus.NewDesc(
+			"shelly_zigbee_network_joined",
+			"Whether a Gen4 device has joined a Zigbee network (1) or not (0)",
+			deviceLabelNames, nil,
+		),
+	}
+}
+
+// all returns all device network metric descriptors
+func (d networkDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.ethLinkUp,
+		d.iface,
+		d.wifiAP,
+		d.zigbee,
+	}
+}
+
+// gen2Eth is the status of the eth component of Gen2+ Pro devices
+type gen2Eth struct {
+	IP *string `json:"ip"` // null without link
+}
+
+// gen2WiFi is the status of the wifi component of a Gen2+ device
+type gen2WiFi struct {
+	StaIP *string `json:"sta_ip"`
+	SSID  *string `json:"ssid"`
+	BSSID *string `json:"bssid"`
+}
+
+// gen2Zigbee is the status of the zigbee component of Gen4 devices
+type gen2Zigbee struct {
+	NetworkState string `json:"network_state"` // e.g. steering or joined
+}
+
+// gen1WiFiSta is the WiFi client status of a Gen1 device
+type gen1WiFiSta struct {
+	Connected bool   `json:"connected"`
+	SSID      string `json:"ssid"`
+}
+
+// gen2NetworkSamples returns the Ethernet link state of a Gen2+ Pro device
+// and the interface the exporter reaches the device through, so cabling
+// issues can be told apart from WiFi issues
+func (e *ShellyExporter) gen2NetworkSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	d := e.descs.network
+
+	var eth gen2Eth
+	hasEth := reading.component(status, "eth", &eth)
+	var wifi gen2WiFi
+	reading.component(status, "wifi", &wifi)
+	ethUp := hasEth && eth.IP != nil && *eth.IP != ""
+
+	// Devices behind a range extender are reached through a mapped port
+	host, _, err := net.SplitHostPort(reading.device.IP)
+	if err != nil {
+		host = reading.device.IP
+	}
+	var iface string
+	switch {
+	case ethUp && *eth.IP == host:
+		iface = interfaceEthernet
+	case wifi.StaIP != nil && *wifi.StaIP == host:
+		iface = interfaceWiFi
+	case ethUp:
+		iface = interfaceEthernet
+	case wifi.StaIP != nil && *wifi.StaIP != "":
+		iface = interfaceWiFi
+	}
+
+	var ethLinkUp *float64
+	if hasEth {
+		ethLinkUp = boolValue(&ethUp)
+	}
+	samples := appendValues(nil, reading.labelValues(),
+		optionalValue{d.ethLinkUp, prometheus.GaugeValue, ethLinkUp})
+	if iface != "" {
+		samples = append(samples, deviceSample{
+			Desc: d.iface, ValueType: prometheus.GaugeValue, Value: 1, LabelValues: append(reading.labelValues(), iface),
+		})
+	}
+	if wifi.SSID != nil && *wifi.SSID != "" {
+		var bssid string
+		if wifi.BSSID != nil {
+			bssid = *wifi.BSSID
+		}
+		samples = append(samples, e.wifiAPSamples(reading, *wifi.SSID, bssid)...)
+	}
+	var zigbee gen2Zigbee
+	if reading.component(status, "zigbee", &zigbee) {
+		joined := zigbee.NetworkState == "joined"
+		samples = appendValues(samples, reading.labelValues(),
+			optionalValue{d.zigbee, prometheus.GaugeValue, boolValue(&joined)})
+	}
+	return samples
+}
+
+// gen1NetworkSamples returns the WiFi network a Gen1 device is associated with
+func (e *ShellyExporter) gen1NetworkSamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	if !status.WiFiSta.Connected || status.WiFiSta.SSID == "" {
+		return nil
+	}
+	return e.wifiAPSamples(reading, status.WiFiSta.SSID, "")
+}
+
+// wifiAPSamples returns the access point a device is associated with and
+// counts a reassociation when it changed since the previous reading, e.g. a
+// device roaming between the nodes of a mesh network
+func (e *ShellyExporter) wifiAPSamples(reading *deviceReading, ssid, bssid string) []deviceSample {
+	ap := ssid + "/" + bssid
+	deviceID := reading.device.DeviceID
+	e.wifiAPsMutex.Lock()
+	previous, ok := e.wifiAPs[deviceID]
+	e.wifiAPs[deviceID] = ap
+	e.wifiAPsMutex.Unlock()
+	if ok && previous != ap {
+		e.wifiReassociations.WithLabelValues(deviceID).Inc()
+		e.collectionLog.Debug("Device associated with another access point", "device_id", deviceID, "ssid", ssid, "bssid", bssid)
+	}
+
+	return []deviceSample{{
+		Desc: e.descs.network.wifiAP, ValueType: prometheus.GaugeValue, Value: 1, LabelValues: append(reading.labelValues(), ssid, bssid),
+	}}
+}
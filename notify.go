@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Notification services supported by notifiers
+const (
+	notifierSlack    = "slack"
+	notifierTelegram = "telegram"
+	notifierNtfy     = "ntfy"
+)
+
+var notifierTypes = []string{notifierSlack, notifierTelegram, notifierNtfy}
+
+// Default servers of the notification services
+const (
+	defaultTelegramURL = "https://api.telegram.org"
+	defaultNtfyURL     = "https://ntfy.sh"
+)
+
+// NotifierConfig configures a notification service device events are sent to
+// as human-readable messages
+type NotifierConfig struct {
+	// Type is the notification service: slack, telegram or ntfy
+	Type string `yaml:"type"`
+	// Events selects the event types sent; all when empty
+	Events []string `yaml:"events"`
+	// URL is Slack's incoming webhook URL, or the Telegram API or ntfy
+	// server when not using the public ones
+	URL string `yaml:"url"`
+	// Token is the Telegram bot token or the ntfy access token
+	Token  string `yaml:"token"`
+	ChatID string `yaml:"chat_id"` // Telegram
+	Topic  string `yaml:"topic"`   // ntfy
+	// Template renders the message text from the event's fields
+	Template string `yaml:"template"`
+
+	template *template.Template
+}
+
+// compile validates the notifier and parses its template
+func (c *NotifierConfig) compile() error {
+	if !slices.Contains(notifierTypes, c.Type) {
+		return fmt.Errorf("invalid notifier type '%s': must be one of %s", c.Type, strings.Join(notifierTypes, ", "))
+	}
+	for _, event := range c.Events {
+		if !slices.Contains(deviceEventTypes, event) {
+			return fmt.Errorf("invalid %s notifier event '%s': must be one of %s", c.Type, event, strings.Join(deviceEventTypes, ", "))
+		}
+	}
+
+	switch c.Type {
+	case notifierSlack:
+		if c.URL == "" {
+			return fmt.Errorf("invalid slack notifier: missing url")
+		}
+	case notifierTelegram:
+		if c.Token == "" || c.ChatID == "" {
+			return fmt.Errorf("invalid telegram notifier: token and chat_id are required")
+		}
+		if c.URL == "" {
+			c.URL = defaultTelegramURL
+		}
+	case notifierNtfy:
+		if c.Topic == "" {
+			return fmt.Errorf("invalid ntfy notifier: missing topic")
+		}
+		if c.URL == "" {
+			c.URL = defaultNtfyURL
+		}
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("invalid %s notifier url: %w", c.Type, err)
+	}
+
+	if c.Template == "" {
+		return nil
+	}
+	tmpl, err := template.New(c.Type).Parse(c.Template)
+	if err != nil {
+		return fmt.Errorf("invalid template of %s notifier: %w", c.Type, err)
+	}
+	c.template = tmpl
+	return nil
+}
+
+// wants reports whether events of the given type are sent to the notifier
+func (c *NotifierConfig) wants(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// String identifies the notifier in logs
+func (c *NotifierConfig) String() string {
+	if c.Type == notifierNtfy {
+		return c.Type + ":" + c.Topic
+	}
+	return c.Type
+}
+
+// message renders the message text for an event
+func (c *NotifierConfig) message(event deviceEvent) (string, error) {
+	if c.template == nil {
+		return event.message(), nil
+	}
+	var buf strings.Builder
+	if err := c.template.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// message describes the event in a sentence
+func (e deviceEvent) message() string {
+	name := e.DeviceName
+	if name == "" {
+		name = e.DeviceID
+	}
+	if name == "" {
+		// Alerts on the exporter's own metrics
+		name = "shelly-exporter"
+	}
+	switch e.Event {
+	case eventDiscovered:
+		return fmt.Sprintf("Discovered %s (%s) at %s", name, e.DeviceType, e.IP)
+	case eventOnline:
+		return fmt.Sprintf("%s is back online at %s", name, e.IP)
+	case eventOffline:
+		return fmt.Sprintf("%s went offline", name)
+	case eventIPChanged:
+		return fmt.Sprintf("%s moved from %s to %s", name, e.PreviousIP, e.IP)
+	case eventAlertFiring:
+		if e.Value != nil {
+			return fmt.Sprintf("Alert %s firing for %s: %g", e.Alert, name, *e.Value)
+		}
+		return fmt.Sprintf("Alert %s firing for %s", e.Alert, name)
+	case eventAlertResolved:
+		return fmt.Sprintf("Alert %s resolved for %s", e.Alert, name)
+	}
+	return fmt.Sprintf("%s: %s", name, e.Event)
+}
+
+// send delivers an event's message through the notification service
+func (c *NotifierConfig) send(ctx context.Context, client *http.Client, event deviceEvent) error {
+	text, err := c.message(event)
+	if err != nil {
+		return fmt.Errorf("rendering message: %w", err)
+	}
+
+	var req *http.Request
+	switch c.Type {
+	case notifierSlack:
+		req, err = newJSONRequest(ctx, c.URL, map[string]string{"text": text})
+	case notifierTelegram:
+		endpoint := strings.TrimSuffix(c.URL, "/") + "/bot" + c.Token + "/sendMessage"
+		req, err = newJSONRequest(ctx, endpoint, map[string]string{"chat_id": c.ChatID, "text": text})
+	case notifierNtfy:
+		endpoint := strings.TrimSuffix(c.URL, "/") + "/" + url.PathEscape(c.Topic)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(text))
+		if err == nil {
+			req.Header.Set("Tags", event.Event)
+			if c.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.Token)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = postEvent(client, req)
+	// Telegram's URL contains the bot token, keep it out of the logs
+	var urlErr *url.Error
+	if c.Token != "" && errors.As(err, &urlErr) {
+		urlErr.URL = strings.ReplaceAll(urlErr.URL, c.Token, "<token>")
+	}
+	return err
+}
+
+// newJSONRequest creates a POST request with a JSON body
+func newJSONRequest(ctx context.Context, endpoint string, body any) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
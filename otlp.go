@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// OTLP protocols
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+)
+
+// OTLPConfig configures pushing the exporter's metrics to an OpenTelemetry collector
+type OTLPConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol"`
+	Interval time.Duration     `yaml:"interval"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// enabled reports whether OTLP export is configured
+func (c OTLPConfig) enabled() bool {
+	return c.Endpoint != ""
+}
+
+// startOTLPExport periodically pushes all metrics of the gatherer to the
+// configured OTLP endpoint. The returned function flushes and stops the export.
+func startOTLPExport(ctx context.Context, cfg OTLPConfig, gatherer prometheus.Gatherer) (func(context.Context) error, error) {
+	var (
+		exporter sdkmetric.Exporter
+		err      error
+	)
+	switch cfg.Protocol {
+	case otlpProtocolGRPC:
+		exporter, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpointURL(cfg.Endpoint),
+			otlpmetricgrpc.WithHeaders(cfg.Headers),
+		)
+	case otlpProtocolHTTP:
+		exporter, err = otlpmetrichttp.New(ctx,
+			otlpmetrichttp.WithEndpointURL(cfg.Endpoint),
+			otlpmetrichttp.WithHeaders(cfg.Headers),
+		)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s': must be %q or %q", cfg.Protocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(cfg.Interval),
+		sdkmetric.WithProducer(prombridge.NewMetricProducer(prombridge.WithGatherer(gatherer))),
+	)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(semconv.ServiceName("shelly-exporter"))),
+	)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Reasons of parse warnings, exported as the reason label
+const (
+	parseWarningNumericString = "numeric_string" // Number reported as a string
+	parseWarningDroppedField  = "dropped_field"  // Field of an unexpected type ignored
+)
+
+// parseWarning is a field of a status that only decoded leniently
+type parseWarning struct {
+	Field  string // Path of the field, e.g. meters.0.power
+	Reason string
+}
+
+// decodeLenient decodes a JSON object into v after strict decoding failed, as
+// some community firmware and old models report fields slightly differently,
+// e.g. power as a string. Strings holding a number are converted where v
+// expects a number, other values that don't fit their field are left out.
+// It returns a warning for every field that needed either, and fails only
+// when the document isn't an object.
+func decodeLenient(raw []byte, v any) ([]parseWarning, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	// Strict decoding may have filled v partially
+	target := reflect.ValueOf(v).Elem()
+	target.SetZero()
+
+	var warnings []parseWarning
+	value := lenientValue(raw, target.Type(), "", &warnings)
+	if err := json.Unmarshal(value, v); err != nil {
+		return warnings, err
+	}
+	return warnings, nil
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// lenientValue returns raw adjusted to decode into a value of type t. Objects
+// and arrays are adjusted element by element, so only the leaves that don't
+// fit are converted or replaced by null.
+func lenientValue(raw json.RawMessage, t reflect.Type, path string, warnings *[]parseWarning) json.RawMessage {
+	if fits(raw, t) {
+		return raw
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	custom := reflect.PointerTo(t).Implements(unmarshalerType)
+	switch kind := t.Kind(); {
+	case custom:
+		// Types decoding themselves are kept or dropped as a whole
+	case kind == reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil || fields == nil {
+			break
+		}
+		types := jsonFields(t)
+		for name, value := range fields {
+			if field, ok := types[strings.ToLower(name)]; ok {
+				fields[name] = lenientValue(value, field, joinPath(path, name), warnings)
+			}
+		}
+		return lenientResult(fields, t, path, warnings)
+	case kind == reflect.Map && t.Key().Kind() == reflect.String:
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(raw, &entries) != nil || entries == nil {
+			break
+		}
+		for key, value := range entries {
+			entries[key] = lenientValue(value, t.Elem(), joinPath(path, key), warnings)
+		}
+		return lenientResult(entries, t, path, warnings)
+	case kind == reflect.Slice && t.Elem().Kind() != reflect.Uint8, kind == reflect.Array:
+		var elements []json.RawMessage
+		if json.Unmarshal(raw, &elements) != nil || elements == nil {
+			break
+		}
+		for i, value := range elements {
+			elements[i] = lenientValue(value, t.Elem(), joinPath(path, strconv.Itoa(i)), warnings)
+		}
+		return lenientResult(elements, t, path, warnings)
+	case isNumeric(kind):
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			break
+		}
+		number := json.RawMessage(strings.TrimSpace(s))
+		var n json.Number
+		if json.Unmarshal(number, &n) == nil && fits(number, t) {
+			*warnings = append(*warnings, parseWarning{Field: path, Reason: parseWarningNumericString})
+			return number
+		}
+	}
+
+	*warnings = append(*warnings, parseWarning{Field: path, Reason: parseWarningDroppedField})
+	return json.RawMessage("null")
+}
+
+// lenientResult encodes the adjusted elements of an object or array, or drops
+// the whole value when it still doesn't fit t
+func lenientResult(elements any, t reflect.Type, path string, warnings *[]parseWarning) json.RawMessage {
+	value, err := json.Marshal(elements)
+	if err != nil || !fits(value, t) {
+		*warnings = append(*warnings, parseWarning{Field: path, Reason: parseWarningDroppedField})
+		return json.RawMessage("null")
+	}
+	return value
+}
+
+// fits reports whether raw decodes into a value of type t
+func fits(raw json.RawMessage, t reflect.Type) bool {
+	return json.Unmarshal(raw, reflect.New(t).Interface()) == nil
+}
+
+// jsonFields returns the types of the fields of a struct by their lower-case
+// JSON name, including the fields of embedded structs. encoding/json matches
+// names case-insensitively too.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		embedded := field.Type
+		if embedded.Kind() == reflect.Pointer {
+			embedded = embedded.Elem()
+		}
+		if field.Anonymous && name == "" && embedded.Kind() == reflect.Struct {
+			for name, t := range jsonFields(embedded) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = t
+				}
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+// isNumeric reports whether values of a kind are decoded from JSON numbers
+func isNumeric(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// joinPath appends a field name or array index to the path of a field
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeLenient(t *testing.T) {
+	raw := `{
+		"meters": [{"power": "12.5", "is_valid": true}, {"power": "n/a", "is_valid": true}],
+		"uptime": " 3600 ",
+		"relays": [{"ison": "yes", "source": "123", "timer_duration": "30"}],
+		"unknown": "42"
+	}`
+	var status ShellyStatus
+	warnings, err := decodeLenient([]byte(raw), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []parseWarning{
+		{"meters.0.power", parseWarningNumericString},
+		{"meters.1.power", parseWarningDroppedField},
+		{"relays.0.ison", parseWarningDroppedField},
+		{"relays.0.timer_duration", parseWarningNumericString},
+		{"uptime", parseWarningNumericString},
+	}
+	got := make(map[parseWarning]bool)
+	for _, warning := range warnings {
+		got[warning] = true
+	}
+	if len(warnings) != len(want) {
+		t.Errorf("got warnings %v, want %v", warnings, want)
+	}
+	for _, warning := range want {
+		if !got[warning] {
+			t.Errorf("missing warning %v in %v", warning, warnings)
+		}
+	}
+
+	if len(status.Meters) != 2 || status.Meters[0].Power != 12.5 || !status.Meters[1].IsValid {
+		t.Errorf("unexpected meters %+v", status.Meters)
+	}
+	if status.Uptime == nil || *status.Uptime != 3600 {
+		t.Errorf("got uptime %v, want 3600", status.Uptime)
+	}
+	// Strings holding digits stay strings where a string is expected
+	if len(status.Relays) != 1 || status.Relays[0].Source != "123" || status.Relays[0].TimerDuration != 30 {
+		t.Errorf("unexpected relays %+v", status.Relays)
+	}
+}
+
+func TestGen2ComponentLenient(t *testing.T) {
+	status := gen2Status{"switch:0": json.RawMessage(`{"id": 0, "output": true, "apower": "8.25", "voltage": {"v": 230}}`)}
+	reading := &deviceReading{}
+
+	var meter gen2Meter
+	if !reading.component(status, "switch:0", &meter) {
+		t.Fatal("component not decoded")
+	}
+	if meter.APower == nil || *meter.APower != 8.25 {
+		t.Errorf("got apower %v, want 8.25", meter.APower)
+	}
+	want := map[string]string{
+		"switch:0.apower":  parseWarningNumericString,
+		"switch:0.voltage": parseWarningDroppedField,
+	}
+	if !reflect.DeepEqual(reading.parseWarnings, want) {
+		t.Errorf("got warnings %v, want %v", reading.parseWarnings, want)
+	}
+}
@@ -0,0 +1,93 @@
+// Package collector collects additional metrics from Shelly devices through
+// handlers, which each support a set of device models. Handlers are kept in
+// a registry; the exporter runs the handlers of the default registry for
+// every device it polls, in addition to its built-in metrics, and serves the
+// readings of all devices through a Collector.
+//
+// The models the exporter supports itself, e.g. the Wall Display, aren't
+// handlers: their readings are also built from pushed and cloud statuses,
+// without requests to the device, and share the exporter's counters and
+// metric groups. Handlers are meant for models and metrics it doesn't cover.
+package collector
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// Device is a device to collect metrics from
+type Device struct {
+	Addr   string         // Address with an optional port
+	Info   *shelly.Info   // Identification from the /shelly endpoint
+	Client *shelly.Client // Client to send requests to the device with
+}
+
+// Metric is a sample collected by a handler. Metrics of the same name must
+// have the same help text and label names.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   prometheus.ValueType // Gauge when zero
+	Labels map[string]string
+	Value  float64
+}
+
+// ValueType returns the type of the metric, defaulting to a gauge
+func (m Metric) ValueType() prometheus.ValueType {
+	if m.Type == 0 {
+		return prometheus.GaugeValue
+	}
+	return m.Type
+}
+
+// Handler collects metrics from the device models it supports
+type Handler interface {
+	// Supports reports whether the handler collects metrics from a device
+	Supports(info *shelly.Info) bool
+	// Collect collects the metrics of a device
+	Collect(ctx context.Context, device Device) ([]Metric, error)
+}
+
+// Registry holds handlers
+type Registry struct {
+	mutex    sync.RWMutex
+	handlers []Handler
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry is the registry whose handlers the exporter runs
+var DefaultRegistry = NewRegistry()
+
+// Register adds a handler to the registry
+func (r *Registry) Register(h Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers = append(r.handlers, h)
+}
+
+// Handlers returns the handlers supporting a device in registration order
+func (r *Registry) Handlers(info *shelly.Info) []Handler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var handlers []Handler
+	for _, h := range r.handlers {
+		if h.Supports(info) {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+// Register adds a handler to the default registry, typically from the init
+// function of the file implementing it
+func Register(h Handler) {
+	DefaultRegistry.Register(h)
+}
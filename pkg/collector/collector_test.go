@@ -0,0 +1,128 @@
+package collector
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// genHandler supports the devices of a generation
+type genHandler int
+
+func (h genHandler) Supports(info *shelly.Info) bool { return info.Generation() == int(h) }
+
+func (h genHandler) Collect(ctx context.Context, device Device) ([]Metric, error) {
+	return nil, nil
+}
+
+func TestRegistryHandlers(t *testing.T) {
+	r := NewRegistry()
+	r.Register(genHandler(2))
+	r.Register(genHandler(1))
+	r.Register(genHandler(2))
+
+	if got := r.Handlers(&shelly.Info{Gen: 2}); !slices.Equal(got, []Handler{genHandler(2), genHandler(2)}) {
+		t.Errorf("got handlers %v for a Gen2 device", got)
+	}
+	if got := r.Handlers(&shelly.Info{Type: "SHPLG-S"}); !slices.Equal(got, []Handler{genHandler(1)}) {
+		t.Errorf("got handlers %v for a Gen1 device", got)
+	}
+	if got := r.Handlers(&shelly.Info{Gen: 3}); len(got) != 0 {
+		t.Errorf("got handlers %v for a Gen3 device", got)
+	}
+}
+
+func TestMetricSample(t *testing.T) {
+	m := Metric{Name: "my_temperature_celsius", Help: "Temperature", Labels: map[string]string{"sensor": "1", "channel": "0"}, Value: 21.5}
+	sample, err := m.Sample([]string{"device_id"}, []string{"shellyht-aabbcc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"shellyht-aabbcc", "0", "1"}; !slices.Equal(sample.LabelValues, want) {
+		t.Errorf("got label values %v, want %v", sample.LabelValues, want)
+	}
+	if sample.ValueType != prometheus.GaugeValue || sample.Value != 21.5 {
+		t.Errorf("got %v of type %v, want a gauge of 21.5", sample.Value, sample.ValueType)
+	}
+
+	if _, err := (Metric{Name: "my_metric", Help: "Invalid", Labels: map[string]string{"sensor": "\xff"}}).Sample(nil, nil); err == nil {
+		t.Error("invalid label value accepted")
+	}
+}
+
+// testReading is a reading with fixed samples
+type testReading struct {
+	samples []Sample
+	at      time.Time
+}
+
+func (r testReading) Samples() []Sample      { return r.samples }
+func (r testReading) CollectedAt() time.Time { return r.at }
+
+// collect returns the metrics of a collector
+func collect(t *testing.T, c prometheus.Collector) []*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var metrics []*dto.Metric
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, &m)
+	}
+	return metrics
+}
+
+func TestCollector(t *testing.T) {
+	power := prometheus.NewDesc("power_watts", "Power", []string{"device_id"}, nil)
+	energy := prometheus.NewDesc("energy_wh", "Energy", []string{"device_id"}, nil)
+	at := time.Unix(1700000000, 0)
+	reading := func(id string, watts float64) testReading {
+		return testReading{at: at, samples: []Sample{
+			{Desc: power, ValueType: prometheus.GaugeValue, Value: watts, LabelValues: []string{id}},
+			{Desc: energy, ValueType: prometheus.CounterValue, Value: 100, LabelValues: []string{id}},
+		}}
+	}
+
+	c := New[testReading]()
+	c.Store("a", reading("a", 1))
+	c.Store("b", reading("b", 2))
+	snapshot := c.Readings()
+	c.Update(func(readings map[string]testReading) {
+		readings["a"] = reading("a", 3)
+		delete(readings, "b")
+	})
+	if len(snapshot) != 2 || snapshot["a"].samples[0].Value != 1 {
+		t.Error("update modified a previous snapshot")
+	}
+	if got := c.Readings(); len(got) != 1 || got["a"].samples[0].Value != 3 {
+		t.Errorf("got readings %v after the update", got)
+	}
+
+	if metrics := collect(t, c); len(metrics) != 2 || metrics[0].TimestampMs != nil {
+		t.Errorf("got %v, want both samples without timestamps", metrics)
+	}
+
+	c.Skip = func(desc *prometheus.Desc) bool { return desc == energy }
+	c.Timestamps = true
+	metrics := collect(t, c)
+	if len(metrics) != 1 || metrics[0].GetGauge().GetValue() != 3 || metrics[0].GetTimestampMs() != at.UnixMilli() {
+		t.Errorf("got %v, want the power sample with the reading time", metrics)
+	}
+
+	c.Delete("a")
+	if metrics := collect(t, c); len(metrics) != 0 {
+		t.Errorf("got %v after deleting the reading", metrics)
+	}
+}
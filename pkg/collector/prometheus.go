@@ -0,0 +1,121 @@
+package collector
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sample is a value of a device metric
+type Sample struct {
+	Desc        *prometheus.Desc
+	ValueType   prometheus.ValueType
+	Value       float64
+	LabelValues []string
+}
+
+// Sample converts a metric into a sample with additional labels, e.g. the
+// device labels of the exporter, before its own ones, which are sorted by
+// name. It fails for invalid metric or label names.
+func (m Metric) Sample(labelNames, labelValues []string) (Sample, error) {
+	names := append([]string{}, labelNames...)
+	values := append([]string{}, labelValues...)
+	for _, name := range slices.Sorted(maps.Keys(m.Labels)) {
+		names = append(names, name)
+		values = append(values, m.Labels[name])
+	}
+	desc := prometheus.NewDesc(m.Name, m.Help, names, nil)
+	if _, err := prometheus.NewConstMetric(desc, m.ValueType(), m.Value, values...); err != nil {
+		return Sample{}, err
+	}
+	return Sample{Desc: desc, ValueType: m.ValueType(), Value: m.Value, LabelValues: values}, nil
+}
+
+// Reading is the state of a device collected at once
+type Reading interface {
+	// Samples returns the samples of the reading
+	Samples() []Sample
+	// CollectedAt returns when the device was collected
+	CollectedAt() time.Time
+}
+
+// Collector is a prometheus.Collector exposing the latest reading of every
+// device. Devices are collected in the background and their readings
+// replaced as a whole, so scrapes never wait for devices. Readings are kept
+// in an immutable snapshot, which scrapes read without locking.
+type Collector[R Reading] struct {
+	// Skip leaves out the samples of a metric, e.g. of a disabled group
+	Skip func(desc *prometheus.Desc) bool
+	// Timestamps exposes samples with the time their reading was collected
+	Timestamps bool
+
+	mutex    sync.Mutex // Serializes updates of the snapshot
+	readings atomic.Pointer[map[string]R]
+}
+
+// New creates a collector without readings
+func New[R Reading]() *Collector[R] {
+	c := &Collector[R]{}
+	c.readings.Store(&map[string]R{})
+	return c
+}
+
+// Readings returns the current readings by device ID. The map must not be
+// modified.
+func (c *Collector[R]) Readings() map[string]R {
+	return *c.readings.Load()
+}
+
+// Update applies fn to a copy of the readings and atomically replaces them
+// with it
+func (c *Collector[R]) Update(fn func(readings map[string]R)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	next := maps.Clone(*c.readings.Load())
+	fn(next)
+	c.readings.Store(&next)
+}
+
+// Store replaces the reading of a device
+func (c *Collector[R]) Store(deviceID string, reading R) {
+	c.Update(func(readings map[string]R) {
+		readings[deviceID] = reading
+	})
+}
+
+// Delete removes the reading of a device
+func (c *Collector[R]) Delete(deviceID string) {
+	c.Update(func(readings map[string]R) {
+		delete(readings, deviceID)
+	})
+}
+
+// Describe implements prometheus.Collector. Which metrics devices report
+// isn't known in advance, so the collector is unchecked.
+func (c *Collector[R]) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (c *Collector[R]) Collect(ch chan<- prometheus.Metric) {
+	for _, reading := range c.Readings() {
+		for _, sample := range reading.Samples() {
+			if c.Skip != nil && c.Skip(sample.Desc) {
+				continue
+			}
+			metric, err := prometheus.NewConstMetric(sample.Desc, sample.ValueType, sample.Value, sample.LabelValues...)
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(sample.Desc, err)
+				continue
+			}
+			if c.Timestamps {
+				// Readings may be up to an interval old when scraped
+				metric = prometheus.NewMetricWithTimestamp(reading.CollectedAt(), metric)
+			}
+			ch <- metric
+		}
+	}
+}
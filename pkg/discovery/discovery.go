@@ -0,0 +1,118 @@
+// Package discovery finds Shelly devices on a network by probing the /shelly
+// endpoint of every address in a range.
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+// Hosts returns the host addresses of a network in CIDR notation, e.g.
+// 192.168.1.0/24, without its network and broadcast addresses
+func Hosts(cidr string) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for ip := ipNet.IP.Mask(ipNet.Mask); ipNet.Contains(ip); inc(ip) {
+		ips = append(ips, ip.String())
+	}
+	if len(ips) > 2 {
+		return ips[1 : len(ips)-1], nil
+	}
+	return ips, nil
+}
+
+// inc increments an IP address
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// Device is a Shelly device found by a scan
+type Device struct {
+	Addr string
+	Info *shelly.Info
+}
+
+// Options limits the load a scan puts on a network
+type Options struct {
+	Concurrency int     // Probes at a time, unlimited when zero
+	Rate        float64 // Probes started per second, unlimited when zero
+}
+
+// Probe returns a probe identifying Shelly devices through the /shelly
+// endpoint with client. Addresses that don't answer or aren't Shelly devices
+// are skipped.
+func Probe(client *shelly.Client) func(ctx context.Context, addr string) (Device, bool) {
+	return func(ctx context.Context, addr string) (Device, bool) {
+		info, err := client.Info(ctx, addr)
+		if err != nil {
+			return Device{}, false
+		}
+		return Device{Addr: addr, Info: info}, true
+	}
+}
+
+// Scan probes the addresses within the limits of opts and returns what the
+// probes found, in no particular order. A cancelled scan returns what was
+// found until then.
+func Scan[D any](ctx context.Context, addrs []string, opts Options, probe func(ctx context.Context, addr string) (D, bool)) []D {
+	var throttle <-chan time.Time
+	if opts.Rate > 0 {
+		// Rates above a probe per nanosecond are as good as unlimited
+		interval := max(time.Duration(float64(time.Second)/opts.Rate), time.Nanosecond)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	var semaphore chan struct{}
+	if opts.Concurrency > 0 {
+		semaphore = make(chan struct{}, opts.Concurrency)
+	}
+
+	var (
+		mutex sync.Mutex
+		found []D
+		wg    sync.WaitGroup
+	)
+	for i, addr := range addrs {
+		if throttle != nil && i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-throttle:
+			}
+		}
+		if semaphore != nil {
+			select {
+			case <-ctx.Done():
+			case semaphore <- struct{}{}:
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Go(func() {
+			if semaphore != nil {
+				defer func() { <-semaphore }()
+			}
+			if d, ok := probe(ctx, addr); ok {
+				mutex.Lock()
+				found = append(found, d)
+				mutex.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return found
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yggdrion/shelly-exporter/pkg/shelly"
+)
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		hosts []string
+	}{
+		{"192.168.1.0/30", []string{"192.168.1.1", "192.168.1.2"}},
+		{"10.0.0.254/31", []string{"10.0.0.254", "10.0.0.255"}},
+		{"10.0.0.7/32", []string{"10.0.0.7"}},
+		{"10.0.0.255/29", []string{"10.0.0.249", "10.0.0.250", "10.0.0.251", "10.0.0.252", "10.0.0.253", "10.0.0.254"}},
+	}
+	for _, tt := range tests {
+		hosts, err := Hosts(tt.cidr)
+		if err != nil {
+			t.Errorf("Hosts(%q) failed: %v", tt.cidr, err)
+			continue
+		}
+		if !slices.Equal(hosts, tt.hosts) {
+			t.Errorf("Hosts(%q) = %v, want %v", tt.cidr, hosts, tt.hosts)
+		}
+	}
+
+	if _, err := Hosts("192.168.1.0"); err == nil {
+		t.Error("Hosts accepted an address without prefix length")
+	}
+}
+
+func TestScan(t *testing.T) {
+	addrs := []string{"a", "b", "c", "d", "e", "f"}
+	var running, peak atomic.Int32
+	probe := func(ctx context.Context, addr string) (string, bool) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return strings.ToUpper(addr), addr != "c"
+	}
+
+	found := Scan(context.Background(), addrs, Options{Concurrency: 2}, probe)
+	slices.Sort(found)
+	if want := []string{"A", "B", "D", "E", "F"}; !slices.Equal(found, want) {
+		t.Errorf("got %v, want %v", found, want)
+	}
+	if peak.Load() > 2 {
+		t.Errorf("got %d probes at a time, want at most 2", peak.Load())
+	}
+}
+
+func TestScanRate(t *testing.T) {
+	start := time.Now()
+	found := Scan(context.Background(), []string{"a", "b", "c"}, Options{Rate: 50}, func(ctx context.Context, addr string) (string, bool) {
+		return addr, true
+	})
+	if len(found) != 3 {
+		t.Errorf("got %v, want 3 results", found)
+	}
+	// The first probe starts at once, the others 20ms apart
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("scan took %v, want at least 40ms", elapsed)
+	}
+}
+
+func TestScanHighRate(t *testing.T) {
+	// The interval between probes rounds down to zero
+	found := Scan(context.Background(), []string{"a", "b"}, Options{Rate: 1e10}, func(ctx context.Context, addr string) (string, bool) {
+		return addr, true
+	})
+	if len(found) != 2 {
+		t.Errorf("got %v, want 2 results", found)
+	}
+}
+
+func TestScanCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var probed atomic.Int32
+	found := Scan(ctx, []string{"a", "b"}, Options{}, func(ctx context.Context, addr string) (string, bool) {
+		probed.Add(1)
+		return addr, true
+	})
+	if len(found) != 0 || probed.Load() != 0 {
+		t.Errorf("cancelled scan probed %d addresses and found %v", probed.Load(), found)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	shellyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id": "shellyplus1-aabbccddeeff", "model": "SNSW-001X16EU", "gen": 2}`))
+	}))
+	defer shellyServer.Close()
+	otherServer := httptest.NewServer(http.NotFoundHandler())
+	defer otherServer.Close()
+
+	addrs := []string{strings.TrimPrefix(shellyServer.URL, "http://"), strings.TrimPrefix(otherServer.URL, "http://")}
+	found := Scan(context.Background(), addrs, Options{Concurrency: 2}, Probe(shelly.NewClient(nil)))
+	if len(found) != 1 || found[0].Addr != addrs[0] || found[0].Info.DeviceID() != "shellyplus1-aabbccddeeff" {
+		t.Errorf("got %+v, want the Shelly device at %s", found, addrs[0])
+	}
+}
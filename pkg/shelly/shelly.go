@@ -0,0 +1,188 @@
+// Package shelly is a client for the local HTTP API of Shelly devices: the
+// REST endpoints of Gen1 devices and the RPC API of Gen2 and later devices,
+// which are reached through HTTP GET requests as well.
+package shelly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Info is the response of the /shelly endpoint, which every generation
+// serves without authentication
+type Info struct {
+	Type        string `json:"type"`
+	Mac         string `json:"mac"`
+	AuthEnabled bool   `json:"auth"`
+	FwVersion   string `json:"fw"`
+	NumOutputs  int    `json:"num_outputs"`
+	NumMeters   int    `json:"num_meters"`
+
+	// Gen2+ devices identify themselves with these fields instead
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Gen    int    `json:"gen"`
+	Ver    string `json:"ver"`
+	App    string `json:"app"`
+	AuthEn bool   `json:"auth_en"`
+}
+
+// Generation returns the device generation; Gen1 devices don't report it
+func (i *Info) Generation() int {
+	if i.Gen >= 2 {
+		return i.Gen
+	}
+	return 1
+}
+
+// DeviceID returns the ID of the device, e.g. shellyplus1pm-a8032ab12345.
+// Gen1 devices don't report it, their ID is made up of the type and the end
+// of the MAC address.
+func (i *Info) DeviceID() string {
+	if i.Gen >= 2 || len(i.Mac) < 6 {
+		return i.ID
+	}
+	return fmt.Sprintf("shelly%s-%s", strings.ToLower(i.Type), strings.ToLower(i.Mac[len(i.Mac)-6:]))
+}
+
+// ErrNotShelly is returned by Client.Info for hosts that aren't Shelly devices
+var ErrNotShelly = errors.New("not a Shelly device")
+
+// StatusError is returned for requests a device answered with another HTTP
+// status than 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected response: " + e.Status
+}
+
+// DecodeError is returned for responses that can't be decoded. It holds the
+// response body, so callers can fall back to a more tolerant decoding.
+type DecodeError struct {
+	Err  error
+	Body json.RawMessage
+}
+
+func (e *DecodeError) Error() string {
+	return "decoding response: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Doer sends HTTP requests, e.g. an *http.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Client sends requests to Shelly devices. Timeouts are applied through the
+// request contexts.
+type Client struct {
+	doer Doer
+}
+
+// NewClient creates a client sending its requests through doer, or
+// http.DefaultClient when it's nil
+func NewClient(doer Doer) *Client {
+	if doer == nil {
+		doer = http.DefaultClient
+	}
+	return &Client{doer: doer}
+}
+
+// Get requests a path of a device, given by its address with an optional
+// port. The caller must close the response body.
+func (c *Client) Get(ctx context.Context, addr, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", addr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.doer.Do(req)
+}
+
+// GetJSON requests a JSON document from a device, decodes it into v and
+// returns it undecoded
+func (c *Client) GetJSON(ctx context.Context, addr, path string, v any) (json.RawMessage, error) {
+	resp, err := c.Get(ctx, addr, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return nil, &DecodeError{Err: err, Body: raw}
+	}
+	return raw, nil
+}
+
+// Info identifies the device at an address. It returns ErrNotShelly when
+// the host answers but isn't a Shelly device.
+func (c *Client) Info(ctx context.Context, addr string) (*Info, error) {
+	var info Info
+	if _, err := c.GetJSON(ctx, addr, "/shelly", &info); err != nil {
+		var statusErr *StatusError
+		var decodeErr *DecodeError
+		if errors.As(err, &statusErr) || errors.As(err, &decodeErr) {
+			return nil, ErrNotShelly
+		}
+		return nil, err
+	}
+	if info.Gen < 2 && info.Type == "" {
+		return nil, ErrNotShelly
+	}
+	return &info, nil
+}
+
+// Status requests the status of a device of the given generation, /status
+// of Gen1 and Shelly.GetStatus of Gen2+ devices, and decodes it into v
+func (c *Client) Status(ctx context.Context, addr string, generation int, v any) (json.RawMessage, error) {
+	if generation >= 2 {
+		return c.GetJSON(ctx, addr, "/rpc/Shelly.GetStatus", v)
+	}
+	return c.GetJSON(ctx, addr, "/status", v)
+}
+
+// Config requests the configuration of a Gen2+ device and decodes it into v
+func (c *Client) Config(ctx context.Context, addr string, v any) (json.RawMessage, error) {
+	return c.GetJSON(ctx, addr, "/rpc/Shelly.GetConfig", v)
+}
+
+// Settings requests the settings of a Gen1 device and decodes them into v
+func (c *Client) Settings(ctx context.Context, addr string, v any) (json.RawMessage, error) {
+	return c.GetJSON(ctx, addr, "/settings", v)
+}
+
+// SplitComponentKey splits a Gen2+ component key like "switch:1" into its
+// kind and ID
+func SplitComponentKey(key string) (kind string, id int, ok bool) {
+	kind, idStr, found := strings.Cut(key, ":")
+	if !found {
+		return key, 0, false
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return key, 0, false
+	}
+	return kind, id, true
+}
@@ -0,0 +1,139 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve starts a server answering paths with fixed responses and returns its
+// address
+func serve(t *testing.T, responses map[string]string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		deviceID   string
+		generation int
+		err        error
+	}{
+		{"gen1", `{"type": "SHPLG-S", "mac": "A4CF12DDEEFF", "auth": false, "fw": "20230913-114008/v1.14.0-gcb84623"}`, "shellyshplg-s-ddeeff", 1, nil},
+		{"gen2", `{"id": "shellyplusplugs-aabbccddeeff", "mac": "AABBCCDDEEFF", "model": "SNPL-00112EU", "gen": 2}`, "shellyplusplugs-aabbccddeeff", 2, nil},
+		{"other json", `{"name": "router"}`, "", 0, ErrNotShelly},
+		{"not json", `<html></html>`, "", 0, ErrNotShelly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serve(t, map[string]string{"/shelly": tt.body})
+			info, err := NewClient(nil).Info(context.Background(), addr)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if info.DeviceID() != tt.deviceID || info.Generation() != tt.generation {
+				t.Errorf("got device %s of generation %d, want %s of generation %d", info.DeviceID(), info.Generation(), tt.deviceID, tt.generation)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		addr := serve(t, nil)
+		if _, err := NewClient(nil).Info(context.Background(), addr); !errors.Is(err, ErrNotShelly) {
+			t.Errorf("got error %v, want %v", err, ErrNotShelly)
+		}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	addr := serve(t, map[string]string{
+		"/status":                `{"meters": [{"power": 12.5}]}`,
+		"/rpc/Shelly.GetStatus":  `{"switch:0": {"apower": 7.5}}`,
+		"/rpc/Shelly.GetConfig":  `{"power": "not a number"}`,
+		"/settings":              `{"name": "Plug"}`,
+		"/rpc/Shelly.GetDevices": `[]`,
+	})
+	client := NewClient(nil)
+	ctx := context.Background()
+
+	var gen1 struct {
+		Meters []struct {
+			Power float64 `json:"power"`
+		} `json:"meters"`
+	}
+	if _, err := client.Status(ctx, addr, 1, &gen1); err != nil || len(gen1.Meters) != 1 || gen1.Meters[0].Power != 12.5 {
+		t.Errorf("got Gen1 status %+v, %v", gen1, err)
+	}
+
+	var gen2 map[string]struct {
+		APower float64 `json:"apower"`
+	}
+	raw, err := client.Status(ctx, addr, 2, &gen2)
+	if err != nil || gen2["switch:0"].APower != 7.5 {
+		t.Errorf("got Gen2 status %+v, %v", gen2, err)
+	}
+	if string(raw) != `{"switch:0": {"apower": 7.5}}` {
+		t.Errorf("got raw status %s", raw)
+	}
+
+	var settings struct {
+		Name string `json:"name"`
+	}
+	if _, err := client.Settings(ctx, addr, &settings); err != nil || settings.Name != "Plug" {
+		t.Errorf("got settings %+v, %v", settings, err)
+	}
+
+	// Undecodable responses keep their body for lenient decoding
+	var config struct {
+		Power float64 `json:"power"`
+	}
+	_, err = client.Config(ctx, addr, &config)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || string(decodeErr.Body) != `{"power": "not a number"}` {
+		t.Errorf("got error %v, want a decode error with the body", err)
+	}
+
+	_, err = client.GetJSON(ctx, addr, "/missing", &config)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got error %v, want a 404 status error", err)
+	}
+}
+
+func TestSplitComponentKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		kind string
+		id   int
+		ok   bool
+	}{
+		{"switch:1", "switch", 1, true},
+		{"em1data:0", "em1data", 0, true},
+		{"sys", "sys", 0, false},
+		{"input:x", "input:x", 0, false},
+	}
+	for _, tt := range tests {
+		kind, id, ok := SplitComponentKey(tt.key)
+		if kind != tt.kind || id != tt.id || ok != tt.ok {
+			t.Errorf("SplitComponentKey(%q) = %q, %d, %v, want %q, %d, %v", tt.key, kind, id, ok, tt.kind, tt.id, tt.ok)
+		}
+	}
+}
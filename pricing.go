@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultTariff names the base rate, which applies when no tariff does
+const defaultTariff = "default"
+
+// weekdayNames are the abbreviations of weekdays in tariff schedules,
+// indexed by time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// PricingConfig configures the price of energy used for the cost metrics
+type PricingConfig struct {
+	// Currency labels the cost metrics, e.g. EUR
+	Currency string `yaml:"currency"`
+	// Rate is the price of a kWh in the currency when no tariff applies
+	Rate float64 `yaml:"rate"`
+	// Tariffs are time-of-use rates; the first one matching the time energy
+	// was consumed at applies
+	Tariffs []TariffConfig `yaml:"tariffs"`
+	// Timezone of the tariff schedules; the local time zone when empty
+	Timezone string `yaml:"timezone"`
+
+	location *time.Location
+}
+
+// TariffConfig is a rate applying on some days and hours, e.g. peak hours on
+// weekdays. Windows ending before they start span midnight.
+type TariffConfig struct {
+	Name string  `yaml:"name"`
+	Rate float64 `yaml:"rate"`
+	// Days the tariff applies on, e.g. [mon, tue]; every day when empty
+	Days []string `yaml:"days"`
+	// Start and End limit the tariff to a time window, e.g. "07:00" to
+	// "22:00"; the whole day when empty
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+
+	days       []time.Weekday
+	start, end time.Duration
+}
+
+// enabled reports whether energy costs are computed
+func (c PricingConfig) enabled() bool {
+	return c.Rate > 0 || len(c.Tariffs) > 0
+}
+
+// compile validates the pricing and parses the tariff schedules
+func (c *PricingConfig) compile() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid energy price %g: must not be negative", c.Rate)
+	}
+	c.location = time.Local
+	if c.Timezone != "" {
+		location, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid pricing timezone '%s': %w", c.Timezone, err)
+		}
+		c.location = location
+	}
+
+	names := make(map[string]bool, len(c.Tariffs))
+	for i := range c.Tariffs {
+		if err := c.Tariffs[i].compile(); err != nil {
+			return err
+		}
+		name := c.Tariffs[i].Name
+		if name == defaultTariff {
+			return fmt.Errorf("invalid tariff name '%s': reserved for the base rate", defaultTariff)
+		}
+		// The costs of tariffs are exported by name and would be mixed up
+		if names[name] {
+			return fmt.Errorf("invalid tariff name '%s': used by several tariffs", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// compile validates the tariff and parses its schedule
+func (c *TariffConfig) compile() error {
+	if c.Name == "" {
+		return fmt.Errorf("invalid tariff: missing name")
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid rate %g of tariff %s: must not be negative", c.Rate, c.Name)
+	}
+	for _, day := range c.Days {
+		weekday := slices.Index(weekdayNames, strings.ToLower(day))
+		if weekday < 0 {
+			return fmt.Errorf("invalid day '%s' of tariff %s: must be one of %s", day, c.Name, strings.Join(weekdayNames, ", "))
+		}
+		c.days = append(c.days, time.Weekday(weekday))
+	}
+
+	if (c.Start == "") != (c.End == "") {
+		return fmt.Errorf("invalid window of tariff %s: start and end must both be set", c.Name)
+	}
+	if c.Start == "" {
+		return nil
+	}
+	var err error
+	if c.start, err = parseTimeOfDay(c.Start); err != nil {
+		return fmt.Errorf("invalid start of tariff %s: %w", c.Name, err)
+	}
+	if c.end, err = parseTimeOfDay(c.End); err != nil {
+		return fmt.Errorf("invalid end of tariff %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// parseTimeOfDay parses a time of day like 07:30 as the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a time like 07:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// applies reports whether the tariff applies at t. The day of windows
+// spanning midnight is the day they start on.
+func (c *TariffConfig) applies(t time.Time) bool {
+	day := t.Weekday()
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if c.start != c.end {
+		if c.start < c.end {
+			if since < c.start || since >= c.end {
+				return false
+			}
+		} else if since < c.start {
+			if since >= c.end {
+				return false
+			}
+			day = (day + 6) % 7
+		}
+	}
+	return len(c.days) == 0 || slices.Contains(c.days, day)
+}
+
+// tariff returns the name and rate of the tariff applying at t
+func (c *PricingConfig) tariff(t time.Time) (string, float64) {
+	t = t.In(c.location)
+	for i := range c.Tariffs {
+		if tariff := &c.Tariffs[i]; tariff.applies(t) {
+			return tariff.Name, tariff.Rate
+		}
+	}
+	return defaultTariff, c.Rate
+}
+
+// costSamples accumulates the cost of the energy a device consumed since its
+// previous reading at the tariff applying now, and returns the cost metrics
+// of every tariff. Costs are kept by the counter store, so they're persisted
+// with the state file and a changed rate only applies to energy consumed
+// afterwards.
+func (e *ShellyExporter) costSamples(reading *deviceReading, energyWh float64) []deviceSample {
+	dev := &reading.device
+	pricing := &e.config.Pricing
+	consumed := e.counters.advance(counterKey(dev, "cost_energy"), energyWh)
+	current, rate := pricing.tariff(reading.collectedAt)
+	e.counters.add(costKey(dev, current), consumed/1000*rate)
+
+	tariffs := []string{defaultTariff}
+	for _, tariff := range pricing.Tariffs {
+		tariffs = append(tariffs, tariff.Name)
+	}
+	samples := make([]deviceSample, 0, len(tariffs))
+	for _, tariff := range tariffs {
+		samples = append(samples, deviceSample{
+			Desc: e.descs.cost, ValueType: prometheus.CounterValue, Value: e.counters.add(costKey(dev, tariff), 0),
+			LabelValues: append(reading.labelValues(), pricing.Currency, tariff),
+		})
+	}
+	return samples
+}
+
+// costKey identifies the cost of a device at a tariff in the counter store
+func costKey(dev *ShellyDevice, tariff string) string {
+	if tariff == defaultTariff {
+		return counterKey(dev, "cost")
+	}
+	return counterKey(dev, "cost:"+tariff)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTariffApplies(t *testing.T) {
+	tests := []struct {
+		name   string
+		tariff TariffConfig
+		day    time.Weekday
+		clock  string // Time of day like "07:00"
+		want   bool
+	}{
+		{"all day", TariffConfig{Name: "flat"}, time.Sunday, "03:00", true},
+		{"weekday", TariffConfig{Name: "week", Days: []string{"mon", "fri"}}, time.Friday, "23:59", true},
+		{"other day", TariffConfig{Name: "week", Days: []string{"mon", "fri"}}, time.Saturday, "00:00", false},
+		{"window start", TariffConfig{Name: "peak", Start: "07:00", End: "22:00"}, time.Tuesday, "07:00", true},
+		{"window end", TariffConfig{Name: "peak", Start: "07:00", End: "22:00"}, time.Tuesday, "22:00", false},
+		{"before window", TariffConfig{Name: "peak", Start: "07:00", End: "22:00"}, time.Tuesday, "06:59", false},
+		{"night evening", TariffConfig{Name: "night", Start: "22:00", End: "06:00"}, time.Wednesday, "23:30", true},
+		{"night morning", TariffConfig{Name: "night", Start: "22:00", End: "06:00"}, time.Thursday, "05:59", true},
+		{"night end", TariffConfig{Name: "night", Start: "22:00", End: "06:00"}, time.Thursday, "06:00", false},
+		{"night day", TariffConfig{Name: "night", Start: "22:00", End: "06:00"}, time.Thursday, "12:00", false},
+		// The morning belongs to the night starting the day before
+		{"night after start day", TariffConfig{Name: "night", Days: []string{"fri"}, Start: "22:00", End: "06:00"}, time.Saturday, "02:00", true},
+		{"night before start day", TariffConfig{Name: "night", Days: []string{"fri"}, Start: "22:00", End: "06:00"}, time.Friday, "02:00", false},
+		{"night over the week", TariffConfig{Name: "night", Days: []string{"sat"}, Start: "22:00", End: "06:00"}, time.Sunday, "01:00", true},
+		{"night from sunday", TariffConfig{Name: "night", Days: []string{"sun"}, Start: "22:00", End: "06:00"}, time.Monday, "01:00", true},
+		{"same start and end", TariffConfig{Name: "day", Days: []string{"sun"}, Start: "06:00", End: "06:00"}, time.Sunday, "05:00", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tariff.compile(); err != nil {
+				t.Fatal(err)
+			}
+			clock, err := parseTimeOfDay(tt.clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 2024-01-07 is a Sunday
+			at := time.Date(2024, 1, 7+int(tt.day), 0, 0, 0, 0, time.UTC).Add(clock)
+			if got := tt.tariff.applies(at); got != tt.want {
+				t.Errorf("applies(%s) = %v, want %v", at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPricingCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		tariffs []TariffConfig
+		valid   bool
+	}{
+		{"distinct", []TariffConfig{{Name: "peak", Start: "07:00", End: "22:00"}, {Name: "night"}}, true},
+		{"duplicate", []TariffConfig{{Name: "peak", Days: []string{"mon"}}, {Name: "peak", Days: []string{"tue"}}}, false},
+		{"reserved", []TariffConfig{{Name: defaultTariff}}, false},
+		{"half window", []TariffConfig{{Name: "peak", Start: "07:00"}}, false},
+		{"invalid day", []TariffConfig{{Name: "peak", Days: []string{"monday"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := PricingConfig{Rate: 0.3, Tariffs: tt.tariffs}
+			if err := c.compile(); (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
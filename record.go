@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fixture holds the recorded responses of a device, keyed by request path
+type fixture struct {
+	Model      string                     `json:"model"`
+	Generation int                        `json:"gen"`
+	RecordedAt time.Time                  `json:"recorded_at"`
+	Responses  map[string]json.RawMessage `json:"responses"`
+}
+
+// Paths recorded from Gen1 and Gen2+ devices
+var (
+	gen1FixturePaths = []string{"/shelly", "/settings", "/status"}
+	gen2FixturePaths = []string{"/shelly", "/rpc/Shelly.GetStatus", "/rpc/Shelly.GetConfig"}
+)
+
+// Placeholders replacing identifying values in fixtures
+const (
+	fixtureMAC  = "AABBCCDDEEFF"
+	fixtureIP   = "192.0.2.10"
+	fixtureName = "Redacted"
+)
+
+// fixtureIPKeys are keys whose values are IP addresses
+var fixtureIPKeys = map[string]bool{
+	"ip": true, "sta_ip": true, "gw": true, "netmask": true, "mask": true, "nameserver": true, "ipv4": true,
+}
+
+// fixtureSecretKeys are keys whose values are removed altogether
+var fixtureSecretKeys = map[string]bool{
+	"ssid": true, "bssid": true, "pass": true, "key": true, "auth_key": true, "server": true,
+	"user": true, "lat": true, "lng": true, "hostname": true,
+}
+
+// runRecorder implements the record subcommand: it captures the responses of
+// the devices at the given addresses into sanitized fixtures
+func runRecorder(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ContinueOnError)
+	out := flags.String("out", "fixtures", "Directory the fixtures are written to")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of each request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: shelly-exporter record [flags] address...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no device addresses given")
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	for _, addr := range flags.Args() {
+		f, err := recordFixture(context.Background(), client, addr)
+		if err != nil {
+			return fmt.Errorf("recording %s: %w", addr, err)
+		}
+		data, err := json.MarshalIndent(f, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := fixturePath(*out, f)
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Recorded %s to %s\n", addr, path)
+	}
+	return nil
+}
+
+// fixturePath returns an unused file name for a fixture, named after the
+// device model and generation
+func fixturePath(dir string, f *fixture) string {
+	base := fmt.Sprintf("%s-gen%d", strings.ToLower(f.Model), f.Generation)
+	path := filepath.Join(dir, base+".json")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.json", base, i))
+	}
+}
+
+// recordFixture fetches the status documents of a device and sanitizes them
+func recordFixture(ctx context.Context, client *http.Client, addr string) (*fixture, error) {
+	raw, err := fetchRaw(ctx, client, addr, "/shelly")
+	if err != nil {
+		return nil, err
+	}
+	var info ShellyInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, fmt.Errorf("decoding /shelly: %w", err)
+	}
+
+	f := &fixture{Model: info.Model, Generation: info.Gen, RecordedAt: time.Now().UTC(), Responses: map[string]json.RawMessage{}}
+	paths := gen2FixturePaths
+	if info.Gen < 2 {
+		f.Model, f.Generation, paths = info.Type, 1, gen1FixturePaths
+	}
+	for _, path := range paths {
+		if path != "/shelly" {
+			if raw, err = fetchRaw(ctx, client, addr, path); err != nil {
+				return nil, err
+			}
+		}
+		if f.Responses[path], err = sanitizeFixture(raw, info.Mac); err != nil {
+			return nil, fmt.Errorf("sanitizing %s: %w", path, err)
+		}
+	}
+	return f, nil
+}
+
+// fetchRaw returns the body of a successful GET request to a device
+func fetchRaw(ctx context.Context, client *http.Client, addr, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response for %s: %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// sanitizeFixture replaces the device's MAC address, IP addresses, names and
+// credentials in a response so it can be shared. Numbers are kept as
+// recorded, e.g. energy counters beyond float precision or integers written
+// with a fraction.
+func sanitizeFixture(raw []byte, mac string) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = sanitizeValue("", v, macPattern(mac))
+	return json.Marshal(v)
+}
+
+// macPattern matches a MAC address with or without separators in any case
+func macPattern(mac string) *regexp.Regexp {
+	mac = strings.NewReplacer(":", "", "-", "").Replace(mac)
+	if len(mac) != 12 {
+		return nil
+	}
+	var parts []string
+	for i := 0; i < 12; i += 2 {
+		parts = append(parts, regexp.QuoteMeta(mac[i:i+2]))
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(parts, "[:-]?"))
+}
+
+// sanitizeValue recursively sanitizes a decoded JSON value found under key
+func sanitizeValue(key string, v any, mac *regexp.Regexp) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = sanitizeValue(k, child, mac)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = sanitizeValue(key, child, mac)
+		}
+		return v
+	case string:
+		switch {
+		case fixtureSecretKeys[key]:
+			return ""
+		case fixtureIPKeys[key] && v != "":
+			return fixtureIP
+		case key == "name" && v != "":
+			return fixtureName
+		case mac != nil:
+			return mac.ReplaceAllStringFunc(v, func(s string) string {
+				if strings.ToLower(s) == s {
+					return strings.ToLower(fixtureMAC)
+				}
+				return fixtureMAC
+			})
+		}
+	case json.Number:
+		if fixtureSecretKeys[key] {
+			return json.Number("0")
+		}
+	}
+	return v
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fixtureDir holds the fixtures recorded with the record subcommand
+const fixtureDir = "testdata/fixtures"
+
+// newTestExporter creates an exporter with the default configuration that
+// logs nothing
+func newTestExporter(t *testing.T) *ShellyExporter {
+	t.Helper()
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := newLogging(cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewShellyExporter(cfg, logs)
+}
+
+// replayFixture serves a fixture like the simulator does and collects it
+// through the exporter like a real device: it's probed, its status decoded
+// and its reading built by the Gen1 or Gen2 reading builder.
+func replayFixture(t *testing.T, e *ShellyExporter, f *fixture) *deviceReading {
+	t.Helper()
+	server := httptest.NewServer(fixtureHandler(f))
+	defer server.Close()
+
+	ctx := context.Background()
+	dev := e.discoverShellyDevice(ctx, strings.TrimPrefix(server.URL, "http://"))
+	if dev == nil {
+		t.Fatal("fixture not recognized as a Shelly device")
+	}
+	if !e.collectShellyMetrics(ctx, dev) {
+		t.Fatal("collecting the fixture failed")
+	}
+	reading := e.readings.Readings()[dev.DeviceID]
+	if reading == nil {
+		t.Fatal("no reading stored for the fixture")
+	}
+	return reading
+}
+
+// counterValue returns the current value of a counter
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestReplayFixtures(t *testing.T) {
+	tests := []struct {
+		file       string
+		deviceID   string
+		generation int
+		power      float64
+		energyWh   float64
+		warnings   float64
+	}{
+		{"shplg-s-gen1.json", "shellyshplg-s-ddeeff", 1, 42.1, 151978.2525744418 / 60, 0},
+		{"shplg-s-gen1-addons.json", "shellyshplg-s-ddeeff", 1, 59.65, 123456.0 / 60, 0},
+		{"shplg-1-gen1-community.json", "shellyshplg-1-ddeeff", 1, 12.5, 10, 3},
+		{"snpl-00112eu-gen2.json", "shellyplusplugs-aabbccddeeff", 2, 57.75518970158349, 891.3858369032538, 0},
+		{"s3pl-00112eu-gen3.json", "shellyplugsg3-aabbccddeeff", 3, 1002.3, 6234.5, 0},
+	}
+	// Every recorded fixture must be replayed
+	paths, err := filepath.Glob(filepath.Join(fixtureDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(tests) {
+		t.Errorf("got %d fixtures in %s, the table covers %d", len(paths), fixtureDir, len(tests))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := loadFixture(filepath.Join(fixtureDir, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := newTestExporter(t)
+			reading := replayFixture(t, e, f)
+			if reading.device.DeviceID != tt.deviceID || reading.device.Generation != tt.generation {
+				t.Errorf("got device %s of generation %d, want %s of generation %d", reading.device.DeviceID, reading.device.Generation, tt.deviceID, tt.generation)
+			}
+			if len(reading.samples) == 0 {
+				t.Error("reading has no samples")
+			}
+			if reading.power == nil || math.Abs(*reading.power-tt.power) > 1e-9 {
+				t.Errorf("got power %v, want %v", fmtValue(reading.power), tt.power)
+			}
+			if reading.energyWh == nil || math.Abs(*reading.energyWh-tt.energyWh) > 1e-9 {
+				t.Errorf("got energy %v, want %v", fmtValue(reading.energyWh), tt.energyWh)
+			}
+			var warnings float64
+			for _, reason := range []string{parseWarningNumericString, parseWarningDroppedField} {
+				warnings += counterValue(t, e.parseWarnings.WithLabelValues(tt.deviceID, reason))
+			}
+			if warnings != tt.warnings {
+				t.Errorf("got %v parse warnings, want %v", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestSanitizeFixture(t *testing.T) {
+	raw := `{"mac": "5A1A00000001", "id": "shellyplus1-5a1a00000001", "name": "Kitchen",
+		"wifi": {"sta_ip": "192.168.1.50", "ssid": "home", "rssi": -60},
+		"aenergy": {"total": 12345678901234567890, "by_minute": [1.50, 0]}}`
+	sanitized, err := sanitizeFixture([]byte(raw), "5A:1A:00:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"aenergy":{"by_minute":[1.50,0],"total":12345678901234567890},"id":"shellyplus1-aabbccddeeff","mac":"AABBCCDDEEFF","name":"Redacted","wifi":{"rssi":-60,"ssid":"","sta_ip":"192.0.2.10"}}`
+	if string(sanitized) != want {
+		t.Errorf("got %s, want %s", sanitized, want)
+	}
+	var v any
+	if err := json.Unmarshal(sanitized, &v); err != nil {
+		t.Errorf("sanitized fixture isn't valid JSON: %v", err)
+	}
+}
+
+// fmtValue formats an optional value of a reading
+func fmtValue(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
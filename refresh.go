@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// refreshQueueSize bounds the devices waiting to be refreshed
+const refreshQueueSize = 64
+
+// requestRefresh queues the collection of a device ahead of its next poll,
+// e.g. after one of its relays was switched. While the queue is full the
+// request is dropped, the next poll shows the change anyway.
+func (e *ShellyExporter) requestRefresh(dev *ShellyDevice) {
+	select {
+	case e.refreshes <- dev:
+	default:
+		e.collectionLog.Debug("Refresh queue full, waiting for the next poll", "device_id", dev.DeviceID)
+	}
+}
+
+// runRefreshes collects the devices queued by requestRefresh until ctx is
+// cancelled. Refreshes are collected like polls, so they respect the
+// circuit breakers and are skipped on standby.
+func (e *ShellyExporter) runRefreshes(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dev := <-e.refreshes:
+			if e.standby.Load() || len(e.allowedDevices([]*ShellyDevice{dev})) == 0 {
+				continue
+			}
+			wg.Go(func() { e.collectDevice(ctx, dev) })
+		}
+	}
+}
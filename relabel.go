@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Relabel actions, a subset of Prometheus' metric_relabel_configs
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+)
+
+// RelabelConfig is a relabel rule applied to exposed series. It follows the
+// semantics of Prometheus' relabel_config for the supported actions.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, applying Prometheus' defaults
+// for fields that aren't set
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = RelabelConfig{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: relabelReplace}
+	type plain RelabelConfig
+	return unmarshal((*plain)(c))
+}
+
+// compile validates the rule and compiles its regex
+func (c *RelabelConfig) compile() error {
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex '%s': %w", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case relabelReplace:
+		if !labelNamePattern.MatchString(c.TargetLabel) && !strings.Contains(c.TargetLabel, "$") {
+			return fmt.Errorf("invalid relabel target label '%s'", c.TargetLabel)
+		}
+	case relabelKeep, relabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action %q requires source_labels", c.Action)
+		}
+	case relabelLabelMap, relabelLabelDrop, relabelLabelKeep:
+	default:
+		return fmt.Errorf("invalid relabel action '%s'", c.Action)
+	}
+	return nil
+}
+
+// apply applies the rule to a series' labels and reports whether the series is kept
+func (c *RelabelConfig) apply(labels map[string]string) bool {
+	values := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case relabelKeep:
+		return c.regex.MatchString(value)
+	case relabelDrop:
+		return !c.regex.MatchString(value)
+	case relabelReplace:
+		match := c.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, match))
+		if !labelNamePattern.MatchString(target) {
+			return true
+		}
+		labels[target] = string(c.regex.ExpandString(nil, c.Replacement, value, match))
+	case relabelLabelMap:
+		// Mapped labels are only added after the loop, so they aren't mapped
+		// again, like in Prometheus
+		mapped := make(map[string]string)
+		for name, v := range labels {
+			if c.regex.MatchString(name) {
+				mapped[c.regex.ReplaceAllString(name, c.Replacement)] = v
+			}
+		}
+		maps.Copy(labels, mapped)
+	case relabelLabelDrop:
+		for name := range labels {
+			if name != "__name__" && c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case relabelLabelKeep:
+		for name := range labels {
+			if name != "__name__" && !c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// relabel applies the rules to the series of a metric family and returns the
+// series that are kept. The metric name is available as __name__ but can't
+// be changed.
+func relabel(mf *dto.MetricFamily, rules []RelabelConfig) []*dto.Metric {
+	kept := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		labels := make(map[string]string, len(m.Label)+1)
+		for _, label := range m.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		labels["__name__"] = mf.GetName()
+
+		keep := true
+		for i := range rules {
+			if keep = rules[i].apply(labels); !keep {
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+
+		delete(labels, "__name__")
+		m.Label = m.Label[:0]
+		for name, value := range labels {
+			// Empty labels are equivalent to missing ones
+			if value != "" {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+		}
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		kept = append(kept, m)
+	}
+	return kept
+}
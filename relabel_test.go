@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.yaml.in/yaml/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  []string // Labels of the kept series
+	}{
+		{
+			"replace",
+			`[{source_labels: [device_name], regex: "(.*) plug", target_label: room}]`,
+			[]string{"device_id=a,device_name=kitchen plug,room=kitchen", "device_id=b,device_name=garage"},
+		},
+		{
+			"replace expanding the target",
+			`[{source_labels: [device_id], target_label: "id_$1", replacement: "yes"}]`,
+			[]string{"device_id=a,device_name=kitchen plug,id_a=yes", "device_id=b,device_name=garage,id_b=yes"},
+		},
+		{
+			"keep joined labels",
+			`[{source_labels: [__name__, device_id], separator: "/", regex: "shelly_power_watts/a", action: keep}]`,
+			[]string{"device_id=a,device_name=kitchen plug"},
+		},
+		{
+			"drop",
+			`[{source_labels: [device_name], regex: ".*plug", action: drop}]`,
+			[]string{"device_id=b,device_name=garage"},
+		},
+		{
+			"labelmap",
+			`[{regex: "device_(.*)", action: labelmap}]`,
+			[]string{"device_id=a,device_name=kitchen plug,id=a,name=kitchen plug", "device_id=b,device_name=garage,id=b,name=garage"},
+		},
+		{
+			"labeldrop",
+			`[{regex: "device_name", action: labeldrop}]`,
+			[]string{"device_id=a", "device_id=b"},
+		},
+		{
+			"labelkeep",
+			`[{regex: "device_name", action: labelkeep}]`,
+			[]string{"device_name=kitchen plug", "device_name=garage"},
+		},
+		{
+			"empty replacement removes the label",
+			`[{target_label: device_name, replacement: ""}]`,
+			[]string{"device_id=a", "device_id=b"},
+		},
+		{
+			"rules apply in order",
+			`[{source_labels: [device_id], target_label: tier, replacement: gold}, {source_labels: [tier], regex: gold, action: drop}]`,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []RelabelConfig
+			if err := yaml.Unmarshal([]byte(tt.rules), &rules); err != nil {
+				t.Fatal(err)
+			}
+			for i := range rules {
+				if err := rules[i].compile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mf := &dto.MetricFamily{Name: proto.String("shelly_power_watts"), Metric: []*dto.Metric{
+				{Label: labelPairs("device_id", "a", "device_name", "kitchen plug")},
+				{Label: labelPairs("device_id", "b", "device_name", "garage")},
+			}}
+			var got []string
+			for _, m := range relabel(mf, rules) {
+				var labels []string
+				for _, label := range m.Label {
+					labels = append(labels, label.GetName()+"="+label.GetValue())
+				}
+				got = append(got, strings.Join(labels, ","))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got series %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelabelCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		valid bool
+	}{
+		{"defaults", `{target_label: room}`, true},
+		{"invalid regex", `{target_label: room, regex: "("}`, false},
+		{"invalid target", `{target_label: "1room"}`, false},
+		{"keep without sources", `{action: keep}`, false},
+		{"unknown action", `{action: hashmod}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule RelabelConfig
+			if err := yaml.Unmarshal([]byte(tt.rule), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if err := rule.compile(); (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// labelPairs returns the label pairs of alternating names and values
+func labelPairs(namesAndValues ...string) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for i := 0; i < len(namesAndValues); i += 2 {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(namesAndValues[i]), Value: proto.String(namesAndValues[i+1])})
+	}
+	return pairs
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// relayDescs holds the descriptors of relay channel metrics shared by Gen1
+// relays and Gen2+ switch components
+type relayDescs struct {
+	timerActive    *prometheus.Desc
+	timerRemaining *prometheus.Desc
+	onSeconds      *prometheus.Desc
+}
+
+// newRelayDescs creates the descriptors of relay channel metrics
+func newRelayDescs() relayDescs {
+	return relayDescs{
+		timerActive: prometheus.NewDesc(
+			"shelly_relay_timer_active",
+			"Whether an auto-on or auto-off timer is running on a relay channel (1) or not (0)",
+			channelLabelNames, nil,
+		),
+		timerRemaining: prometheus.NewDesc(
+			"shelly_relay_timer_remaining_seconds",
+			"Time until the running timer of a relay channel flips its output in seconds",
+			channelLabelNames, nil,
+		),
+		onSeconds: prometheus.NewDesc(
+			"shelly_relay_on_seconds_total",
+			"Time a relay channel was observed on in seconds, since the exporter started unless persisted with STATE_FILE",
+			channelLabelNames, nil,
+		),
+	}
+}
+
+// all returns all relay channel metric descriptors
+func (d relayDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.timerActive,
+		d.timerRemaining,
+		d.onSeconds,
+	}
+}
+
+// relayOnState is the last observed state of a relay channel
+type relayOnState struct {
+	on    bool
+	since time.Time
+}
+
+// relayOnSeconds records the observed state of a relay channel and returns
+// the accumulated on time. The time since the previous observation counts
+// as on when the relay was on then; observations are forgotten when a
+// collection fails, so time the device was unreachable doesn't count. The
+// total is kept by the counter store, so it's persisted with the state file.
+func (e *ShellyExporter) relayOnSeconds(key string, on bool) float64 {
+	e.relayOnMutex.Lock()
+	defer e.relayOnMutex.Unlock()
+
+	now := time.Now()
+	state, ok := e.relayOn[key]
+	if !ok {
+		state = &relayOnState{}
+		e.relayOn[key] = state
+	}
+	var delta float64
+	if ok && state.on {
+		delta = now.Sub(state.since).Seconds()
+	}
+	state.on = on
+	state.since = now
+	return e.counters.add(key, delta)
+}
+
+// forgetRelayOn forgets the observed relay states of a device, or of all
+// devices when deviceID is empty, so the next observation starts a new
+// interval instead of counting the time since the last one
+func (e *ShellyExporter) forgetRelayOn(deviceID string) {
+	e.relayOnMutex.Lock()
+	defer e.relayOnMutex.Unlock()
+	for key := range e.relayOn {
+		if deviceID == "" || strings.HasPrefix(key, deviceID+"/") {
+			delete(e.relayOn, key)
+		}
+	}
+}
+
+// gen1RelaySamples returns the timer state and on time of the relays in the
+// status of a Gen1 device
+func (e *ShellyExporter) gen1RelaySamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	var samples []deviceSample
+	for i, relay := range status.Relays {
+		active := relay.HasTimer
+		var remaining float64
+		if active {
+			remaining = float64(relay.TimerRemaining)
+		}
+		onSeconds := e.relayOnSeconds(counterKey(&reading.device, fmt.Sprintf("relay:%d", i)), relay.IsOn)
+		samples = appendValues(samples, append(reading.labelValues(), strconv.Itoa(i), ""),
+			optionalValue{e.descs.relays.timerActive, prometheus.GaugeValue, boolValue(&active)},
+			optionalValue{e.descs.relays.timerRemaining, prometheus.GaugeValue, &remaining},
+			optionalValue{e.descs.relays.onSeconds, prometheus.CounterValue, &onSeconds},
+		)
+	}
+	return samples
+}
+
+// gen2TimerSamples returns the timer state of a Gen2+ switch component. The
+// device only reports when the timer started and its duration, so the
+// remaining time is relative to the exporter's clock.
+func (e *ShellyExporter) gen2TimerSamples(labelValues []string, sw gen2Switch) []deviceSample {
+	active := sw.TimerStartedAt != nil && sw.TimerDuration != nil
+	var remaining float64
+	if active {
+		end := *sw.TimerStartedAt + *sw.TimerDuration
+		remaining = max(end-float64(time.Now().UnixNano())/1e9, 0)
+	}
+	return appendValues(nil, labelValues,
+		optionalValue{e.descs.relays.timerActive, prometheus.GaugeValue, boolValue(&active)},
+		optionalValue{e.descs.relays.timerRemaining, prometheus.GaugeValue, &remaining},
+	)
+}
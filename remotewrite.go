@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the remote write 1.0 protobuf messages
+const (
+	fieldTimeseries      = 1 // WriteRequest.timeseries
+	fieldLabels          = 1 // TimeSeries.labels
+	fieldSamples         = 2 // TimeSeries.samples
+	fieldLabelName       = 1 // Label.name
+	fieldLabelValue      = 2 // Label.value
+	fieldSampleValue     = 1 // Sample.value
+	fieldSampleTimestamp = 2 // Sample.timestamp
+)
+
+// remoteWriteSeries is a series of a remote write request
+type remoteWriteSeries struct {
+	labels  [][2]string
+	samples []*dto.Metric
+	value   func(*dto.Metric) float64
+}
+
+// encodeWriteRequest encodes gauge, counter and untyped metric families as
+// a snappy-compressed remote write 1.0 request. Samples of the same series
+// are grouped into one time series in the order they are given.
+func encodeWriteRequest(families []*dto.MetricFamily) io.Reader {
+	var series []*remoteWriteSeries
+	bySignature := make(map[string]*remoteWriteSeries)
+	for _, mf := range families {
+		var value func(*dto.Metric) float64
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			value = func(m *dto.Metric) float64 { return m.GetGauge().GetValue() }
+		case dto.MetricType_COUNTER:
+			value = func(m *dto.Metric) float64 { return m.GetCounter().GetValue() }
+		case dto.MetricType_UNTYPED:
+			value = func(m *dto.Metric) float64 { return m.GetUntyped().GetValue() }
+		default:
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := [][2]string{{"__name__", mf.GetName()}}
+			for _, label := range m.GetLabel() {
+				if label.GetValue() != "" {
+					labels = append(labels, [2]string{label.GetName(), label.GetValue()})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+			var signature strings.Builder
+			for _, label := range labels {
+				signature.WriteString(label[0] + "\xff" + label[1] + "\xff")
+			}
+			s, ok := bySignature[signature.String()]
+			if !ok {
+				s = &remoteWriteSeries{labels: labels, value: value}
+				bySignature[signature.String()] = s
+				series = append(series, s)
+			}
+			s.samples = append(s.samples, m)
+		}
+	}
+
+	var request []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var pair []byte
+			pair = protowire.AppendTag(pair, fieldLabelName, protowire.BytesType)
+			pair = protowire.AppendString(pair, label[0])
+			pair = protowire.AppendTag(pair, fieldLabelValue, protowire.BytesType)
+			pair = protowire.AppendString(pair, label[1])
+			ts = protowire.AppendTag(ts, fieldLabels, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, pair)
+		}
+		for _, m := range s.samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, fieldSampleValue, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.value(m)))
+			sample = protowire.AppendTag(sample, fieldSampleTimestamp, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(m.GetTimestampMs()))
+			ts = protowire.AppendTag(ts, fieldSamples, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+		request = protowire.AppendTag(request, fieldTimeseries, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return bytes.NewReader(snappy.Encode(nil, request))
+}
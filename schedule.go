@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+// dueDevices returns the devices whose polling interval elapsed since they
+// were last polled. The collection loop ticks at the shortest interval, so
+// devices are due half a tick early.
+func (e *ShellyExporter) dueDevices(devices []*ShellyDevice) []*ShellyDevice {
+	e.pollTimesMutex.Lock()
+	defer e.pollTimesMutex.Unlock()
+
+	now := time.Now()
+	tick := e.config.collectionTick()
+	due := devices[:0]
+	for _, device := range devices {
+		interval, poll := e.config.pollInterval(device)
+		if !poll {
+			continue
+		}
+		if last, ok := e.pollTimes[device.DeviceID]; !ok || now.Sub(last) >= interval-tick/2 {
+			due = append(due, device)
+		}
+	}
+	return due
+}
+
+// markPolled records the devices as polled now. Only devices actually polled
+// are recorded, so devices held back by their circuit breaker are due as soon
+// as it lets them through.
+func (e *ShellyExporter) markPolled(devices []*ShellyDevice) {
+	e.pollTimesMutex.Lock()
+	defer e.pollTimesMutex.Unlock()
+
+	now := time.Now()
+	for _, device := range devices {
+		e.pollTimes[device.DeviceID] = now
+	}
+}
+
+// collectionDelays returns how long to wait before polling each device. With
+// spreading enabled, requests are spaced evenly in a stable device order
+// across the part of the interval that leaves room for the collect timeout.
+// A configured jitter adds a random delay with or without spreading, within
+// the same part of the interval. Otherwise all devices are polled at once.
+func (e *ShellyExporter) collectionDelays(devices []*ShellyDevice, spread bool) []time.Duration {
+	delays := make([]time.Duration, len(devices))
+	jitter := e.config.CollectionJitter
+	if !spread || (!e.config.CollectionSpread || len(devices) < 2) && jitter <= 0 {
+		return delays
+	}
+
+	window := max(e.config.collectionTick()-e.config.CollectTimeout, 0)
+	order := make([]int, len(devices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return devices[order[a]].DeviceID < devices[order[b]].DeviceID })
+
+	for slot, i := range order {
+		var delay time.Duration
+		if e.config.CollectionSpread {
+			delay = window * time.Duration(slot) / time.Duration(len(devices))
+		}
+		if jitter > 0 {
+			delay += rand.N(jitter)
+		}
+		delays[i] = min(delay, window)
+	}
+	return delays
+}
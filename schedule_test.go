@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectionDelays(t *testing.T) {
+	// With the default 10s interval and 5s collect timeout, delays stay
+	// within the first 5s
+	tests := []struct {
+		name      string
+		spread    bool // COLLECTION_SPREAD
+		jitter    time.Duration
+		spreadNow bool // Whether the collection may be spread at all
+		ids       []string
+		min, max  []time.Duration // Bounds of each device's delay
+	}{
+		{"at once", false, 0, true, []string{"a", "b"}, []time.Duration{0, 0}, []time.Duration{0, 0}},
+		{"spread", true, 0, true, []string{"d", "b", "a", "c"},
+			[]time.Duration{3750 * time.Millisecond, 1250 * time.Millisecond, 0, 2500 * time.Millisecond},
+			[]time.Duration{3750 * time.Millisecond, 1250 * time.Millisecond, 0, 2500 * time.Millisecond}},
+		{"spread single device", true, 0, true, []string{"a"}, []time.Duration{0}, []time.Duration{0}},
+		{"not spreadable", true, time.Second, false, []string{"a", "b"}, []time.Duration{0, 0}, []time.Duration{0, 0}},
+		{"jitter", false, 2 * time.Second, true, []string{"a", "b"}, []time.Duration{0, 0}, []time.Duration{2 * time.Second, 2 * time.Second}},
+		{"jitter beyond the window", false, time.Minute, true, []string{"a"}, []time.Duration{0}, []time.Duration{5 * time.Second}},
+		{"spread and jitter", true, time.Second, true, []string{"a", "b"},
+			[]time.Duration{0, 2500 * time.Millisecond}, []time.Duration{time.Second, 3500 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t)
+			e.config.CollectionSpread = tt.spread
+			e.config.CollectionJitter = tt.jitter
+			devices := make([]*ShellyDevice, len(tt.ids))
+			for i, id := range tt.ids {
+				devices[i] = &ShellyDevice{DeviceID: id}
+			}
+
+			// Jitter is random, its bounds must hold every time
+			for range 100 {
+				for i, delay := range e.collectionDelays(devices, tt.spreadNow) {
+					if delay < tt.min[i] || delay > tt.max[i] {
+						t.Fatalf("got delay %v for device %s, want between %v and %v", delay, tt.ids[i], tt.min[i], tt.max[i])
+					}
+				}
+			}
+		})
+	}
+}
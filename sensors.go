@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sensorDescs holds the descriptors of the environmental sensor and
+// thermostat components of Gen2+ devices, e.g. of the Wall Display, and of
+// the analog inputs and external sensors of Gen1 devices like the Shelly Uni
+type sensorDescs struct {
+	temperature       *prometheus.Desc
+	humidity          *prometheus.Desc
+	illuminance       *prometheus.Desc
+	thermostatEnabled *prometheus.Desc
+	thermostatTarget  *prometheus.Desc
+	thermostatCurrent *prometheus.Desc
+	thermostatOutput  *prometheus.Desc
+	adcVoltage        *prometheus.Desc
+}
+
+// newSensorDescs creates the descriptors of sensor and thermostat metrics
+func newSensorDescs() sensorDescs {
+	return sensorDescs{
+		temperature: prometheus.NewDesc(
+			"shelly_temperature_celsius",
+			"Temperature measured by a sensor of a Shelly device in degrees Celsius",
+			channelLabelNames, nil,
+		),
+		humidity: prometheus.NewDesc(
+			"shelly_humidity_percent",
+			"Relative humidity measured by a sensor of a Shelly device in percent",
+			channelLabelNames, nil,
+		),
+		illuminance: prometheus.NewDesc(
+			"shelly_illuminance_lux",
+			"Illuminance measured by a sensor of a Shelly device in lux",
+			channelLabelNames, nil,
+		),
+		thermostatEnabled: prometheus.NewDesc(
+			"shelly_thermostat_enabled",
+			"Whether a thermostat is enabled (1) or not (0)",
+			channelLabelNames, nil,
+		),
+		thermostatTarget: prometheus.NewDesc(
+			"shelly_thermostat_target_celsius",
+			"Target temperature of a thermostat in degrees Celsius",
+			channelLabelNames, nil,
+		),
+		thermostatCurrent: prometheus.NewDesc(
+			"shelly_thermostat_current_celsius",
+			"Temperature a thermostat currently regulates on in degrees Celsius",
+			channelLabelNames, nil,
+		),
+		thermostatOutput: prometheus.NewDesc(
+			"shelly_thermostat_output",
+			"Whether a thermostat currently calls for heating or cooling (1) or not (0)",
+			channelLabelNames, nil,
+		),
+		adcVoltage: prometheus.NewDesc(
+			"shelly_adc_voltage_volts",
+			"Voltage measured by an analog input of a Shelly device in volts",
+			channelLabelNames, nil,
+		),
+	}
+}
+
+// all returns all sensor and thermostat metric descriptors
+func (d sensorDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.temperature,
+		d.humidity,
+		d.illuminance,
+		d.thermostatEnabled,
+		d.thermostatTarget,
+		d.thermostatCurrent,
+		d.thermostatOutput,
+		d.adcVoltage,
+	}
+}
+
+// gen2Temperature is the status of a temperature:N component
+type gen2Temperature struct {
+	TC *float64 `json:"tC"`
+}
+
+// gen2Humidity is the status of a humidity:N component
+type gen2Humidity struct {
+	RH *float64 `json:"rh"`
+}
+
+// gen2Illuminance is the status of an illuminance:N component
+type gen2Illuminance struct {
+	Lux *float64 `json:"lux"`
+}
+
+// gen2Voltmeter is the status of a voltmeter:N component of the Plus Add-on
+type gen2Voltmeter struct {
+	Voltage *float64 `json:"voltage"`
+}
+
+// gen2Thermostat is the status of a thermostat:N component
+type gen2Thermostat struct {
+	Enable   *bool    `json:"enable"`
+	TargetC  *float64 `json:"target_C"`
+	CurrentC *float64 `json:"current_C"`
+	Output   *bool    `json:"output"`
+}
+
+// sensorSamples returns the samples of the sensor and thermostat components
+// of a Gen2+ device. Sensors of the Plus Add-on are components with IDs from
+// 100 and are labeled with their configured name like any other.
+func (e *ShellyExporter) sensorSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	config := e.cachedConfig(reading.device.DeviceID)
+	d := e.descs.sensors
+
+	var samples []deviceSample
+	for _, key := range status.components("temperature") {
+		var t gen2Temperature
+		if reading.component(status, key, &t) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{d.temperature, prometheus.GaugeValue, t.TC})
+		}
+	}
+	for _, key := range status.components("humidity") {
+		var h gen2Humidity
+		if reading.component(status, key, &h) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{d.humidity, prometheus.GaugeValue, h.RH})
+		}
+	}
+	for _, key := range status.components("illuminance") {
+		var i gen2Illuminance
+		if reading.component(status, key, &i) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{d.illuminance, prometheus.GaugeValue, i.Lux})
+		}
+	}
+	for _, key := range status.components("voltmeter") {
+		var v gen2Voltmeter
+		if reading.component(status, key, &v) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{d.adcVoltage, prometheus.GaugeValue, v.Voltage})
+		}
+	}
+	for _, key := range status.components("thermostat") {
+		var t gen2Thermostat
+		if reading.component(status, key, &t) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{d.thermostatEnabled, prometheus.GaugeValue, boolValue(t.Enable)},
+				optionalValue{d.thermostatTarget, prometheus.GaugeValue, t.TargetC},
+				optionalValue{d.thermostatCurrent, prometheus.GaugeValue, t.CurrentC},
+				optionalValue{d.thermostatOutput, prometheus.GaugeValue, boolValue(t.Output)},
+			)
+		}
+	}
+	return samples
+}
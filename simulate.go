@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// simulatedDevice is a fake Shelly device whose power follows a randomized
+// daily curve and whose energy counter integrates that power
+type simulatedDevice struct {
+	index      int
+	gen        int
+	mac        string
+	name       string
+	basePower  float64
+	amplitude  float64
+	phase      float64
+	started    time.Time
+	mutex      sync.Mutex
+	energyWh   float64
+	lastUpdate time.Time
+}
+
+// newSimulatedDevice creates the index-th simulated device; even devices
+// simulate a Gen1 Plug S, odd ones a Gen2 Plus Plug S
+func newSimulatedDevice(index int) *simulatedDevice {
+	gen := 1
+	if index%2 == 1 {
+		gen = 2
+	}
+	now := time.Now()
+	return &simulatedDevice{
+		index:      index,
+		gen:        gen,
+		mac:        fmt.Sprintf("5A1A00%06X", index),
+		name:       fmt.Sprintf("Simulated Plug %d", index+1),
+		basePower:  20 + rand.Float64()*200,
+		amplitude:  rand.Float64() * 150,
+		phase:      rand.Float64() * 2 * math.Pi,
+		started:    now,
+		energyWh:   rand.Float64() * 10000,
+		lastUpdate: now,
+	}
+}
+
+// power returns the current power in watts and advances the energy counter
+func (d *simulatedDevice) power() (power, energyWh float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	day := float64(now.Unix()%86400) / 86400
+	power = math.Max(d.basePower+d.amplitude*math.Sin(2*math.Pi*day+d.phase)+rand.NormFloat64()*5, 0)
+	d.energyWh += power * now.Sub(d.lastUpdate).Hours()
+	d.lastUpdate = now
+	return power, d.energyWh
+}
+
+// handler serves the HTTP API of the device's generation
+func (d *simulatedDevice) handler() http.Handler {
+	mux := http.NewServeMux()
+	if d.gen == 1 {
+		mux.HandleFunc("/shelly", func(w http.ResponseWriter, r *http.Request) {
+			writeSimulatorJSON(w, map[string]any{
+				"type": "SHPLG-S", "mac": d.mac, "auth": false,
+				"fw": "20230913-112003/v1.14.0-gcb84623", "num_outputs": 1, "num_meters": 1,
+			})
+		})
+		mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+			writeSimulatorJSON(w, map[string]any{
+				"device": map[string]any{"type": "SHPLG-S", "mac": d.mac, "hostname": "shellyplug-s-" + d.mac[6:]},
+				"name":   d.name,
+			})
+		})
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			power, energyWh := d.power()
+			writeSimulatorJSON(w, map[string]any{
+				"relays": []any{map[string]any{"ison": true, "has_timer": false, "overpower": false}},
+				"meters": []any{map[string]any{
+					"power": power, "is_valid": true, "timestamp": time.Now().Unix(), "total": energyWh * 60,
+				}},
+				"temperature": 30 + rand.Float64()*5,
+				"uptime":      int(time.Since(d.started).Seconds()),
+				"unixtime":    time.Now().Unix(),
+				"ram_total":   52064,
+				"ram_free":    38000 + rand.IntN(2000),
+				"fs_free":     162648,
+			})
+		})
+		return mux
+	}
+
+	id := "shellyplusplugs-" + strings.ToLower(d.mac)
+	mux.HandleFunc("/shelly", func(w http.ResponseWriter, r *http.Request) {
+		writeSimulatorJSON(w, map[string]any{
+			"id": id, "name": d.name, "mac": d.mac, "model": "SNPL-00112EU", "gen": 2,
+			"ver": "1.4.4", "app": "PlugS", "auth_en": false,
+		})
+	})
+	mux.HandleFunc("/rpc/Shelly.GetStatus", func(w http.ResponseWriter, r *http.Request) {
+		power, energyWh := d.power()
+		writeSimulatorJSON(w, map[string]any{
+			"switch:0": map[string]any{
+				"id": 0, "output": true, "apower": power, "voltage": 228 + rand.Float64()*4,
+				"current": power / 230, "aenergy": map[string]any{"total": energyWh},
+				"temperature": map[string]any{"tC": 35 + rand.Float64()*5},
+			},
+			"sys": map[string]any{
+				"mac": d.mac, "restart_required": false, "uptime": int(time.Since(d.started).Seconds()),
+				"unixtime": time.Now().Unix(), "ram_size": 246000, "ram_free": 110000 + rand.IntN(10000),
+				"fs_free": 200000, "cfg_rev": 1,
+			},
+		})
+	})
+	mux.HandleFunc("/rpc/Shelly.GetConfig", func(w http.ResponseWriter, r *http.Request) {
+		writeSimulatorJSON(w, map[string]any{
+			"switch:0": map[string]any{"id": 0, "name": d.name},
+			"sys":      map[string]any{"device": map[string]any{"name": d.name, "mac": d.mac}},
+		})
+	})
+	return mux
+}
+
+// writeSimulatorJSON writes v as a JSON response
+func writeSimulatorJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fixtureHandler replays the recorded responses of a fixture
+func fixtureHandler(f *fixture) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := f.Responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	})
+}
+
+// loadFixtures reads the fixtures written by the record subcommand from dir
+func loadFixtures(dir string) ([]*fixture, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no fixtures found in %s", dir)
+	}
+	fixtures := make([]*fixture, 0, len(paths))
+	for _, path := range paths {
+		f, err := loadFixture(path)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, f)
+	}
+	return fixtures, nil
+}
+
+// loadFixture reads a fixture written by the record subcommand
+func loadFixture(path string) (*fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing fixture %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// runSimulator implements the simulate subcommand: it serves the HTTP APIs
+// of fake Gen1 and Gen2 devices on consecutive local ports until interrupted.
+// With --fixtures, recorded devices are replayed instead.
+func runSimulator(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return simulate(ctx, args, os.Stderr)
+}
+
+// simulate serves the devices of the simulate subcommand until ctx is
+// cancelled and prints the TARGETS value covering them to w
+func simulate(ctx context.Context, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	count := flags.Int("devices", 10, "Number of devices to simulate")
+	host := flags.String("host", "127.0.0.1", "Address the devices listen on")
+	port := flags.Int("port", 10080, "Port of the first device; the others use the following ports, 0 for any free ports")
+	fixtureDir := flags.String("fixtures", "", "Replay the fixtures recorded to this directory instead")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var handlers []http.Handler
+	if *fixtureDir != "" {
+		fixtures, err := loadFixtures(*fixtureDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range fixtures {
+			handlers = append(handlers, fixtureHandler(f))
+		}
+	} else {
+		if *count < 1 {
+			return fmt.Errorf("invalid number of devices %d: must be at least 1", *count)
+		}
+		for i := range *count {
+			handlers = append(handlers, newSimulatedDevice(i).handler())
+		}
+	}
+
+	servers := make([]*http.Server, 0, len(handlers))
+	targets := make([]string, 0, len(handlers))
+	for i, handler := range handlers {
+		addr := net.JoinHostPort(*host, "0")
+		if *port != 0 {
+			addr = net.JoinHostPort(*host, strconv.Itoa(*port+i))
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, server := range servers {
+				server.Close()
+			}
+			return fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		addr = listener.Addr().String()
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+		servers = append(servers, server)
+		targets = append(targets, addr)
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Simulated device failed", "addr", addr, "error", err)
+			}
+		}()
+	}
+
+	slog.Info("Simulating Shelly devices", "devices", len(handlers), "first", targets[0], "last", targets[len(targets)-1])
+	fmt.Fprintf(w, "Point the exporter at the devices with:\n  TARGETS=%s\n", strings.Join(targets, ","))
+
+	<-ctx.Done()
+	for _, server := range servers {
+		server.Close()
+	}
+	return nil
+}
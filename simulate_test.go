@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startSimulator runs the simulate subcommand with args until the test ends
+// and returns the targets it prints
+func startSimulator(t *testing.T, args ...string) []string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- simulate(ctx, args, w)
+		w.Close()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("simulator failed: %v", err)
+		}
+	})
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if targets, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "TARGETS="); ok {
+			// Drain the rest of the output so the simulator never blocks
+			go io.Copy(io.Discard, r)
+			return strings.Split(targets, ",")
+		}
+	}
+	t.Fatal("simulator printed no targets")
+	return nil
+}
+
+// TestSimulatorScrape collects the simulated devices like a deployment
+// pointed at them and scrapes the result over HTTP
+func TestSimulatorScrape(t *testing.T) {
+	targets := startSimulator(t, "--devices", "4", "--port", "0")
+	if len(targets) != 4 {
+		t.Fatalf("got targets %v, want 4", targets)
+	}
+
+	cfg := defaultConfig()
+	cfg.NetworkRange = ""
+	cfg.Targets = targets
+	logs, err := newLogging(cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewShellyExporter(cfg, logs)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	server := httptest.NewServer(promhttp.HandlerFor(e.exposition(registry), promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if result := e.discoverDevices(ctx); result.Devices != 4 {
+		t.Fatalf("discovered %d devices, want 4", result.Devices)
+	}
+	e.collectMetricsFromKnownDevices(ctx, 0)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape failed: %s: %s", resp.Status, body)
+	}
+
+	// Half of the simulated devices are Gen1 plugs, the others Gen2 plugs
+	series := map[string]int{}
+	for line := range strings.Lines(string(body)) {
+		name, _, ok := strings.Cut(line, "{")
+		if ok && strings.Contains(line, `device_id="shelly`) {
+			series[name]++
+		}
+	}
+	for _, name := range []string{"shelly_power_watts", "shelly_energy_total_wh", "shelly_device_last_seen_timestamp_seconds"} {
+		if series[name] != 4 {
+			t.Errorf("got %d %s series, want 4", series[name], name)
+		}
+	}
+	if !strings.Contains(string(body), `device_type="SHPLG-S"`) || !strings.Contains(string(body), `device_type="SNPL-00112EU"`) {
+		t.Error("scrape lacks the Gen1 or Gen2 devices")
+	}
+}
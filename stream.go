@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber before
+// events are dropped for that subscriber
+const subscriberBuffer = 64
+
+// broadcaster fans out published values to all current subscribers without
+// blocking the publisher on slow subscribers
+type broadcaster[T any] struct {
+	mutex       sync.Mutex
+	subscribers map[chan T]struct{}
+	closed      bool
+}
+
+// newBroadcaster creates an empty broadcaster
+func newBroadcaster[T any]() *broadcaster[T] {
+	return &broadcaster[T]{subscribers: make(map[chan T]struct{})}
+}
+
+// subscribe registers a new subscriber; the returned channel is closed when
+// the broadcaster is closed
+func (b *broadcaster[T]) subscribe() chan T {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := make(chan T, subscriberBuffer)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe removes a subscriber
+func (b *broadcaster[T]) unsubscribe(ch chan T) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish sends v to all subscribers, dropping it for subscribers whose buffer is full
+func (b *broadcaster[T]) publish(v T) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
+
+// close closes all subscriber channels and rejects new subscribers
+func (b *broadcaster[T]) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// readingEvent is a device reading as sent to stream subscribers
+type readingEvent struct {
+	DeviceID    string    `json:"device_id"`
+	DeviceName  string    `json:"device_name"`
+	DeviceType  string    `json:"device_type"`
+	IP          string    `json:"ip"`
+	MAC         string    `json:"mac"`
+	Firmware    string    `json:"firmware"`
+	Source      string    `json:"source"`
+	PowerWatts  *float64  `json:"power_watts,omitempty"`
+	EnergyWh    *float64  `json:"energy_wh,omitempty"`
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// newReadingEvent creates the stream event for a device reading
+func newReadingEvent(reading *deviceReading) readingEvent {
+	return readingEvent{
+		DeviceID:    reading.device.DeviceID,
+		DeviceName:  reading.device.DeviceName,
+		DeviceType:  reading.device.DeviceType,
+		IP:          reading.device.IP,
+		MAC:         reading.device.Mac,
+		Firmware:    reading.device.Firmware,
+		Source:      reading.device.Source,
+		PowerWatts:  reading.power,
+		EnergyWh:    reading.energyWh,
+		CollectedAt: reading.collectedAt,
+	}
+}
+
+// streamKeepAlive is the interval of comment lines keeping idle streams open
+const streamKeepAlive = 30 * time.Second
+
+// streamHandler streams device readings as server-sent events
+func (e *ShellyExporter) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := e.events.subscribe()
+	defer e.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				e.collectionLog.Error("Error encoding stream event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// channelLabelNames identify a channel of a multi-channel device
+var channelLabelNames = append(append([]string{}, deviceLabelNames...), "channel", "channel_name")
+
+// switchDescs holds the descriptors of per-channel switch metrics
+type switchDescs struct {
+	output      *prometheus.Desc
+	power       *prometheus.Desc
+	energy      *prometheus.Desc
+	voltage     *prometheus.Desc
+	current     *prometheus.Desc
+	temperature *prometheus.Desc
+}
+
+// newSwitchDescs creates the descriptors of per-channel switch metrics
+func newSwitchDescs() switchDescs {
+	return switchDescs{
+		output: prometheus.NewDesc(
+			"shelly_switch_output",
+			"Whether the output of a switch channel is on (1) or off (0)",
+			channelLabelNames, nil,
+		),
+		power: prometheus.NewDesc(
+			"shelly_switch_power_watts",
+			"Active power of a switch channel in watts",
+			channelLabelNames, nil,
+		),
+		energy: prometheus.NewDesc(
+			"shelly_switch_energy_watt_hours_total",
+			"Active energy consumed on a switch channel in watt-hours",
+			channelLabelNames, nil,
+		),
+		voltage: prometheus.NewDesc(
+			"shelly_switch_voltage_volts",
+			"Supply voltage of a switch channel in volts",
+			channelLabelNames, nil,
+		),
+		current: prometheus.NewDesc(
+			"shelly_switch_current_amperes",
+			"Current of a switch channel in amperes",
+			channelLabelNames, nil,
+		),
+		temperature: prometheus.NewDesc(
+			"shelly_switch_temperature_celsius",
+			"Internal temperature of a switch channel in degrees Celsius",
+			channelLabelNames, nil,
+		),
+	}
+}
+
+// all returns all switch metric descriptors
+func (d switchDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.output,
+		d.power,
+		d.energy,
+		d.voltage,
+		d.current,
+		d.temperature,
+	}
+}
+
+// gen2Switch is the status of a switch:N component
+type gen2Switch struct {
+	Output  *bool    `json:"output"`
+	APower  *float64 `json:"apower"`
+	Voltage *float64 `json:"voltage"`
+	Current *float64 `json:"current"`
+	AEnergy *struct {
+		Total float64 `json:"total"`
+	} `json:"aenergy"`
+	Temperature *struct {
+		TC *float64 `json:"tC"`
+	} `json:"temperature"`
+	TimerStartedAt *float64 `json:"timer_started_at"`
+	TimerDuration  *float64 `json:"timer_duration"`
+}
+
+// gen2ComponentConfig holds the configuration fields common to all components
+type gen2ComponentConfig struct {
+	Name string `json:"name"`
+}
+
+// channelLabelValues returns the label values of a component of a Gen2+
+// device: the device labels, the component ID and its user-assigned name
+func channelLabelValues(reading *deviceReading, config *gen2Config, key string) []string {
+	_, id, _ := splitComponentKey(key)
+	var componentConfig gen2ComponentConfig
+	if config != nil {
+		config.components.component(key, &componentConfig)
+	}
+	return append(reading.labelValues(), strconv.Itoa(id), componentConfig.Name)
+}
+
+// switchSamples returns the per-channel samples of the switch components of
+// a Gen2+ device, e.g. the four channels of a Pro 4PM
+func (e *ShellyExporter) switchSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	config := e.cachedConfig(reading.device.DeviceID)
+
+	var samples []deviceSample
+	for _, key := range status.components("switch") {
+		var sw gen2Switch
+		if !reading.component(status, key, &sw) {
+			continue
+		}
+
+		var energy, temperature, onSeconds *float64
+		if sw.AEnergy != nil {
+			total := e.counters.monotonic(counterKey(&reading.device, key), sw.AEnergy.Total)
+			energy = &total
+		}
+		if sw.Temperature != nil {
+			temperature = sw.Temperature.TC
+		}
+		if sw.Output != nil {
+			seconds := e.relayOnSeconds(counterKey(&reading.device, key), *sw.Output)
+			onSeconds = &seconds
+		}
+		labelValues := channelLabelValues(reading, config, key)
+		samples = appendValues(samples, labelValues,
+			optionalValue{e.descs.switches.output, prometheus.GaugeValue, boolValue(sw.Output)},
+			optionalValue{e.descs.switches.power, prometheus.GaugeValue, sw.APower},
+			optionalValue{e.descs.switches.energy, prometheus.CounterValue, energy},
+			optionalValue{e.descs.switches.voltage, prometheus.GaugeValue, sw.Voltage},
+			optionalValue{e.descs.switches.current, prometheus.GaugeValue, sw.Current},
+			optionalValue{e.descs.switches.temperature, prometheus.GaugeValue, temperature},
+			optionalValue{e.descs.relays.onSeconds, prometheus.CounterValue, onSeconds},
+		)
+		samples = append(samples, e.gen2TimerSamples(labelValues, sw)...)
+	}
+	return samples
+}
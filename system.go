@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// systemDescs holds the descriptors of device system metrics
+type systemDescs struct {
+	ramFree         *prometheus.Desc
+	ramTotal        *prometheus.Desc
+	fsFree          *prometheus.Desc
+	uptime          *prometheus.Desc
+	restartRequired *prometheus.Desc
+	timeDrift       *prometheus.Desc
+	matterEnabled   *prometheus.Desc
+	matterFabrics   *prometheus.Desc
+	configHash      *prometheus.Desc
+}
+
+// newSystemDescs creates the descriptors of device system metrics
+func newSystemDescs() systemDescs {
+	return systemDescs{
+		ramFree: prometheus.NewDesc(
+			"shelly_ram_free_bytes",
+			"Free RAM of a Shelly device in bytes",
+			deviceLabelNames, nil,
+		),
+		ramTotal: prometheus.NewDesc(
+			"shelly_ram_total_bytes",
+			"Total RAM of a Shelly device in bytes",
+			deviceLabelNames, nil,
+		),
+		fsFree: prometheus.NewDesc(
+			"shelly_fs_free_bytes",
+			"Free space on the filesystem of a Shelly device in bytes",
+			deviceLabelNames, nil,
+		),
+		uptime: prometheus.NewDesc(
+			"shelly_uptime_seconds",
+			"Time since a Shelly device last started in seconds",
+			deviceLabelNames, nil,
+		),
+		restartRequired: prometheus.NewDesc(
+			"shelly_restart_required",
+			"Whether a Gen2+ device needs a restart to apply configuration changes (1) or not (0)",
+			deviceLabelNames, nil,
+		),
+		timeDrift: prometheus.NewDesc(
+			"shelly_time_drift_seconds",
+			"Difference between the clock of a Shelly device and the exporter's clock in seconds, with a resolution of one second",
+			deviceLabelNames, nil,
+		),
+		matterEnabled: prometheus.NewDesc(
+			"shelly_matter_enabled",
+			"Whether Matter is enabled on a Shelly device (1) or not (0)",
+			deviceLabelNames, nil,
+		),
+		matterFabrics: prometheus.NewDesc(
+			"shelly_matter_fabrics",
+			"Number of Matter fabrics a Shelly device is commissioned to; zero if it isn't commissioned",
+			deviceLabelNames, nil,
+		),
+		configHash: prometheus.NewDesc(
+			"shelly_config_hash",
+			"Hash of the watched configuration of a Shelly device: authentication, cloud connection, eco mode and power limits",
+			append(append([]string{}, deviceLabelNames...), "hash"), nil,
+		),
+	}
+}
+
+// all returns all device system metric descriptors
+func (d systemDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.ramFree,
+		d.ramTotal,
+		d.fsFree,
+		d.uptime,
+		d.restartRequired,
+		d.timeDrift,
+		d.matterEnabled,
+		d.matterFabrics,
+		d.configHash,
+	}
+}
+
+// gen2Sys is the status of the sys component of a Gen2+ device
+type gen2Sys struct {
+	RAMSize         *float64 `json:"ram_size"`
+	RAMFree         *float64 `json:"ram_free"`
+	FSFree          *float64 `json:"fs_free"`
+	Uptime          *float64 `json:"uptime"`
+	RestartRequired *bool    `json:"restart_required"`
+	Unixtime        *float64 `json:"unixtime"`
+}
+
+// gen1SystemSamples returns the system metrics in the status of a Gen1 device
+func (e *ShellyExporter) gen1SystemSamples(reading *deviceReading, status ShellyStatus) []deviceSample {
+	e.trackUptime(reading.device.DeviceID, status.Uptime)
+
+	d := e.descs.system
+	return appendValues(nil, reading.labelValues(),
+		optionalValue{d.ramFree, prometheus.GaugeValue, status.RAMFree},
+		optionalValue{d.ramTotal, prometheus.GaugeValue, status.RAMTotal},
+		optionalValue{d.fsFree, prometheus.GaugeValue, status.FSFree},
+		optionalValue{d.uptime, prometheus.GaugeValue, status.Uptime},
+	)
+}
+
+// gen2SystemSamples returns the system metrics in the sys status of a Gen2+ device
+func (e *ShellyExporter) gen2SystemSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	var sys gen2Sys
+	if !reading.component(status, "sys", &sys) {
+		return nil
+	}
+	e.trackUptime(reading.device.DeviceID, sys.Uptime)
+
+	d := e.descs.system
+	return appendValues(nil, reading.labelValues(),
+		optionalValue{d.ramFree, prometheus.GaugeValue, sys.RAMFree},
+		optionalValue{d.ramTotal, prometheus.GaugeValue, sys.RAMSize},
+		optionalValue{d.fsFree, prometheus.GaugeValue, sys.FSFree},
+		optionalValue{d.uptime, prometheus.GaugeValue, sys.Uptime},
+		optionalValue{d.restartRequired, prometheus.GaugeValue, boolValue(sys.RestartRequired)},
+	)
+}
+
+// gen2Matter is the status of the matter component of Matter-capable devices
+type gen2Matter struct {
+	NumFabrics *float64 `json:"num_fabrics"`
+}
+
+// gen2MatterConfig is the configuration of the matter component
+type gen2MatterConfig struct {
+	Enable *bool `json:"enable"`
+}
+
+// gen2MatterSamples returns whether Matter is enabled on a Gen2+ device and
+// the number of fabrics it's commissioned to, so devices also exposed to
+// another smart home controller can be audited
+func (e *ShellyExporter) gen2MatterSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	var matter gen2Matter
+	reading.component(status, "matter", &matter)
+	var config gen2MatterConfig
+	if cached := e.cachedConfig(reading.device.DeviceID); cached != nil {
+		cached.components.component("matter", &config)
+	}
+
+	d := e.descs.system
+	return appendValues(nil, reading.labelValues(),
+		optionalValue{d.matterEnabled, prometheus.GaugeValue, boolValue(config.Enable)},
+		optionalValue{d.matterFabrics, prometheus.GaugeValue, matter.NumFabrics},
+	)
+}
+
+// trackUptime counts a restart of the device when its uptime decreased
+// since the previous reading
+func (e *ShellyExporter) trackUptime(deviceID string, uptime *float64) {
+	if uptime == nil {
+		return
+	}
+	e.uptimesMutex.Lock()
+	defer e.uptimesMutex.Unlock()
+
+	previous, ok := e.uptimes[deviceID]
+	e.uptimes[deviceID] = *uptime
+	if ok && *uptime < previous {
+		e.deviceRestarts.WithLabelValues(deviceID).Inc()
+		e.collectionLog.Info("Device restarted", "device_id", deviceID, "uptime", *uptime, "previous_uptime", previous)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// TextfileConfig configures writing metrics to a file for the textfile
+// collector of node_exporter
+type TextfileConfig struct {
+	// Path of the .prom file in the collector's directory
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// enabled reports whether the textfile writer is configured
+func (c TextfileConfig) enabled() bool {
+	return c.Path != ""
+}
+
+// runTextfile writes the gathered metrics to the textfile every interval
+// until ctx is cancelled
+func runTextfile(ctx context.Context, cfg TextfileConfig, gatherer prometheus.Gatherer, log *slog.Logger) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := writeTextfile(cfg.Path, gatherer); err != nil {
+				log.Warn("Error writing metrics textfile", "path", cfg.Path, "error", err)
+			}
+		}
+	}
+}
+
+// writeTextfile writes the gathered metrics in the text exposition format.
+// The file is replaced atomically as node_exporter may read it at any time.
+func writeTextfile(path string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return fmt.Errorf("encoding metrics: %w", err)
+		}
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
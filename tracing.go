@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of discovery and collection. It is a no-op until
+// tracing is started.
+var tracer = otel.Tracer("shelly-exporter")
+
+// TracingConfig configures exporting traces of discovery and collection
+// cycles to an OpenTelemetry collector
+type TracingConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol"`
+	Headers  map[string]string `yaml:"headers"`
+	// SampleRatio is the fraction of cycles traced
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// enabled reports whether tracing is configured
+func (c TracingConfig) enabled() bool {
+	return c.Endpoint != ""
+}
+
+// startTracing installs a tracer provider exporting spans in batches to the
+// configured OTLP endpoint. The returned function flushes and stops the export.
+func startTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Protocol {
+	case otlpProtocolGRPC:
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpointURL(cfg.Endpoint),
+			otlptracegrpc.WithHeaders(cfg.Headers),
+		)
+	case otlpProtocolHTTP:
+		exporter, err = otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpointURL(cfg.Endpoint),
+			otlptracehttp.WithHeaders(cfg.Headers),
+		)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s': must be %q or %q", cfg.Protocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("shelly-exporter"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// deviceAttributes returns the span attributes identifying a device
+func deviceAttributes(dev *ShellyDevice) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("shelly.device_id", dev.DeviceID),
+		attribute.String("shelly.device_type", dev.DeviceType),
+		attribute.Int("shelly.generation", dev.Generation),
+		semconv.ServerAddress(dev.IP),
+	}
+}
+
+// startRequestSpan starts the span of a request to a device
+func startRequestSpan(ctx context.Context, req *http.Request) (context.Context, trace.Span) {
+	return tracer.Start(ctx, req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+			semconv.ServerAddress(req.URL.Host),
+		),
+	)
+}
+
+// endRequestSpan records the outcome of a device request and ends its span
+func endRequestSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= http.StatusBadRequest:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	span.End()
+}
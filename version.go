@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	// Fall back to the VCS information the go command embeds
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = setting.Value
+			}
+		case "vcs.time":
+			if date == "" {
+				date = setting.Value
+			}
+		}
+	}
+}
+
+// versionString returns the build information printed by --version
+func versionString() string {
+	return fmt.Sprintf("shelly-exporter %s (commit: %s, date: %s, go: %s)", version, orUnknown(commit), orUnknown(date), runtime.Version())
+}
+
+// orUnknown returns s, or "unknown" when it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
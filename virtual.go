@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// virtualDescs holds the descriptors of Gen2+ virtual components, which
+// scripts use to publish their own values
+type virtualDescs struct {
+	number  *prometheus.Desc
+	boolean *prometheus.Desc
+}
+
+// newVirtualDescs creates the descriptors of virtual component metrics
+func newVirtualDescs() virtualDescs {
+	return virtualDescs{
+		number: prometheus.NewDesc(
+			"shelly_virtual_number_value",
+			"Value of a virtual number component",
+			channelLabelNames, nil,
+		),
+		boolean: prometheus.NewDesc(
+			"shelly_virtual_boolean_value",
+			"Value of a virtual boolean component as 1 (true) or 0 (false)",
+			channelLabelNames, nil,
+		),
+	}
+}
+
+// all returns all virtual component metric descriptors
+func (d virtualDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.number,
+		d.boolean,
+	}
+}
+
+// virtualSamples returns the samples of the numeric and boolean virtual
+// components of a Gen2+ device, labeled with the component names
+func (e *ShellyExporter) virtualSamples(reading *deviceReading, status gen2Status) []deviceSample {
+	config := e.cachedConfig(reading.device.DeviceID)
+
+	var samples []deviceSample
+	for _, key := range status.components("number") {
+		var number struct {
+			Value *float64 `json:"value"`
+		}
+		if reading.component(status, key, &number) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{e.descs.virtual.number, prometheus.GaugeValue, number.Value})
+		}
+	}
+	for _, key := range status.components("boolean") {
+		var boolean struct {
+			Value *bool `json:"value"`
+		}
+		if reading.component(status, key, &boolean) {
+			samples = appendValues(samples, channelLabelValues(reading, config, key),
+				optionalValue{e.descs.virtual.boolean, prometheus.GaugeValue, boolValue(boolean.Value)})
+		}
+	}
+	return samples
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Voltage of a measuring point relative to the configured band
+const (
+	voltageNormal = iota
+	voltageSag
+	voltageSwell
+)
+
+// VoltageBandConfig configures the supply voltage band; voltages outside it
+// are counted as sag or swell events, e.g. 207 to 253 volts for the ±10% of
+// the nominal 230 volts allowed by EN 50160
+type VoltageBandConfig struct {
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+}
+
+// enabled reports whether a bound of the voltage band is configured
+func (c VoltageBandConfig) enabled() bool {
+	return c.Min > 0 || c.Max > 0
+}
+
+// compile validates the voltage band
+func (c VoltageBandConfig) compile() error {
+	if c.Min < 0 || c.Max < 0 {
+		return fmt.Errorf("invalid voltage band %g-%g: must not be negative", c.Min, c.Max)
+	}
+	if c.Min > 0 && c.Max > 0 && c.Min >= c.Max {
+		return fmt.Errorf("invalid voltage band %g-%g: minimum must be below maximum", c.Min, c.Max)
+	}
+	return nil
+}
+
+// state returns whether a voltage is within, below or above the band
+func (c VoltageBandConfig) state(voltage float64) int {
+	switch {
+	case c.Min > 0 && voltage < c.Min:
+		return voltageSag
+	case c.Max > 0 && voltage > c.Max:
+		return voltageSwell
+	}
+	return voltageNormal
+}
+
+// trackVoltage counts an excursion of the voltage at a measuring point of a
+// device, e.g. a phase, outside the configured band. Like error conditions,
+// an excursion is counted once when it starts, not in every reading.
+func (e *ShellyExporter) trackVoltage(dev *ShellyDevice, point string, voltage *float64) {
+	band := e.config.VoltageBand
+	if !band.enabled() || voltage == nil {
+		return
+	}
+	// Devices without mains voltage, e.g. on a DC supply, report zero
+	if *voltage <= 0 {
+		return
+	}
+
+	e.voltageStatesMutex.Lock()
+	defer e.voltageStatesMutex.Unlock()
+
+	key := counterKey(dev, point)
+	state := band.state(*voltage)
+	if e.voltageStates[key] == state {
+		return
+	}
+	switch state {
+	case voltageSag:
+		e.voltageSags.WithLabelValues(dev.DeviceID).Inc()
+	case voltageSwell:
+		e.voltageSwells.WithLabelValues(dev.DeviceID).Inc()
+	}
+	if state == voltageNormal {
+		delete(e.voltageStates, key)
+		return
+	}
+	e.voltageStates[key] = state
+}
+
+// trackGen1Voltages tracks the voltages of the energy meter channels in the
+// status of a Gen1 device
+func (e *ShellyExporter) trackGen1Voltages(dev *ShellyDevice, status ShellyStatus) {
+	for i, meter := range status.EMeters {
+		if meter.IsValid {
+			e.trackVoltage(dev, "emeter:"+strconv.Itoa(i), meter.Voltage)
+		}
+	}
+}
+
+// trackGen2Voltages tracks the voltages measured by the metering and energy
+// meter components in the status of a Gen2+ device
+func (e *ShellyExporter) trackGen2Voltages(dev *ShellyDevice, status gen2Status) {
+	for _, kind := range gen2MeterKinds {
+		for _, key := range status.components(kind) {
+			var meter gen2Meter
+			if status.component(key, &meter) {
+				e.trackVoltage(dev, key, meter.Voltage)
+			}
+		}
+	}
+	for _, key := range status.components("em") {
+		for phase, em := range status.phases(key) {
+			e.trackVoltage(dev, key+":"+phase, em.Voltage)
+		}
+	}
+	for _, key := range status.components("em1") {
+		var em gen2EM1
+		if status.component(key, &em) {
+			e.trackVoltage(dev, key, em.Voltage)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig configures HTTPS for the exporter's endpoints. Field names follow
+// the tls_server_config block of the Prometheus exporter-toolkit web config.
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	MinVersion     string `yaml:"min_version"`
+}
+
+// tlsVersions maps configurable TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// tlsClientAuthTypes maps configurable client auth types to their values
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// enabled reports whether HTTPS is configured
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// serverConfig builds the TLS configuration for the HTTP server
+func (c TLSConfig) serverConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("both cert_file and key_file must be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version '%s'", c.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if c.ClientAuthType != "" {
+		authType, ok := tlsClientAuthTypes[c.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type '%s'", c.ClientAuthType)
+		}
+		if authType >= tls.VerifyClientCertIfGiven && cfg.ClientCAs == nil {
+			return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuthType)
+		}
+		cfg.ClientAuth = authType
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// webhookEventPattern restricts webhook event names to keep label cardinality bounded
+var webhookEventPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// deviceByID returns the known device with the given ID
+func (e *ShellyExporter) deviceByID(deviceID string) *ShellyDevice {
+	e.devicesMutex.RLock()
+	defer e.devicesMutex.RUnlock()
+
+	if device, ok := e.pushedDevices[deviceID]; ok {
+		return device
+	}
+	if device, ok := e.cloudDevices[deviceID]; ok {
+		return device
+	}
+	for _, device := range e.knownDevices {
+		if device.DeviceID == deviceID {
+			return device
+		}
+	}
+	return nil
+}
+
+// isPushed reports whether the device pushes its status over a WebSocket
+func (e *ShellyExporter) isPushed(deviceID string) bool {
+	e.devicesMutex.RLock()
+	defer e.devicesMutex.RUnlock()
+
+	_, ok := e.pushedDevices[deviceID]
+	return ok
+}
+
+// webhookHandler receives Shelly action URL callbacks. The event name is
+// taken from the "event" query parameter, e.g.
+// /webhook/shellyplug-s-ddeeff?event=overpower. Each callback is counted and
+// triggers an immediate collection from the device. Callbacks of input
+// actions name the input, e.g. /webhook/shellyix3-aabbcc?input=0&event=longpush,
+// and are counted as input events as well.
+func (e *ShellyExporter) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("device_id")
+	device := e.deviceByID(deviceID)
+	if device == nil {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	event := r.FormValue("event")
+	if event == "" {
+		event = "unknown"
+	}
+	if !webhookEventPattern.MatchString(event) {
+		http.Error(w, "invalid event name", http.StatusBadRequest)
+		return
+	}
+
+	input := -1
+	if value := r.FormValue("input"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 0 {
+			http.Error(w, "invalid input", http.StatusBadRequest)
+			return
+		}
+		input = id
+	}
+
+	e.webhookEvents.WithLabelValues(deviceID, event).Inc()
+	if name, ok := inputEvent(event); ok && input >= 0 {
+		e.inputEvents.WithLabelValues(deviceID, strconv.Itoa(input), name).Inc()
+	}
+	e.collectionLog.Debug("Received webhook event", "device_id", deviceID, "event", event, "remote_addr", r.RemoteAddr)
+
+	// Refresh the device's state right away instead of waiting for the next
+	// poll; devices connected over a WebSocket push their state themselves
+	if e.isPushed(deviceID) || device.Source == sourceCloud {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	go func() {
+		if !e.collectShellyMetrics(context.Background(), device) {
+			e.forgetDevice(deviceID)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
+}
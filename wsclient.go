@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runRPCClients keeps a WebSocket RPC connection open to every known Gen2+
+// device until ctx is cancelled. Connected devices send status notifications
+// on every change, so they don't need to be polled. Unless enabled for all
+// devices, only input-only devices are connected to receive their events.
+// Devices requiring authentication stay polled, RPC frames aren't
+// authenticated.
+// A standby replica closes all connections until it becomes active.
+func (e *ShellyExporter) runRPCClients(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Connections are keyed by IP, like the known devices
+	clients := make(map[string]context.CancelFunc)
+	ticker := time.NewTicker(e.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		devices := make(map[string]ShellyDevice)
+		if !e.standby.Load() {
+			e.devicesMutex.RLock()
+			for ip, device := range e.knownDevices {
+				if device.AuthEnabled != nil && *device.AuthEnabled {
+					continue
+				}
+				if device.Generation >= 2 && (e.config.Gen2WebSocket || slices.Contains(inputDeviceModels, device.DeviceType)) {
+					devices[ip] = *device
+				}
+			}
+			e.devicesMutex.RUnlock()
+		}
+
+		for ip, cancel := range clients {
+			if _, ok := devices[ip]; !ok {
+				cancel()
+				delete(clients, ip)
+			}
+		}
+		for ip, device := range devices {
+			if _, ok := clients[ip]; ok {
+				continue
+			}
+			clientCtx, cancel := context.WithCancel(ctx)
+			clients[ip] = cancel
+			wg.Go(func() { e.runRPCClient(clientCtx, device) })
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.roleChanged:
+		}
+	}
+}
+
+// runRPCClient connects to the RPC WebSocket of a device and reconnects after
+// every metrics interval while the connection is down. It gives up once the
+// device rejects the connection's requests for lack of authentication.
+func (e *ShellyExporter) runRPCClient(ctx context.Context, dev ShellyDevice) {
+	url := fmt.Sprintf("ws://%s/rpc", dev.IP)
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, e.collectTimeout(&dev))
+		conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, url, nil)
+		cancel()
+		if err != nil {
+			e.collectionLog.Debug("Error connecting to device WebSocket", "device_id", dev.DeviceID, "ip", dev.IP, "error", err)
+		} else {
+			if errors.Is(e.serveDeviceConn(ctx, conn, dev.IP), errWSUnauthorized) {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.metricsInterval):
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timing of the keep-alive pings sent to devices connected over a WebSocket
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 3 * wsPingInterval
+)
+
+// IDs of the RPC requests sent to devices after they connect
+const (
+	wsRequestDeviceInfo = 1
+	wsRequestStatus     = 2
+	wsRequestConfig     = 3
+)
+
+// errWSUnauthorized is returned when a device rejects the unauthenticated
+// RPC frames of a WebSocket connection
+var errWSUnauthorized = errors.New("device requires authentication")
+
+// wsUpgrader accepts outbound WebSocket connections from devices, which don't
+// send an Origin header a browser would
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// gen2Frame is a JSON-RPC frame exchanged with a Gen2+ device: a request,
+// a response or a notification
+type gen2Frame struct {
+	ID     int             `json:"id,omitempty"`
+	Src    string          `json:"src,omitempty"`
+	Dst    string          `json:"dst,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// merge applies a partial NotifyStatus update to the status. Devices only
+// send the changed fields of a component, so fields are merged into the
+// component's previous status.
+func (s gen2Status) merge(update gen2Status) {
+	for key, raw := range update {
+		var prev, next map[string]any
+		if json.Unmarshal(s[key], &prev) != nil || json.Unmarshal(raw, &next) != nil {
+			s[key] = raw
+			continue
+		}
+		mergeFields(prev, next)
+		if merged, err := json.Marshal(prev); err == nil {
+			s[key] = merged
+		}
+	}
+}
+
+// mergeFields recursively copies the fields of src into dst
+func mergeFields(dst, src map[string]any) {
+	for k, v := range src {
+		if sub, ok := v.(map[string]any); ok {
+			if prev, ok := dst[k].(map[string]any); ok {
+				mergeFields(prev, sub)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// pushHandler is the server side of the outbound WebSocket of Gen2+ devices.
+// Devices configured with this endpoint as their outbound WebSocket server
+// push NotifyStatus messages, so they are collected without polling and
+// even when the exporter can't reach them. Devices can't send credentials
+// other than in the URL, so a bearer token must be passed as the "token"
+// query parameter. Connections are refused without authentication, e.g. on
+// a listener without credentials, as anyone could push any device's readings.
+func (e *ShellyExporter) pushHandler(w http.ResponseWriter, r *http.Request) {
+	if auth := requestAuth(r, e.config.Auth); !auth.enabled() || !auth.authorized(r) && !auth.validToken(r.URL.Query().Get("token")) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		e.collectionLog.Warn("Error accepting device WebSocket", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	_ = e.serveDeviceConn(r.Context(), conn, ip)
+}
+
+// serveDeviceConn handles a WebSocket connection to a Gen2+ device until it
+// closes or ctx is cancelled. The device is collected from its status
+// notifications and isn't polled once it sent its full status. Frames aren't
+// authenticated, so devices requiring authentication close the connection
+// with errWSUnauthorized and stay polled.
+func (e *ShellyExporter) serveDeviceConn(ctx context.Context, conn *websocket.Conn, ip string) error {
+	defer conn.Close()
+
+	// Ask for the device's identity and full status right away; until the
+	// identity is known, pushed status updates are only accumulated
+	requests := []gen2Frame{
+		{ID: wsRequestDeviceInfo, Src: "shelly-exporter", Method: "Shelly.GetDeviceInfo"},
+		{ID: wsRequestStatus, Src: "shelly-exporter", Method: "Shelly.GetStatus"},
+	}
+	for _, request := range requests {
+		if err := conn.WriteJSON(request); err != nil {
+			e.collectionLog.Warn("Error sending request to device WebSocket", "ip", ip, "error", err)
+			return nil
+		}
+	}
+
+	conn.SetReadLimit(1 << 20)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				// Unblocks the read loop below
+				conn.Close()
+				return
+			case <-ticker.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var device *ShellyDevice
+	status := gen2Status{}
+	configRequested := false
+	// The device is only registered as pushed, and no longer polled, once its
+	// full status arrived
+	fullStatus, pushed := false, false
+	defer func() {
+		if pushed {
+			e.devicesMutex.Lock()
+			if e.pushedDevices[device.DeviceID] == device {
+				delete(e.pushedDevices, device.DeviceID)
+			}
+			e.devicesMutex.Unlock()
+			e.collectionLog.Info("Device WebSocket disconnected", "device_id", device.DeviceID, "ip", ip)
+		}
+	}()
+
+	for {
+		var frame gen2Frame
+		if err := conn.ReadJSON(&frame); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				e.collectionLog.Debug("Error reading device WebSocket", "ip", ip, "error", err)
+			}
+			return nil
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		if frame.Error != nil && frame.Error.Code == http.StatusUnauthorized {
+			e.collectionLog.Info("Device WebSocket requires authentication, polling the device instead", "src", frame.Src, "ip", ip)
+			return errWSUnauthorized
+		}
+		if frame.Error != nil {
+			e.collectionLog.Warn("Device WebSocket request failed", "src", frame.Src, "ip", ip, "code", frame.Error.Code, "message", frame.Error.Message)
+			continue
+		}
+
+		switch {
+		case frame.ID == wsRequestDeviceInfo && frame.Result != nil:
+			var info ShellyInfo
+			if err := json.Unmarshal(frame.Result, &info); err != nil {
+				e.collectionLog.Warn("Error decoding device info", "src", frame.Src, "ip", ip, "error", err)
+				continue
+			}
+			if device = newGen2Device(ip, info); device == nil {
+				e.collectionLog.Warn("Device WebSocket sent no device ID", "ip", ip)
+				return nil
+			}
+			if e.config.excludedType(device.DeviceType) {
+				e.collectionLog.Debug("Closing WebSocket of excluded device type", "device_id", device.DeviceID, "device_type", device.DeviceType)
+				device = nil
+				return nil
+			}
+			if !e.config.inShard(device) {
+				e.collectionLog.Debug("Closing WebSocket of device in another shard", "device_id", device.DeviceID)
+				device = nil
+				return nil
+			}
+		case frame.ID == wsRequestStatus && frame.Result != nil, frame.Method == "NotifyFullStatus":
+			raw := frame.Params
+			if frame.Result != nil {
+				raw = frame.Result
+			}
+			var full gen2Status
+			if err := json.Unmarshal(raw, &full); err != nil {
+				e.collectionLog.Warn("Error decoding device status", "src", frame.Src, "ip", ip, "error", err)
+				continue
+			}
+			status = full
+			fullStatus = true
+		case frame.Method == "NotifyStatus":
+			var update gen2Status
+			if err := json.Unmarshal(frame.Params, &update); err != nil {
+				e.collectionLog.Warn("Error decoding device status", "src", frame.Src, "ip", ip, "error", err)
+				continue
+			}
+			status.merge(update)
+		case frame.Method == "NotifyEvent":
+			if device != nil {
+				e.countGen2Events(device, frame.Params)
+			}
+			continue
+		case frame.ID == wsRequestConfig && frame.Result != nil:
+			configRequested = false
+			var config gen2Status
+			if err := json.Unmarshal(frame.Result, &config); err != nil || device == nil {
+				continue
+			}
+			e.storeConfig(device.DeviceID, status.configRevision(), config)
+		default:
+			continue
+		}
+
+		// Fetch the configuration over the same connection, the device may
+		// not be reachable otherwise
+		if device != nil && !configRequested && e.needsConfig(device.DeviceID, status) {
+			if err := conn.WriteJSON(gen2Frame{ID: wsRequestConfig, Src: "shelly-exporter", Method: "Shelly.GetConfig"}); err != nil {
+				return nil
+			}
+			configRequested = true
+		}
+
+		if device != nil && fullStatus {
+			e.devicesMutex.Lock()
+			if !pushed && !e.acceptPushedDevice(device) {
+				e.devicesMutex.Unlock()
+				e.collectionLog.Warn("Closing WebSocket of device over the device limit", "device_id", device.DeviceID, "max_devices", e.config.MaxDevices)
+				device = nil
+				return nil
+			}
+			device.LastSeen = time.Now()
+			e.devicesMutex.Unlock()
+			if !pushed {
+				pushed = true
+				e.collectionLog.Info("Device WebSocket connected", "device_id", device.DeviceID, "device_name", device.DeviceName, "ip", ip)
+			}
+			reading := e.newGen2Reading(device, status)
+			// Pushed updates are merged, the document is rebuilt from them
+			reading.raw, _ = json.Marshal(status)
+			e.storeReading(reading)
+		}
+	}
+}